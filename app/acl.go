@@ -0,0 +1,287 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/alejoacosta74/go-logger"
+	"github.com/alejoacosta74/libp2p-chat-app/p2p/acl"
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// roomMembers holds the access control list of a restricted room, which is
+// replaced whenever the owner signs a new one
+type roomMembers struct {
+	mu  sync.RWMutex
+	acl *acl.ACL
+	// changeMu serializes the changes we make to the list as its owner, from
+	// reading it to saving the signed result, so that they don't sign the
+	// same sequence number
+	changeMu sync.Mutex
+}
+
+func newRoomMembers(a *acl.ACL) *roomMembers {
+	return &roomMembers{acl: a}
+}
+
+// get returns the current list
+func (r *roomMembers) get() *acl.ACL {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.acl
+}
+
+// IsMember reports whether the peer is allowed to publish in the room
+func (r *roomMembers) IsMember(p peer.ID) bool {
+	return r.get().IsMember(p)
+}
+
+// update replaces the list if next is a newer list of the same room and
+// owner. It returns false if next was ignored.
+func (r *roomMembers) update(next *acl.ACL) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if next.Room != r.acl.Room || next.Owner != r.acl.Owner || next.Seq <= r.acl.Seq {
+		return false
+	}
+	r.acl = next
+	return true
+}
+
+// EnableInvitations lets us create restricted rooms, signing their access
+// control lists with key, and invite members to them. The invitations
+// received from the owners of other rooms are kept pending until accepted,
+// and pushed to the Invitations channel.
+func (rm *RoomManager) EnableInvitations(svc *acl.Service, key crypto.PrivKey) {
+	rm.mu.Lock()
+	rm.invites = svc
+	rm.privKey = key
+	rm.mu.Unlock()
+	go rm.receiveInvitations(svc)
+}
+
+// Invitations returns the channel of invitations to restricted rooms received from their owners.
+func (rm *RoomManager) Invitations() <-chan *acl.Invitation {
+	return rm.invitedChan
+}
+
+// Create creates a restricted room owned by us, end-to-end encrypted if
+// passphrase is not empty, and joins it. Other peers can only publish in the
+// room once invited.
+func (rm *RoomManager) Create(roomName, passphrase string) (*ChatRoom, error) {
+	rm.mu.RLock()
+	key := rm.privKey
+	_, joined := rm.rooms[roomName]
+	rm.mu.RUnlock()
+	if key == nil {
+		return nil, errors.New("restricted rooms are not enabled")
+	}
+	if joined {
+		return nil, fmt.Errorf("already in room %q", roomName)
+	}
+
+	roomACL := acl.New(roomName, rm.self)
+	if err := roomACL.Sign(key); err != nil {
+		return nil, fmt.Errorf("failed to sign access control list: %w", err)
+	}
+	rm.saveACL(roomACL)
+	return rm.join(roomName, passphrase, roomACL)
+}
+
+// Invite adds the peer to the members of a restricted room we own, shares
+// the new access control list with the room, and delivers the invitation to
+// the peer.
+func (rm *RoomManager) Invite(ctx context.Context, roomName string, p peer.ID) error {
+	rm.mu.RLock()
+	cr, ok := rm.rooms[roomName]
+	svc, key := rm.invites, rm.privKey
+	rm.mu.RUnlock()
+	if !ok {
+		return fmt.Errorf("not in room %q", roomName)
+	}
+	if svc == nil {
+		return errors.New("restricted rooms are not enabled")
+	}
+	if cr.members == nil {
+		return fmt.Errorf("room %q is open to anyone", roomName)
+	}
+	roomACL, err := rm.addMember(cr, p, key)
+	if err != nil {
+		return err
+	}
+	return svc.Send(ctx, p, &acl.Invitation{ACL: roomACL, Encrypted: cr.Encrypted(), SenderNick: rm.Nick()})
+}
+
+// addMember adds the peer to the members of the room we own, then saves and
+// publishes the signed list. It returns the list including the peer.
+func (rm *RoomManager) addMember(cr *ChatRoom, p peer.ID, key crypto.PrivKey) (*acl.ACL, error) {
+	cr.members.changeMu.Lock()
+	defer cr.members.changeMu.Unlock()
+
+	roomACL := cr.members.get()
+	if roomACL.Owner != rm.self.String() {
+		return nil, acl.ErrNotOwner
+	}
+	// peers already members are sent the invitation again, e.g. if they lost it
+	if roomACL.IsMember(p) {
+		return roomACL, nil
+	}
+	next := roomACL.Add(p)
+	if err := next.Sign(key); err != nil {
+		return nil, fmt.Errorf("failed to sign access control list: %w", err)
+	}
+	// a newer list may have been received from another node sharing our identity
+	if !cr.members.update(next) {
+		return nil, fmt.Errorf("members of room %s changed while inviting %s, try again", cr.roomName, p)
+	}
+	rm.saveACL(next)
+	if err := cr.PublishACL(next); err != nil {
+		logger.Warnf("failed to publish members of room %s: %v", cr.roomName, err)
+	}
+	return next, nil
+}
+
+// Invited returns the names of the rooms with a pending invitation, sorted
+func (rm *RoomManager) Invited() []string {
+	rm.mu.RLock()
+	defer rm.mu.RUnlock()
+	names := make([]string, 0, len(rm.pending))
+	for name := range rm.pending {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Accept accepts the pending invitation to the restricted room, saves its
+// access control list and joins the room, end-to-end encrypted if passphrase
+// is not empty.
+func (rm *RoomManager) Accept(roomName, passphrase string) (*ChatRoom, error) {
+	rm.mu.RLock()
+	inv, ok := rm.pending[roomName]
+	cr, joined := rm.rooms[roomName]
+	rm.mu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("no pending invitation to room %q", roomName)
+	}
+	if inv.Encrypted && passphrase == "" {
+		return nil, fmt.Errorf("room %q is encrypted, its passphrase is required", roomName)
+	}
+	roomACL := inv.ACL
+	if stored := rm.storedACL(roomName); stored != nil {
+		if stored.Owner != roomACL.Owner {
+			return nil, fmt.Errorf("room %q is already owned by %s", roomName, stored.Owner)
+		}
+		if stored.Seq > roomACL.Seq {
+			roomACL = stored
+		}
+	}
+	if joined && cr.members == nil {
+		return nil, fmt.Errorf("room %q is joined as an open room, leave it first", roomName)
+	}
+
+	rm.saveACL(roomACL)
+	cr, err := rm.join(roomName, passphrase, roomACL)
+	if err != nil {
+		return nil, err
+	}
+	rm.mu.Lock()
+	if rm.pending[roomName] == inv {
+		delete(rm.pending, roomName)
+	}
+	rm.mu.Unlock()
+	return cr, nil
+}
+
+// receiveInvitations keeps the invitations received from room owners pending
+// until they are accepted. The invitations to rooms owned by another peer are
+// dropped, so that nobody can take over a room we already joined.
+func (rm *RoomManager) receiveInvitations(svc *acl.Service) {
+	for {
+		select {
+		case inv := <-svc.Invitations():
+			roomName := inv.ACL.Room
+			stored := rm.storedACL(roomName)
+			if stored != nil && stored.Owner != inv.ACL.Owner {
+				logger.Warnf("ignoring invitation to room %s from %s, which is owned by %s", roomName, inv.ACL.Owner, stored.Owner)
+				continue
+			}
+			// the owner of a room we accepted is trusted with its new lists
+			if stored != nil && stored.Seq < inv.ACL.Seq {
+				rm.saveACL(inv.ACL)
+			}
+			if cr, ok := rm.Room(roomName); ok && cr.members != nil {
+				cr.members.update(inv.ACL)
+			}
+			rm.mu.Lock()
+			rm.pending[roomName] = inv
+			rm.mu.Unlock()
+			select {
+			case rm.invitedChan <- inv:
+			case <-rm.ctx.Done():
+				return
+			}
+		case <-rm.ctx.Done():
+			return
+		}
+	}
+}
+
+// announceACL waits for the restricted room to have topic peers and shares
+// its access control list with them, so that the peers who missed the last
+// invitations learn about the new members
+func (rm *RoomManager) announceACL(cr *ChatRoom) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	timeout := time.After(syncWaitTimeout)
+
+	for len(cr.ListPeers()) == 0 {
+		select {
+		case <-ticker.C:
+		case <-timeout:
+			return
+		case <-cr.ctx.Done():
+			return
+		}
+	}
+	if err := cr.PublishACL(cr.ACL()); err != nil {
+		logger.Debugf("failed to publish members of room %s: %v", cr.roomName, err)
+	}
+}
+
+// storedACL returns the access control list saved for the room, or nil if
+// the room is open to anyone
+func (rm *RoomManager) storedACL(roomName string) *acl.ACL {
+	if rm.store == nil {
+		return nil
+	}
+	data, err := rm.store.ACL(roomName)
+	if err != nil || data == nil {
+		return nil
+	}
+	roomACL, err := acl.Decode(data)
+	if err != nil {
+		logger.Warnf("ignoring invalid access control list of room %s: %v", roomName, err)
+		return nil
+	}
+	return roomACL
+}
+
+// saveACL saves the access control list of the room to the history store
+func (rm *RoomManager) saveACL(roomACL *acl.ACL) {
+	if rm.store == nil {
+		return
+	}
+	data, err := roomACL.Encode()
+	if err == nil {
+		err = rm.store.PutACL(roomACL.Room, data)
+	}
+	if err != nil {
+		logger.Warnf("failed to save access control list of room %s: %v", roomACL.Room, err)
+	}
+}
@@ -0,0 +1,88 @@
+package app
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	"github.com/alejoacosta74/libp2p-chat-app/p2p/acl"
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	"github.com/libp2p/go-libp2p/core/peer"
+	mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
+)
+
+func TestAddMemberConcurrently(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	mn := mocknet.New()
+	defer mn.Close()
+	key, _ := newTestKey(t)
+	h, err := mn.AddPeer(key, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ps, err := pubsub.NewGossipSub(ctx, h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rm := NewRoomManager(ctx, ps, h.ID(), "owner", nil)
+	rm.privKey = key
+	cr, err := rm.Create("private", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rm.Leave("private")
+
+	// the invitations sent at once must all make it to the list
+	const n = 20
+	invited := make([]peer.ID, n)
+	for i := range invited {
+		_, invited[i] = newTestKey(t)
+	}
+	var wg sync.WaitGroup
+	lists := make([]*acl.ACL, n)
+	for i, p := range invited {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			l, err := rm.addMember(cr, p, key)
+			if err != nil {
+				t.Errorf("inviting %s: %v", p, err)
+				return
+			}
+			lists[i] = l
+		}()
+	}
+	wg.Wait()
+
+	final := cr.ACL()
+	if final.Seq != n {
+		t.Errorf("got seq %d, want %d", final.Seq, n)
+	}
+	if err := final.Verify(); err != nil {
+		t.Error(err)
+	}
+	seqs := make(map[uint64]bool)
+	for i, p := range invited {
+		if !final.IsMember(p) {
+			t.Errorf("%s is missing from the members", p)
+		}
+		// every invitee gets a distinct list including itself
+		if l := lists[i]; l != nil {
+			if !l.IsMember(p) || seqs[l.Seq] {
+				t.Errorf("%s got list seq %d, not including it or shared with another invitee", p, l.Seq)
+			}
+			seqs[l.Seq] = true
+		}
+	}
+
+	// inviting a member again returns the current list, without signing a new one
+	again, err := rm.addMember(cr, invited[0], key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again.Seq != final.Seq {
+		t.Errorf("got seq %d inviting a member again, want %d", again.Seq, final.Seq)
+	}
+}
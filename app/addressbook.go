@@ -0,0 +1,220 @@
+package app
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/alejoacosta74/go-logger"
+	"github.com/alejoacosta74/libp2p-chat-app/history"
+	"github.com/alejoacosta74/libp2p-chat-app/p2p/nickname"
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// suffixLen is the number of peer ID characters appended to the nicknames
+// used by several peers
+const suffixLen = 6
+
+// AddressBook maps the peer IDs to the nicknames they announced, in
+// announcements signed by the peers. It is saved to the history store, if any.
+type AddressBook struct {
+	self  peer.ID
+	key   crypto.PrivKey // signs our announcements
+	store *history.Store // optional, persists the announcements
+
+	mu      sync.RWMutex
+	entries map[peer.ID]*nickname.Announcement
+	encoded map[peer.ID][]byte // encoded announcements, to skip the ones already known
+}
+
+// NewAddressBook creates the address book of the peer with the given key,
+// announcing nick unless it is empty, and loads the announcements saved in store.
+func NewAddressBook(key crypto.PrivKey, nick string, store *history.Store) (*AddressBook, error) {
+	self, err := peer.IDFromPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	b := &AddressBook{
+		self:    self,
+		key:     key,
+		store:   store,
+		entries: make(map[peer.ID]*nickname.Announcement),
+		encoded: make(map[peer.ID][]byte),
+	}
+	if store != nil {
+		saved, err := store.Peers()
+		if err != nil {
+			return nil, fmt.Errorf("failed to load address book: %w", err)
+		}
+		for id, data := range saved {
+			p, err := peer.Decode(id)
+			if err != nil || p == self {
+				continue
+			}
+			if _, err := b.Update(p, data); err != nil {
+				logger.Debugf("ignoring saved nickname of %s: %v", id, err)
+			}
+		}
+	}
+
+	if nick == "" {
+		return b, nil
+	}
+	if err := b.SetNick(nick); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// SetNick signs a new announcement of our nickname
+func (b *AddressBook) SetNick(nick string) error {
+	own, err := nickname.New(b.key, nick)
+	if err != nil {
+		return err
+	}
+	return b.put(b.self, own)
+}
+
+// Self returns our encoded announcement, published in the presence heartbeats
+func (b *AddressBook) Self() []byte {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.encoded[b.self]
+}
+
+// Update records the encoded announcement received from the peer, if it is
+// newer than the one known. It reports whether the nickname of the peer changed.
+func (b *AddressBook) Update(from peer.ID, data []byte) (bool, error) {
+	b.mu.RLock()
+	known := bytes.Equal(b.encoded[from], data)
+	b.mu.RUnlock()
+	if known {
+		return false, nil
+	}
+
+	a, err := nickname.Decode(data)
+	if err != nil {
+		return false, err
+	}
+	if a.Peer != from.String() {
+		return false, fmt.Errorf("announcement of %s sent by %s", a.Peer, from)
+	}
+	b.mu.Lock()
+	prev, ok := b.entries[from]
+	b.mu.Unlock()
+	if ok && prev.Timestamp >= a.Timestamp {
+		return false, nil
+	}
+	if err := b.put(from, a); err != nil {
+		return false, err
+	}
+	return !ok || prev.Nick != a.Nick, nil
+}
+
+// put records the announcement of the peer, and saves it to the store
+func (b *AddressBook) put(p peer.ID, a *nickname.Announcement) error {
+	data, err := a.Encode()
+	if err != nil {
+		return err
+	}
+	b.mu.Lock()
+	b.entries[p] = a
+	b.encoded[p] = data
+	b.mu.Unlock()
+	if b.store != nil && p != b.self {
+		if err := b.store.PutPeer(p.String(), data); err != nil {
+			logger.Warnf("failed to save nickname of %s: %v", p, err)
+		}
+	}
+	return nil
+}
+
+// Nick returns the nickname announced by the peer
+func (b *AddressBook) Nick(p peer.ID) (string, bool) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	a, ok := b.entries[p]
+	if !ok {
+		return "", false
+	}
+	return a.Nick, true
+}
+
+// Name returns the name the peer is shown with: the nickname it announced,
+// or fallback if it announced none and fallback is a valid nickname. The
+// nicknames used by several peers get a suffix of the peer ID, e.g. alice#kXz9Qe.
+func (b *AddressBook) Name(p peer.ID, fallback string) string {
+	nick, ok := b.Nick(p)
+	if !ok && nickname.Validate(fallback) == nil {
+		nick = fallback
+	}
+	if nick == "" {
+		return "#" + idSuffix(p)
+	}
+	if b.collides(p, nick) {
+		return nick + "#" + idSuffix(p)
+	}
+	return nick
+}
+
+// Lookup returns the peer shown with the given name, either a nickname used
+// by a single peer, or a nickname with a peer ID suffix
+func (b *AddressBook) Lookup(name string) (peer.ID, bool) {
+	nick, suffix, hasSuffix := strings.Cut(name, "#")
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	var found []peer.ID
+	for p, a := range b.entries {
+		if !strings.EqualFold(a.Nick, nick) && nick != "" {
+			continue
+		}
+		if hasSuffix && !strings.HasSuffix(p.String(), suffix) {
+			continue
+		}
+		found = append(found, p)
+	}
+	if len(found) != 1 {
+		return "", false
+	}
+	return found[0], true
+}
+
+// Names returns the names the other peers of the book are shown with
+func (b *AddressBook) Names() []string {
+	b.mu.RLock()
+	peers := make([]peer.ID, 0, len(b.entries))
+	for p := range b.entries {
+		if p != b.self {
+			peers = append(peers, p)
+		}
+	}
+	b.mu.RUnlock()
+	names := make([]string, 0, len(peers))
+	for _, p := range peers {
+		names = append(names, b.Name(p, ""))
+	}
+	return names
+}
+
+// collides reports whether another peer announced the nickname
+func (b *AddressBook) collides(p peer.ID, nick string) bool {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	for other, a := range b.entries {
+		if other != p && strings.EqualFold(a.Nick, nick) {
+			return true
+		}
+	}
+	return false
+}
+
+// idSuffix returns the last characters of the peer ID
+func idSuffix(p peer.ID) string {
+	s := p.String()
+	if len(s) <= suffixLen {
+		return s
+	}
+	return s[len(s)-suffixLen:]
+}
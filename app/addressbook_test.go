@@ -0,0 +1,158 @@
+package app
+
+import (
+	"crypto/rand"
+	"testing"
+	"time"
+
+	"github.com/alejoacosta74/libp2p-chat-app/p2p/nickname"
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+func newTestKey(t *testing.T) (crypto.PrivKey, peer.ID) {
+	t.Helper()
+	key, _, err := crypto.GenerateEd25519Key(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := peer.IDFromPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key, id
+}
+
+// announce returns the encoded announcement of the nickname, signed with key
+func announce(t *testing.T, key crypto.PrivKey, nick string) []byte {
+	t.Helper()
+	// announcements are ordered by their timestamp in milliseconds
+	time.Sleep(2 * time.Millisecond)
+	a, err := nickname.New(key, nick)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := a.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestAddressBookUpdate(t *testing.T) {
+	selfKey, _ := newTestKey(t)
+	aliceKey, alice := newTestKey(t)
+	_, mallory := newTestKey(t)
+
+	first := announce(t, aliceKey, "alice")
+	renamed := announce(t, aliceKey, "alicia")
+
+	tests := []struct {
+		name        string
+		from        peer.ID
+		data        []byte
+		wantChanged bool
+		wantErr     bool
+		wantNick    string
+	}{
+		{name: "first announcement", from: alice, data: first, wantChanged: true, wantNick: "alice"},
+		{name: "same announcement", from: alice, data: first, wantNick: "alice"},
+		{name: "relayed by another peer", from: mallory, data: first, wantErr: true, wantNick: "alice"},
+		{name: "garbage", from: alice, data: []byte("garbage"), wantErr: true, wantNick: "alice"},
+		{name: "newer nickname", from: alice, data: renamed, wantChanged: true, wantNick: "alicia"},
+		{name: "replayed older nickname", from: alice, data: first, wantNick: "alicia"},
+	}
+	// the cases run in order against the same book
+	b, err := NewAddressBook(selfKey, "me", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range tests {
+		changed, err := b.Update(tt.from, tt.data)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: got error %v, want error %v", tt.name, err, tt.wantErr)
+		}
+		if changed != tt.wantChanged {
+			t.Errorf("%s: got changed %v, want %v", tt.name, changed, tt.wantChanged)
+		}
+		if nick, _ := b.Nick(alice); nick != tt.wantNick {
+			t.Errorf("%s: got nickname %q, want %q", tt.name, nick, tt.wantNick)
+		}
+	}
+	if _, ok := b.Nick(mallory); ok {
+		t.Error("the relaying peer got the nickname of alice")
+	}
+}
+
+func TestAddressBookCollisions(t *testing.T) {
+	selfKey, _ := newTestKey(t)
+	aliceKey, alice := newTestKey(t)
+	otherKey, other := newTestKey(t)
+	bobKey, bob := newTestKey(t)
+	_, unknown := newTestKey(t)
+
+	b, err := NewAddressBook(selfKey, "me", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for p, data := range map[peer.ID][]byte{
+		alice: announce(t, aliceKey, "alice"),
+		other: announce(t, otherKey, "Alice"),
+		bob:   announce(t, bobKey, "bob"),
+	} {
+		if _, err := b.Update(p, data); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the nicknames rendering as, or copying, the name of another peer can't
+	// be announced
+	for _, nick := range []string{"bob[-]", "bob ", " bob", "bob#" + idSuffix(bob)} {
+		if _, err := nickname.New(otherKey, nick); err == nil {
+			t.Errorf("announced nickname %q", nick)
+		}
+	}
+
+	names := []struct {
+		p        peer.ID
+		fallback string
+		want     string
+	}{
+		{p: alice, want: "alice#" + idSuffix(alice)},
+		{p: other, want: "Alice#" + idSuffix(other)},
+		{p: bob, want: "bob"},
+		{p: bob, fallback: "carol", want: "bob"},
+		{p: unknown, want: "#" + idSuffix(unknown)},
+		{p: unknown, fallback: "carol", want: "carol"},
+		{p: unknown, fallback: "BOB", want: "BOB#" + idSuffix(unknown)},
+		// invalid nicknames claimed in the messages are not shown
+		{p: unknown, fallback: "bob[-]", want: "#" + idSuffix(unknown)},
+		{p: unknown, fallback: "bob ", want: "#" + idSuffix(unknown)},
+		{p: unknown, fallback: "bob#" + idSuffix(bob), want: "#" + idSuffix(unknown)},
+	}
+	for _, tt := range names {
+		if got := b.Name(tt.p, tt.fallback); got != tt.want {
+			t.Errorf("Name(%s, %q): got %q, want %q", tt.p, tt.fallback, got, tt.want)
+		}
+	}
+
+	lookups := []struct {
+		name   string
+		want   peer.ID
+		wantOK bool
+	}{
+		{name: "bob", want: bob, wantOK: true},
+		{name: "BOB", want: bob, wantOK: true},
+		{name: "alice"},
+		{name: "alice#" + idSuffix(alice), want: alice, wantOK: true},
+		{name: "alice#" + idSuffix(other), want: other, wantOK: true},
+		{name: "#" + idSuffix(bob), want: bob, wantOK: true},
+		{name: "carol"},
+	}
+	for _, tt := range lookups {
+		got, ok := b.Lookup(tt.name)
+		if ok != tt.wantOK || got != tt.want {
+			t.Errorf("Lookup(%q): got %s, %v, want %s, %v", tt.name, got, ok, tt.want, tt.wantOK)
+		}
+	}
+}
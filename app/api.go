@@ -0,0 +1,450 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/alejoacosta74/go-logger"
+	"github.com/alejoacosta74/libp2p-chat-app/p2p/node"
+	"github.com/libp2p/go-libp2p/core/peer"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+// maxAPIRequestSize is the maximum size of an API request body
+const maxAPIRequestSize = 64 * 1024
+
+// APIServer serves a local HTTP/JSON API to drive the chat node from scripts,
+// bots or integration tests. It has no authentication, so it only listens on
+// a Unix socket or a loopback address, and refuses the requests web pages
+// could send: the ones for another host name than a loopback one, the ones
+// from another origin, and the POST requests without a JSON body.
+//
+//	GET    /v1/node                   node info
+//	GET    /v1/peers                  connected peers
+//	GET    /v1/rooms                  joined rooms
+//	POST   /v1/rooms                  join a room, {"Room": "name"}
+//	DELETE /v1/rooms/{room}           leave a room
+//	GET    /v1/rooms/{room}/peers     topic peers of a room
+//	POST   /v1/rooms/{room}/messages  publish a message, {"Message": "text"}
+//	POST   /v1/rooms/{room}/invites   invite a peer to a restricted room, {"Peer": "ID"}
+//	GET    /v1/messages[?room=name]   stream of received messages, one JSON object per line
+type APIServer struct {
+	node   *node.Node
+	rm     *RoomManager
+	server *http.Server
+}
+
+// NodeInfo is returned by GET /v1/node
+type NodeInfo struct {
+	ID           string
+	Nickname     string
+	Addrs        []string
+	Reachability string
+	Peers        int
+	Rooms        []string
+}
+
+// PeerInfo is returned by GET /v1/peers
+type PeerInfo struct {
+	ID    string
+	Addrs []string
+}
+
+// RoomInfo is returned by GET /v1/rooms and POST /v1/rooms
+type RoomInfo struct {
+	Name      string
+	Peers     []string
+	Unread    int
+	Throttled uint64
+	Encrypted bool
+	// Owner and Members are set for the rooms restricted to their members
+	Owner   string   `json:",omitempty"`
+	Members []string `json:",omitempty"`
+	// Presence holds the status of the peers that recently sent a heartbeat
+	Presence []*Presence
+}
+
+// JoinRequest is the body of POST /v1/rooms. Setting a passphrase joins an
+// end-to-end encrypted room. Setting Create creates a room restricted to the
+// members we invite, and setting Accept accepts the invitation to a
+// restricted room.
+type JoinRequest struct {
+	Room       string
+	Passphrase string `json:",omitempty"`
+	Create     bool   `json:",omitempty"`
+	Accept     bool   `json:",omitempty"`
+}
+
+// InviteRequest is the body of POST /v1/rooms/{room}/invites
+type InviteRequest struct {
+	Peer string
+}
+
+// PublishRequest is the body of POST /v1/rooms/{room}/messages
+type PublishRequest struct {
+	Message string
+}
+
+// apiError is the body of the error responses
+type apiError struct {
+	Error string
+}
+
+// NewAPIServer creates the API server of the node and its rooms
+func NewAPIServer(n *node.Node, rm *RoomManager) *APIServer {
+	s := &APIServer{node: n, rm: rm}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /v1/node", s.handleNode)
+	mux.HandleFunc("GET /v1/peers", s.handlePeers)
+	mux.HandleFunc("GET /v1/rooms", s.handleRooms)
+	mux.HandleFunc("POST /v1/rooms", s.handleJoin)
+	mux.HandleFunc("DELETE /v1/rooms/{room}", s.handleLeave)
+	mux.HandleFunc("GET /v1/rooms/{room}/peers", s.handleRoomPeers)
+	mux.HandleFunc("POST /v1/rooms/{room}/messages", s.handlePublish)
+	mux.HandleFunc("POST /v1/rooms/{room}/invites", s.handleInvite)
+	mux.HandleFunc("GET /v1/messages", s.handleMessages)
+
+	s.server = &http.Server{
+		Handler:           checkRequest(mux),
+		ReadHeaderTimeout: 10 * time.Second,
+		BaseContext:       func(net.Listener) context.Context { return rm.ctx },
+	}
+	return s
+}
+
+// Listen starts serving the API on addr, either "unix:<path>" or a loopback
+// "host:port" address
+func (s *APIServer) Listen(addr string) error {
+	ln, err := listenAPI(addr)
+	if err != nil {
+		return err
+	}
+	go func() {
+		if err := s.server.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logger.Errorf("control API stopped: %v", err)
+		}
+	}()
+	logger.Infof("Control API listening on %s", addr)
+	return nil
+}
+
+// Close stops the API server, ending the open message streams
+func (s *APIServer) Close() error {
+	return s.server.Close()
+}
+
+// listenAPI opens the listener of the API, refusing non-loopback TCP addresses
+func listenAPI(addr string) (net.Listener, error) {
+	if path, ok := strings.CutPrefix(addr, "unix:"); ok {
+		// remove the socket left behind by a previous run
+		if fi, err := os.Stat(path); err == nil && fi.Mode()&fs.ModeSocket != 0 {
+			os.Remove(path)
+		}
+		ln, err := net.Listen("unix", path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to listen on %s: %w", path, err)
+		}
+		if err := os.Chmod(path, 0o600); err != nil {
+			ln.Close()
+			return nil, fmt.Errorf("failed to restrict access to %s: %w", path, err)
+		}
+		return ln, nil
+	}
+
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid API address %q: %w", addr, err)
+	}
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return nil, fmt.Errorf("API address %q is not a loopback address", addr)
+	}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on %s: %w", addr, err)
+	}
+	return ln, nil
+}
+
+// checkRequest rejects the requests a web page visited by the user could
+// send to the API: cross-site requests, which carry a foreign Origin, and
+// DNS rebinding, which reaches the loopback address with a foreign Host.
+// Browsers can't reach a Unix socket, so the clients of the socket may use
+// any host name, e.g. http://unix/v1/node. The POST requests must have a JSON
+// body, as the simple requests of browsers, sent without preflight, can't.
+func checkRequest(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !onUnixSocket(r) {
+			if !isLoopbackHost(r.Host) {
+				writeError(w, http.StatusForbidden, fmt.Errorf("host %q is not a loopback address", r.Host))
+				return
+			}
+			if origin := r.Header.Get("Origin"); origin != "" {
+				u, err := url.Parse(origin)
+				if err != nil || u.Host != r.Host {
+					writeError(w, http.StatusForbidden, fmt.Errorf("cross-origin request from %q", origin))
+					return
+				}
+			}
+		}
+		if r.Method == http.MethodPost {
+			mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+			if mediaType != "application/json" {
+				writeError(w, http.StatusUnsupportedMediaType, errors.New("content type must be application/json"))
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// onUnixSocket reports whether the request was received on a Unix socket
+func onUnixSocket(r *http.Request) bool {
+	addr, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr)
+	return ok && addr.Network() == "unix"
+}
+
+// isLoopbackHost reports whether the host, with an optional port, is localhost or a loopback IP
+func isLoopbackHost(hostport string) bool {
+	host, _, err := net.SplitHostPort(hostport)
+	if err != nil {
+		host = hostport
+	}
+	host = strings.Trim(host, "[]")
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+func (s *APIServer) handleNode(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, &NodeInfo{
+		ID:           s.node.ID().String(),
+		Nickname:     s.rm.Nick(),
+		Addrs:        addrStrings(s.node.Addrs()),
+		Reachability: s.node.Reachability().String(),
+		Peers:        len(s.node.Network().Peers()),
+		Rooms:        s.rm.Rooms(),
+	})
+}
+
+func (s *APIServer) handlePeers(w http.ResponseWriter, r *http.Request) {
+	peers := []*PeerInfo{}
+	for _, p := range s.node.Network().Peers() {
+		peers = append(peers, &PeerInfo{
+			ID:    p.String(),
+			Addrs: addrStrings(s.node.Peerstore().Addrs(p)),
+		})
+	}
+	writeJSON(w, http.StatusOK, peers)
+}
+
+func (s *APIServer) handleRooms(w http.ResponseWriter, r *http.Request) {
+	rooms := []*RoomInfo{}
+	for _, name := range s.rm.Rooms() {
+		if info, ok := s.roomInfo(name); ok {
+			rooms = append(rooms, info)
+		}
+	}
+	writeJSON(w, http.StatusOK, rooms)
+}
+
+func (s *APIServer) handleJoin(w http.ResponseWriter, r *http.Request) {
+	var req JoinRequest
+	if !readJSON(w, r, &req) {
+		return
+	}
+	join := s.rm.Join
+	switch {
+	case req.Create:
+		join = func(roomName string) (*ChatRoom, error) {
+			return s.rm.Create(roomName, req.Passphrase)
+		}
+	case req.Accept:
+		join = func(roomName string) (*ChatRoom, error) {
+			return s.rm.Accept(roomName, req.Passphrase)
+		}
+	case req.Passphrase != "":
+		join = func(roomName string) (*ChatRoom, error) {
+			return s.rm.JoinEncrypted(roomName, req.Passphrase)
+		}
+	}
+	if _, err := join(req.Room); err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Errorf("failed to join room %s: %w", req.Room, err))
+		return
+	}
+	info, _ := s.roomInfo(req.Room)
+	writeJSON(w, http.StatusCreated, info)
+}
+
+func (s *APIServer) handleLeave(w http.ResponseWriter, r *http.Request) {
+	roomName := r.PathValue("room")
+	if _, ok := s.rm.Room(roomName); !ok {
+		writeError(w, http.StatusNotFound, fmt.Errorf("not in room %q", roomName))
+		return
+	}
+	if err := s.rm.Leave(roomName); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *APIServer) handleRoomPeers(w http.ResponseWriter, r *http.Request) {
+	info, ok := s.roomInfo(r.PathValue("room"))
+	if !ok {
+		writeError(w, http.StatusNotFound, fmt.Errorf("not in room %q", r.PathValue("room")))
+		return
+	}
+	writeJSON(w, http.StatusOK, info.Peers)
+}
+
+func (s *APIServer) handlePublish(w http.ResponseWriter, r *http.Request) {
+	cr, ok := s.rm.Room(r.PathValue("room"))
+	if !ok {
+		writeError(w, http.StatusNotFound, fmt.Errorf("not in room %q", r.PathValue("room")))
+		return
+	}
+	var req PublishRequest
+	if !readJSON(w, r, &req) {
+		return
+	}
+	if strings.TrimSpace(req.Message) == "" {
+		writeError(w, http.StatusBadRequest, errors.New("empty message"))
+		return
+	}
+	if err := cr.Publish(req.Message); err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Errorf("failed to publish message: %w", err))
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (s *APIServer) handleInvite(w http.ResponseWriter, r *http.Request) {
+	roomName := r.PathValue("room")
+	if _, ok := s.rm.Room(roomName); !ok {
+		writeError(w, http.StatusNotFound, fmt.Errorf("not in room %q", roomName))
+		return
+	}
+	var req InviteRequest
+	if !readJSON(w, r, &req) {
+		return
+	}
+	p, err := peer.Decode(req.Peer)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid peer ID: %w", err))
+		return
+	}
+	if err := s.rm.Invite(r.Context(), roomName, p); err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Errorf("failed to invite %s: %w", p, err))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleMessages streams the messages received in the joined rooms, or in a
+// single room if the room query parameter is set, until the client goes away
+func (s *APIServer) handleMessages(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, errors.New("streaming not supported"))
+		return
+	}
+	roomName, filter := "", r.URL.Query().Has("room")
+	if filter {
+		roomName = r.URL.Query().Get("room")
+	}
+
+	msgs, cancel := s.rm.Subscribe()
+	defer cancel()
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	enc := json.NewEncoder(w)
+	for {
+		select {
+		case m := <-msgs:
+			if filter && m.Room != roomName {
+				continue
+			}
+			if err := enc.Encode(m); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// roomInfo describes a joined room
+func (s *APIServer) roomInfo(roomName string) (*RoomInfo, bool) {
+	cr, ok := s.rm.Room(roomName)
+	if !ok {
+		return nil, false
+	}
+	peers := []string{}
+	for _, p := range cr.ListPeers() {
+		peers = append(peers, p.String())
+	}
+	info := &RoomInfo{
+		Name:      roomName,
+		Peers:     peers,
+		Unread:    s.rm.Unread(roomName),
+		Throttled: s.rm.Throttled(roomName),
+		Encrypted: cr.Encrypted(),
+		Presence:  cr.Presence(),
+	}
+	if info.Presence == nil {
+		info.Presence = []*Presence{}
+	}
+	if roomACL := cr.ACL(); roomACL != nil {
+		info.Owner = roomACL.Owner
+		info.Members = roomACL.Members
+	}
+	return info, true
+}
+
+func addrStrings(addrs []ma.Multiaddr) []string {
+	out := make([]string, 0, len(addrs))
+	for _, a := range addrs {
+		out = append(out, a.String())
+	}
+	return out
+}
+
+// readJSON decodes the request body, writing an error response on failure
+func readJSON(w http.ResponseWriter, r *http.Request, v any) bool {
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxAPIRequestSize))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid request body: %w", err))
+		return false
+	}
+	return true
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		logger.Debugf("failed to write API response: %v", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, &apiError{Error: err.Error()})
+}
@@ -0,0 +1,87 @@
+package app
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCheckRequest(t *testing.T) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+
+	// serve returns a client of the API checks listening on addr, and the base URL to reach them
+	serve := func(addr string) (*http.Client, string) {
+		ln, err := listenAPI(addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		server := &http.Server{Handler: checkRequest(ok)}
+		go server.Serve(ln)
+		t.Cleanup(func() { server.Close() })
+		if ln.Addr().Network() != "unix" {
+			return http.DefaultClient, "http://" + ln.Addr().String()
+		}
+		client := &http.Client{Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return new(net.Dialer).DialContext(ctx, "unix", ln.Addr().String())
+			},
+		}}
+		return client, "http://unix"
+	}
+	unixClient, unixURL := serve("unix:" + filepath.Join(t.TempDir(), "api.sock"))
+	tcpClient, tcpURL := serve("127.0.0.1:0")
+
+	tests := []struct {
+		name        string
+		unix        bool
+		method      string
+		host        string
+		origin      string
+		contentType string
+		wantStatus  int
+	}{
+		{name: "loopback", method: http.MethodGet, wantStatus: http.StatusOK},
+		{name: "localhost", method: http.MethodGet, host: "localhost", wantStatus: http.StatusOK},
+		{name: "foreign host", method: http.MethodGet, host: "evil.example.com", wantStatus: http.StatusForbidden},
+		{name: "foreign origin", method: http.MethodGet, origin: "http://evil.example.com", wantStatus: http.StatusForbidden},
+		{name: "json post", method: http.MethodPost, contentType: "application/json", wantStatus: http.StatusOK},
+		{name: "form post", method: http.MethodPost, contentType: "text/plain", wantStatus: http.StatusUnsupportedMediaType},
+		// browsers can't reach the socket, whatever host name the clients use
+		{name: "unix", unix: true, method: http.MethodGet, wantStatus: http.StatusOK},
+		{name: "unix with an origin", unix: true, method: http.MethodGet, origin: "http://evil.example.com", wantStatus: http.StatusOK},
+		{name: "unix json post", unix: true, method: http.MethodPost, contentType: "application/json", wantStatus: http.StatusOK},
+		{name: "unix form post", unix: true, method: http.MethodPost, contentType: "text/plain", wantStatus: http.StatusUnsupportedMediaType},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, base := tcpClient, tcpURL
+			if tt.unix {
+				client, base = unixClient, unixURL
+			}
+			req, err := http.NewRequest(tt.method, base+"/v1/node", strings.NewReader("{}"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.host != "" {
+				req.Host = tt.host
+			}
+			if tt.origin != "" {
+				req.Header.Set("Origin", tt.origin)
+			}
+			if tt.contentType != "" {
+				req.Header.Set("Content-Type", tt.contentType)
+			}
+			resp, err := client.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != tt.wantStatus {
+				t.Errorf("got status %d, want %d", resp.StatusCode, tt.wantStatus)
+			}
+		})
+	}
+}
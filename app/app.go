@@ -2,31 +2,50 @@ package app
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
 
 	"github.com/alejoacosta74/go-logger"
+	"github.com/alejoacosta74/libp2p-chat-app/history"
 	uilogger "github.com/alejoacosta74/libp2p-chat-app/logger"
+	"github.com/alejoacosta74/libp2p-chat-app/p2p/acl"
+	"github.com/alejoacosta74/libp2p-chat-app/p2p/discovery"
+	"github.com/alejoacosta74/libp2p-chat-app/p2p/dm"
+	"github.com/alejoacosta74/libp2p-chat-app/p2p/filetransfer"
+	"github.com/alejoacosta74/libp2p-chat-app/p2p/historysync"
+	"github.com/alejoacosta74/libp2p-chat-app/p2p/identity"
+	"github.com/alejoacosta74/libp2p-chat-app/p2p/message"
 	"github.com/alejoacosta74/libp2p-chat-app/p2p/node"
+	"github.com/alejoacosta74/libp2p-chat-app/p2p/ratelimit"
+	"github.com/libp2p/go-libp2p/core/pnet"
 	"github.com/spf13/viper"
 )
 
-func Run(ctx context.Context) error {
-	// Create a new libp2p node with the provided context
-	p2pNode := node.NewNode(ctx)
-
-	// Initialize the GossipSub pubsub service for p2p message broadcasting
-	ps, err := p2pNode.CreatePubSubService()
-	if err != nil {
-		return err
-	}
+// services holds the node and the chat services shared by the terminal UI and the daemon
+type services struct {
+	node    *node.Node
+	rm      *RoomManager
+	dms     *dm.Service
+	invites *acl.Service
+	files   *filetransfer.Service
+	store   *history.Store
+	syncer  *historysync.Service
+	api     *APIServer // optional, local control API
+	web     *WebBridge // optional, browser chat client
+}
 
-	// Join the specified chat room using the pubsub service, node ID, and user preferences
-	cr, err := JoinChatRoom(ctx, ps, p2pNode.ID(), viper.GetString("nickname"), viper.GetString("room"))
+// Run starts the node and the chat services, and blocks in the terminal UI until exit
+func Run(ctx context.Context) error {
+	svc, err := startServices(ctx)
 	if err != nil {
 		return err
 	}
+	defer svc.close()
 
-	// Create the terminal UI instance for the chat room
-	ui := NewChatUI(cr)
+	// Create the terminal UI instance for the chat rooms
+	ui := NewChatUI(svc.node, svc.rm, svc.dms, svc.files)
 	// Initialize the global UI logger to capture logs in the UI
 	uilogger.InitGlobalLogger(ui)
 	// Redirect all logger output to the UI logger
@@ -37,7 +56,7 @@ func Run(ctx context.Context) error {
 	}
 
 	// Initialize the p2p node, starting discovery services and event listeners
-	err = p2pNode.Init()
+	err = svc.node.Init()
 	if err != nil {
 		return err
 	}
@@ -45,3 +64,222 @@ func Run(ctx context.Context) error {
 	// Start the terminal UI event loop and block until exit
 	return ui.Run()
 }
+
+// startServices creates the libp2p node, the pubsub service and the chat
+// services, and joins the configured room. The node is not initialized yet,
+// so that the caller can set up logging before discovery starts.
+func startServices(ctx context.Context) (_ *services, err error) {
+	// Load the persistent node identity, generating one on first run
+	ks := identity.NewKeyStore(viper.GetString("identity"), viper.GetString("identity-passphrase"))
+	privKey, err := ks.LoadOrCreate()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load identity from %s: %w", ks.Path(), err)
+	}
+
+	// Create a new libp2p node with the provided context
+	nodeConfig := node.NewNodeConfig()
+	nodeConfig.PrivKey = privKey
+	nodeConfig.ListenAddrs = viper.GetStringSlice("listen")
+	nodeConfig.Validator.MaxMessageSize = viper.GetInt("max-message-size")
+	nodeConfig.Validator.MaxClockSkew = viper.GetDuration("max-clock-skew")
+	if err := viper.UnmarshalKey("pubsub.score", nodeConfig.Score); err != nil {
+		return nil, fmt.Errorf("invalid peer score configuration: %w", err)
+	}
+	if err := viper.UnmarshalKey("nat", nodeConfig.NAT); err != nil {
+		return nil, fmt.Errorf("invalid NAT traversal configuration: %w", err)
+	}
+	if relays := viper.GetStringSlice("relay"); len(relays) > 0 {
+		nodeConfig.NAT.StaticRelays = relays
+	}
+	nodeConfig.Discovery = discoveryConfig()
+	if nodeConfig.SwarmKey, err = swarmKey(); err != nil {
+		return nil, err
+	}
+	p2pNode, err := node.NewNode(ctx, nodeConfig)
+	if err != nil {
+		return nil, err
+	}
+	svc := &services{node: p2pNode}
+	// release whatever was set up if a later step fails
+	defer func() {
+		if err != nil {
+			svc.close()
+		}
+	}()
+
+	// Expose the Prometheus metrics of the node and the chat rooms, if enabled
+	if err := registerMetrics(p2pNode.MetricsRegistry()); err != nil {
+		return nil, fmt.Errorf("failed to register metrics: %w", err)
+	}
+	if addr := viper.GetString("metrics"); addr != "" {
+		if err := p2pNode.ServeMetrics(addr); err != nil {
+			return nil, fmt.Errorf("failed to serve metrics: %w", err)
+		}
+	}
+
+	// Initialize the GossipSub pubsub service for p2p message broadcasting
+	ps, err := p2pNode.CreatePubSubService()
+	if err != nil {
+		return nil, err
+	}
+
+	// Open the local message store used for the chat history
+	svc.store, err = history.Open(viper.GetString("history"))
+	if err != nil {
+		return nil, err
+	}
+
+	// Create the room manager holding the chat rooms joined on the pubsub service
+	rm := NewRoomManager(ctx, ps, p2pNode.ID(), viper.GetString("nickname"), svc.store)
+	format, err := message.ParseFormat(viper.GetString("wire-format"))
+	if err != nil {
+		return nil, err
+	}
+	rm.SetWireFormat(format)
+	rm.SetValidator(p2pNode.Validator())
+	rm.SetTopicScoreParams(p2pNode.TopicScoreParams())
+	rateLimit := &ratelimit.Config{Rate: viper.GetFloat64("rate-limit.rate"), Burst: viper.GetInt("rate-limit.burst")}
+	// rooms overriding the rate limits inherit the settings they leave out
+	roomLimits := make(map[string]*ratelimit.Config)
+	for name := range viper.GetStringMap("rate-limit.rooms") {
+		cfg := *rateLimit
+		if err := viper.UnmarshalKey("rate-limit.rooms."+name, &cfg); err != nil {
+			return nil, fmt.Errorf("invalid rate limit configuration of room %s: %w", name, err)
+		}
+		roomLimits[name] = &cfg
+	}
+	rm.SetRateLimits(rateLimit, roomLimits)
+	svc.rm = rm
+
+	// Announce our nickname in the rooms, and keep the ones announced by the other peers
+	book, err := NewAddressBook(privKey, viper.GetString("nickname"), svc.store)
+	if err != nil {
+		return nil, err
+	}
+	rm.EnableAddressBook(book)
+
+	// Serve our history to other peers, and fetch the messages we missed when joining a room
+	svc.syncer = historysync.NewService(p2pNode, svc.store, rm.authorizeHistory)
+	rm.EnableHistorySync(svc.syncer)
+
+	// Deliver and receive the invitations to restricted rooms
+	svc.invites = acl.NewService(ctx, p2pNode)
+	rm.EnableInvitations(svc.invites, privKey)
+
+	// Join the specified chat room using user preferences, encrypted if a
+	// passphrase is set. More rooms can be joined later on from the UI
+	if passphrase := viper.GetString("room-passphrase"); passphrase != "" {
+		_, err = rm.JoinEncrypted(viper.GetString("room"), passphrase)
+	} else {
+		_, err = rm.Join(viper.GetString("room"))
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Register the direct message protocol on the node
+	svc.dms = dm.NewService(ctx, p2pNode, viper.GetString("nickname"))
+
+	// Serve the files shared in the rooms, and download the ones shared by other peers
+	svc.files = filetransfer.NewService(p2pNode, rm.authorizeFile)
+
+	// Serve the local control API, if enabled
+	if addr := viper.GetString("api"); addr != "" {
+		api := NewAPIServer(p2pNode, rm)
+		if err := api.Listen(addr); err != nil {
+			return nil, fmt.Errorf("failed to start control API: %w", err)
+		}
+		svc.api = api
+	}
+
+	// Serve the web chat client, if enabled
+	if addr := viper.GetString("web"); addr != "" {
+		web := NewWebBridge(rm, viper.GetString("web-token"))
+		if err := web.Listen(addr); err != nil {
+			return nil, fmt.Errorf("failed to start web bridge: %w", err)
+		}
+		svc.web = web
+	}
+	return svc, nil
+}
+
+// discoveryConfig reads the DHT settings from the "dht" section of the config file and the flags
+func discoveryConfig() *discovery.DiscoveryConfig {
+	cfg := discovery.NewDiscoveryConfig()
+	if mode := viper.GetString("dht.mode"); mode != "" {
+		cfg.DHTMode = mode
+	}
+	cfg.DHTProtocolPrefix = viper.GetString("dht.protocol-prefix")
+	cfg.BootstrapPeers = viper.GetStringSlice("dht.bootstrap")
+	if timeout := viper.GetDuration("dht.bootstrap-timeout"); timeout > 0 {
+		cfg.BootstrapTimeout = timeout
+	}
+	return cfg
+}
+
+// swarmKey loads the pre-shared key of the private network, if one is configured
+func swarmKey() (pnet.PSK, error) {
+	path := viper.GetString("swarm-key")
+	if path == "" {
+		return nil, nil
+	}
+	return node.LoadSwarmKey(path)
+}
+
+// saveSetting writes the setting to the config file, creating it if needed.
+// The file is read again, so that the settings coming from the flags and the
+// environment are not written to it.
+func saveSetting(key string, value any) error {
+	path := viper.ConfigFileUsed()
+	if path == "" {
+		return errors.New("no config file")
+	}
+	v := viper.New()
+	v.SetConfigFile(path)
+	if err := v.ReadInConfig(); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to read config file: %w", err)
+	}
+	v.Set(key, value)
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return fmt.Errorf("failed to create config directory: %w", err)
+	}
+	if err := v.WriteConfigAs(path); err != nil {
+		return fmt.Errorf("failed to write config file: %w", err)
+	}
+	return nil
+}
+
+// close stops the control API and the web bridge, leaves the joined rooms, stops the node and closes the history store
+func (svc *services) close() {
+	if svc.api != nil {
+		svc.api.Close()
+	}
+	if svc.web != nil {
+		svc.web.Close()
+	}
+	if svc.rm != nil {
+		for _, roomName := range svc.rm.Rooms() {
+			if err := svc.rm.Leave(roomName); err != nil {
+				logger.Debugf("failed to leave room %s: %v", roomName, err)
+			}
+		}
+	}
+	if svc.dms != nil {
+		svc.dms.Close()
+	}
+	if svc.invites != nil {
+		svc.invites.Close()
+	}
+	if svc.files != nil {
+		svc.files.Close()
+	}
+	if svc.syncer != nil {
+		svc.syncer.Close()
+	}
+	if err := svc.node.Close(); err != nil {
+		logger.Warnf("failed to close node: %v", err)
+	}
+	if svc.store != nil {
+		svc.store.Close()
+	}
+}
@@ -3,8 +3,19 @@ package app
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
 
 	"github.com/alejoacosta74/go-logger"
+	"github.com/alejoacosta74/libp2p-chat-app/history"
+	"github.com/alejoacosta74/libp2p-chat-app/p2p/acl"
+	"github.com/alejoacosta74/libp2p-chat-app/p2p/filetransfer"
+	"github.com/alejoacosta74/libp2p-chat-app/p2p/historysync"
+	"github.com/alejoacosta74/libp2p-chat-app/p2p/message"
+	"github.com/alejoacosta74/libp2p-chat-app/p2p/nickname"
+	"github.com/alejoacosta74/libp2p-chat-app/p2p/ratelimit"
 	"github.com/libp2p/go-libp2p/core/peer"
 
 	pubsub "github.com/libp2p/go-libp2p-pubsub"
@@ -17,31 +28,84 @@ const ChatRoomBufSize = 128
 // can be published to the topic with ChatRoom.Publish, and received
 // messages are pushed to the Messages channel.
 type ChatRoom struct {
-	ctx   context.Context
-	ps    *pubsub.PubSub
-	topic *pubsub.Topic
-	sub   *pubsub.Subscription
+	ctx    context.Context
+	cancel context.CancelFunc
+	ps     *pubsub.PubSub
+	topic  *pubsub.Topic
+	sub    *pubsub.Subscription
 
 	roomName string
-	self     peer.ID
-	nick     string
+	// historyName is the name the messages are saved under in the history store
+	historyName string
+	self        peer.ID
+	mu          sync.RWMutex
+	nick        string             // guarded by mu
+	shared      map[string]bool    // hashes of the files we offered in the room, guarded by mu
+	store       *history.Store     // optional, persists sent and received messages
+	format      message.Format     // encoding of the published envelopes
+	limiter     *ratelimit.Limiter // optional, throttles the messages of each sender
+	key         *message.RoomKey   // optional, encrypts the messages of the room
+	members     *roomMembers       // optional, restricts the room to its members
+	presence    *presence          // status of the peers of the room
+	book        *AddressBook       // optional, nicknames announced by the peers
+	// forwardOnly rooms relay the heartbeats of the peers without publishing ours
+	forwardOnly bool
 
 	outboundChan chan *ChatMessage // messages to be sent to the chat room
 	inboundChan  chan *ChatMessage // messages received from the chat room
 }
 
-// ChatMessage gets converted to/from JSON and sent in the body of pubsub messages.
+// ChatMessage is a message exchanged in a chat room. It is wrapped in a
+// message.Envelope in the body of pubsub messages.
 type ChatMessage struct {
+	ID         string
+	Timestamp  int64 // unix milliseconds
 	Message    string
 	SenderID   string
 	SenderNick string
+	// Error is set, and the other fields left empty, for the messages of an
+	// encrypted room that could not be decrypted
+	Error string `json:",omitempty"`
+	// File is set for the messages sharing a file, whose text describes it
+	File *filetransfer.Offer `json:",omitempty"`
+	// Notice is set for the events of the room shown instead of a message,
+	// e.g. a nickname change. They are not saved to the history.
+	Notice bool `json:",omitempty"`
+}
+
+// RoomOptions holds the optional settings of a ChatRoom, see JoinChatRoom.
+type RoomOptions struct {
+	// Format is the encoding of the published envelopes, protobuf if empty
+	Format message.Format
+	// Store, if not nil, saves every message sent and received in the room
+	Store *history.Store
+	// Limiter, if not nil, drops the messages of a sender exceeding its rate
+	// before they reach the Messages channel
+	Limiter *ratelimit.Limiter
+	// Key, if not nil, end-to-end encrypts the messages, the room being joined
+	// on a topic derived from the key instead of the room name
+	Key *message.RoomKey
+	// Members, if not nil, restricts the room to the members of its access
+	// control list, the room being joined on a topic of its owner
+	Members *roomMembers
+	// Book, if not nil, announces our nickname in the presence heartbeats, and
+	// records the announcements of the peers
+	Book *AddressBook
+	// ForwardOnly joins the presence topic only to relay the heartbeats of the
+	// peers: none is published, nor recorded
+	ForwardOnly bool
 }
 
 // JoinChatRoom tries to subscribe to the PubSub topic for the room name, returning
 // a ChatRoom on success.
-func JoinChatRoom(ctx context.Context, ps *pubsub.PubSub, selfID peer.ID, nickname string, roomName string) (*ChatRoom, error) {
+func JoinChatRoom(ctx context.Context, ps *pubsub.PubSub, selfID peer.ID, nickname string, roomName string, opts RoomOptions) (*ChatRoom, error) {
+	format, err := message.ParseFormat(string(opts.Format))
+	if err != nil {
+		return nil, err
+	}
+
 	// join the pubsub topic
-	topic, err := ps.Join(topicName(roomName))
+	topic, err := ps.Join(roomTopic(roomName, opts.Key, opts.Members))
 	if err != nil {
 		return nil, err
 	}
@@ -52,40 +116,221 @@ func JoinChatRoom(ctx context.Context, ps *pubsub.PubSub, selfID peer.ID, nickna
 		return nil, err
 	}
 
+	ctx, cancel := context.WithCancel(ctx)
 	cr := &ChatRoom{
 		ctx:          ctx,
+		cancel:       cancel,
 		ps:           ps,
 		topic:        topic,
 		sub:          sub,
 		self:         selfID,
 		nick:         nickname,
+		shared:       make(map[string]bool),
 		roomName:     roomName,
+		historyName:  historyName(roomName, opts.Key, opts.Members),
+		store:        opts.Store,
+		format:       format,
+		limiter:      opts.Limiter,
+		key:          opts.Key,
+		members:      opts.Members,
+		book:         opts.Book,
+		forwardOnly:  opts.ForwardOnly,
 		outboundChan: make(chan *ChatMessage, ChatRoomBufSize),
 		inboundChan:  make(chan *ChatMessage, ChatRoomBufSize),
 	}
+	if cr.presence, err = joinPresence(cr); err != nil {
+		cancel()
+		sub.Cancel()
+		topic.Close()
+		return nil, fmt.Errorf("failed to join presence topic: %w", err)
+	}
 
 	go cr.eventLoop()
+	go cr.presence.loop()
 	return cr, nil
 }
 
-func (cr *ChatRoom) Publish(message string) error {
+// Publish sends a message to the room under the room's nickname
+func (cr *ChatRoom) Publish(text string) error {
+	_, err := cr.PublishAs(cr.Nick(), text)
+	return err
+}
+
+// PublishAs sends a message to the room under the given nickname, e.g. for a
+// web client sharing the node's identity. It returns the queued message.
+func (cr *ChatRoom) PublishAs(nick, text string) (*ChatMessage, error) {
+	if !cr.IsMember(cr.self) {
+		return nil, fmt.Errorf("only the members of room %s can publish in it", cr.roomName)
+	}
 	msg := &ChatMessage{
-		Message:    message,
+		ID:         message.NewID(),
+		Timestamp:  time.Now().UnixMilli(),
+		Message:    text,
 		SenderID:   cr.self.String(),
-		SenderNick: cr.nick,
+		SenderNick: nick,
 	}
 
 	select {
 	case cr.outboundChan <- msg:
-		return nil
+		return msg, nil
 	case <-cr.ctx.Done():
 		logger.Warn("context done")
-		return cr.ctx.Err()
+		return nil, cr.ctx.Err()
+	}
+}
+
+// PublishFile announces a file shared with filetransfer.Service.Share in the
+// room. It returns the queued message.
+func (cr *ChatRoom) PublishFile(offer *filetransfer.Offer) (*ChatMessage, error) {
+	if !cr.IsMember(cr.self) {
+		return nil, fmt.Errorf("only the members of room %s can publish in it", cr.roomName)
+	}
+	msg := &ChatMessage{
+		ID:         message.NewID(),
+		Timestamp:  time.Now().UnixMilli(),
+		Message:    fileText(offer),
+		SenderID:   cr.self.String(),
+		SenderNick: cr.Nick(),
+		File:       offer,
+	}
+
+	// the file is served to the peers of the room as soon as they see the offer
+	cr.mu.Lock()
+	cr.shared[offer.Hash] = true
+	cr.mu.Unlock()
+	select {
+	case cr.outboundChan <- msg:
+		return msg, nil
+	case <-cr.ctx.Done():
+		return nil, cr.ctx.Err()
 	}
 }
 
 func (cr *ChatRoom) ListPeers() []peer.ID {
-	return cr.ps.ListPeers(topicName(cr.roomName))
+	return cr.ps.ListPeers(cr.topic.String())
+}
+
+// Name returns the name of the chat room
+func (cr *ChatRoom) Name() string {
+	return cr.roomName
+}
+
+// HistoryName returns the name the messages of the room are saved under in
+// the history store, which differs from the room name for the encrypted and
+// restricted rooms
+func (cr *ChatRoom) HistoryName() string {
+	return cr.historyName
+}
+
+// Encrypted reports whether the messages of the room are end-to-end encrypted
+func (cr *ChatRoom) Encrypted() bool {
+	return cr.key != nil
+}
+
+// ACL returns the access control list of a restricted room, or nil if anyone
+// can publish in the room
+func (cr *ChatRoom) ACL() *acl.ACL {
+	if cr.members == nil {
+		return nil
+	}
+	return cr.members.get()
+}
+
+// Nick returns our nickname in the room
+func (cr *ChatRoom) Nick() string {
+	cr.mu.RLock()
+	defer cr.mu.RUnlock()
+	return cr.nick
+}
+
+// SetNick changes our nickname in the room. If announcement is not nil, the
+// signed announcement of the new nickname is published in the room, so that
+// its peers are told about the change.
+func (cr *ChatRoom) SetNick(nick string, announcement []byte) error {
+	cr.mu.Lock()
+	old := cr.nick
+	cr.nick = nick
+	cr.mu.Unlock()
+	if announcement == nil || !cr.IsMember(cr.self) {
+		return nil
+	}
+	env := message.New(message.TypeNick, cr.roomName, cr.self.String(), old, announcement)
+	var err error
+	if cr.key != nil {
+		if env, err = cr.key.Seal(env); err != nil {
+			return err
+		}
+	}
+	data, err := message.Encode(env, cr.format)
+	if err != nil {
+		return err
+	}
+	if err := cr.topic.Publish(cr.ctx, data); err != nil {
+		return err
+	}
+	// refresh the announcement in the presence heartbeats right away
+	cr.presence.announceNow()
+	return nil
+}
+
+// offered reports whether we offered the file with the given hash in the room
+func (cr *ChatRoom) offered(hash string) bool {
+	cr.mu.RLock()
+	defer cr.mu.RUnlock()
+	return cr.shared[hash]
+}
+
+// IsMember reports whether the peer can publish in the room
+func (cr *ChatRoom) IsMember(p peer.ID) bool {
+	return cr.members == nil || cr.members.IsMember(p)
+}
+
+// PublishACL shares the access control list with the peers of a restricted
+// room, so that they accept the messages of the members it adds
+func (cr *ChatRoom) PublishACL(a *acl.ACL) error {
+	payload, err := a.Encode()
+	if err != nil {
+		return err
+	}
+	env := message.New(message.TypeACL, cr.roomName, cr.self.String(), cr.Nick(), payload)
+	if cr.key != nil {
+		if env, err = cr.key.Seal(env); err != nil {
+			return err
+		}
+	}
+	data, err := message.Encode(env, cr.format)
+	if err != nil {
+		return err
+	}
+	return cr.topic.Publish(cr.ctx, data)
+}
+
+// SetStatus announces our availability to the peers of the room
+func (cr *ChatRoom) SetStatus(status Status) {
+	cr.presence.setStatus(status)
+}
+
+// SetTyping tells the peers of the room whether we are typing a message. It
+// does not block, the heartbeat being published in the background.
+func (cr *ChatRoom) SetTyping(typing bool) {
+	cr.presence.setTyping(typing)
+}
+
+// Presence returns the status of the peers that recently sent a heartbeat in
+// the room, sorted by nickname
+func (cr *ChatRoom) Presence() []*Presence {
+	return cr.presence.list()
+}
+
+// Leave stops the room's event loop, cancels the subscription and closes
+// the topic so that the room can be joined again later.
+func (cr *ChatRoom) Leave() error {
+	if err := cr.presence.leave(); err != nil {
+		logger.Debugf("failed to leave presence topic of room %s: %v", cr.roomName, err)
+	}
+	cr.cancel()
+	cr.sub.Cancel()
+	return cr.topic.Close()
 }
 
 func (cr *ChatRoom) eventLoop() {
@@ -95,13 +340,17 @@ func (cr *ChatRoom) eventLoop() {
 		for {
 			msg, err := cr.sub.Next(cr.ctx)
 			if err != nil {
+				if cr.ctx.Err() != nil || errors.Is(err, pubsub.ErrSubscriptionCancelled) {
+					return
+				}
 				logger.Warn("error receiving message", err)
 				continue
 			}
-			if msg.ReceivedFrom == cr.self {
-				continue
+			select {
+			case receivedMsgCh <- msg:
+			case <-cr.ctx.Done():
+				return
 			}
-			receivedMsgCh <- msg
 		}
 	}()
 
@@ -111,22 +360,49 @@ func (cr *ChatRoom) eventLoop() {
 			return
 		case msg := <-cr.outboundChan:
 			logger.Debug("sending message to chat room")
-			msgBytes, err := json.Marshal(msg)
+			env, err := cr.envelope(msg)
+			if err != nil {
+				logger.Warn("error encrypting message", err)
+				continue
+			}
+			msgBytes, err := message.Encode(env, cr.format)
 			if err != nil {
 				logger.Warn("error marshalling message", err)
 				continue
 			}
 			if err := cr.topic.Publish(cr.ctx, msgBytes); err != nil {
 				logger.Warn("error publishing message", err)
+				continue
 			}
+			messagesPublished.WithLabelValues(cr.roomName).Inc()
 		case msg := <-receivedMsgCh:
 			if msg.ReceivedFrom == cr.self {
+				// our own messages are delivered back signed, as they are
+				// kept in the history
+				cr.persistOwn(msg)
+				continue
+			}
+			if cr.limiter != nil && !cr.limiter.Allow(msg.GetFrom()) {
+				logger.Debugf("throttling message from %s in room %s", msg.GetFrom(), cr.roomName)
+				messagesThrottled.WithLabelValues(cr.roomName).Inc()
 				continue
 			}
-			cm := new(ChatMessage)
-			if err := json.Unmarshal(msg.Data, cm); err != nil {
-				logger.Warn("error unmarshalling message", err)
+			cm, err := cr.open(msg)
+			if errors.Is(err, message.ErrDecrypt) {
+				// tell the user instead of silently dropping the message, as
+				// the sender may be using another passphrase
+				logger.Warnf("failed to decrypt message from %s in room %s", msg.GetFrom(), cr.roomName)
+				cm = &ChatMessage{Timestamp: time.Now().UnixMilli(), SenderID: msg.GetFrom().String(), Error: err.Error()}
+			} else if err != nil {
+				logger.Warnf("dropping message from %s: %v", msg.GetFrom(), err)
 				continue
+			} else if cm == nil {
+				// control message, e.g. an access control list update
+				continue
+			}
+			messagesReceived.WithLabelValues(cr.roomName).Inc()
+			if cm.Error == "" && !cm.Notice {
+				cr.persist(cm, msg)
 			}
 			select {
 			case cr.inboundChan <- cm:
@@ -137,6 +413,310 @@ func (cr *ChatRoom) eventLoop() {
 	}
 }
 
+// persist saves the message to the history store, if any, along with the
+// signed pubsub message it was received in
+func (cr *ChatRoom) persist(cm *ChatMessage, msg *pubsub.Message) {
+	if cr.store == nil {
+		return
+	}
+	signed, err := msg.Message.Marshal()
+	if err != nil {
+		logger.Warn("error marshalling message", err)
+		return
+	}
+	if err := cr.store.Put(cr.record(cm, signed)); err != nil {
+		logger.Warn("error saving message to history", err)
+	}
+}
+
+// persistOwn saves a message we published, as delivered back by pubsub
+func (cr *ChatRoom) persistOwn(msg *pubsub.Message) {
+	if cr.store == nil {
+		return
+	}
+	env, err := cr.unwrap(msg)
+	if err != nil || (env.Type != message.TypeChat && env.Type != message.TypeFile) {
+		return
+	}
+	cm, err := chatMessage(env)
+	if err != nil {
+		return
+	}
+	cr.persist(cm, msg)
+}
+
+// record returns the history record of a chat message
+func (cr *ChatRoom) record(cm *ChatMessage, signed []byte) *history.Record {
+	return &history.Record{
+		Room:       cr.historyName,
+		ID:         cm.ID,
+		Timestamp:  cm.Timestamp,
+		SenderID:   cm.SenderID,
+		SenderNick: cm.SenderNick,
+		Message:    cm.Message,
+		Signed:     signed,
+	}
+}
+
+// verifyRecord checks a record fetched from a peer against the signed
+// message it carries: the message must have been published in the room by
+// one of its members, not too far in the future. The record is rebuilt from
+// the signed message, so that none of its fields can be forged by the peer
+// serving it.
+func (cr *ChatRoom) verifyRecord(r *history.Record, maxSkew time.Duration) (*history.Record, error) {
+	msg, err := historysync.SignedMessage(r)
+	if err != nil {
+		return nil, err
+	}
+	if msg.GetTopic() != cr.topic.String() {
+		return nil, fmt.Errorf("message published on topic %q", msg.GetTopic())
+	}
+	if !cr.IsMember(msg.GetFrom()) {
+		return nil, fmt.Errorf("message published by %s, not a member of the room", msg.GetFrom())
+	}
+	env, err := cr.unwrap(msg)
+	if err != nil {
+		return nil, err
+	}
+	// messages from older peers carry no timestamp to check
+	if env.Legacy {
+		return nil, errors.New("legacy message")
+	}
+	if env.Type != message.TypeChat && env.Type != message.TypeFile {
+		return nil, fmt.Errorf("unexpected message type %d", env.Type)
+	}
+	cm, err := chatMessage(env)
+	if err != nil {
+		return nil, err
+	}
+	if cm.ID != r.ID {
+		return nil, fmt.Errorf("record of message %s", cm.ID)
+	}
+	if time.Until(env.Time()) > maxSkew {
+		return nil, fmt.Errorf("message timestamp %s is in the future", env.Time())
+	}
+	return cr.record(cm, r.Signed), nil
+}
+
+// envelope wraps a chat message sent to the room, sealing it with the room
+// key if the room is encrypted
+func (cr *ChatRoom) envelope(cm *ChatMessage) (*message.Envelope, error) {
+	env := &message.Envelope{
+		Version:    message.Version,
+		ID:         cm.ID,
+		Timestamp:  cm.Timestamp,
+		Type:       message.TypeChat,
+		Room:       cr.roomName,
+		SenderID:   cm.SenderID,
+		SenderNick: cm.SenderNick,
+		Payload:    []byte(cm.Message),
+	}
+	if cm.File != nil {
+		payload, err := json.Marshal(cm.File)
+		if err != nil {
+			return nil, err
+		}
+		env.Type, env.Payload = message.TypeFile, payload
+	}
+	if cr.key == nil {
+		return env, nil
+	}
+	return cr.key.Seal(env)
+}
+
+// open decodes a message received from the room, applying the control
+// messages, and returns the chat message or notice to show, if any.
+func (cr *ChatRoom) open(msg *pubsub.Message) (*ChatMessage, error) {
+	env, err := cr.unwrap(msg)
+	if err != nil {
+		return nil, err
+	}
+	switch env.Type {
+	case message.TypeACL:
+		return nil, cr.updateACL(env.Payload)
+	case message.TypeNick:
+		return cr.nickChanged(env)
+	}
+	return chatMessage(env)
+}
+
+// unwrap decodes the envelope of a message published in the room, opening it
+// if the room is encrypted, and checks it was sent by the peer it claims to
+// come from.
+func (cr *ChatRoom) unwrap(msg *pubsub.Message) (*message.Envelope, error) {
+	env, err := message.Decode(msg.Data)
+	if err != nil {
+		return nil, err
+	}
+	// the From field is covered by the pubsub message signature, so unlike
+	// SenderID it can't be forged by the sender
+	if env.SenderID != msg.GetFrom().String() {
+		return nil, fmt.Errorf("sender ID %s does not match signed origin %s", env.SenderID, msg.GetFrom())
+	}
+	if cr.key != nil {
+		if env.Room != cr.key.ID() {
+			return nil, fmt.Errorf("message for room %q published in an encrypted room", env.Room)
+		}
+		if env, err = cr.key.Open(env); err != nil {
+			return nil, err
+		}
+	} else if env.Encrypted {
+		return nil, errors.New("encrypted message published in a clear room")
+	}
+	// messages from older peers carry no room, ID nor timestamp
+	if !env.Legacy && env.Room != cr.roomName {
+		return nil, fmt.Errorf("message for room %q published in room %q", env.Room, cr.roomName)
+	}
+	return env, nil
+}
+
+// chatMessage returns the chat message carried by an envelope of the chat or
+// file type.
+func chatMessage(env *message.Envelope) (*ChatMessage, error) {
+	var offer *filetransfer.Offer
+	switch env.Type {
+	case message.TypeChat:
+	case message.TypeFile:
+		offer = new(filetransfer.Offer)
+		if err := json.Unmarshal(env.Payload, offer); err != nil {
+			return nil, fmt.Errorf("invalid file offer: %w", err)
+		}
+		if err := offer.Validate(); err != nil {
+			return nil, fmt.Errorf("invalid file offer: %w", err)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported message type %d", env.Type)
+	}
+	if env.ID == "" {
+		env.ID = message.NewID()
+	}
+	if env.Timestamp == 0 {
+		env.Timestamp = time.Now().UnixMilli()
+	}
+
+	cm := &ChatMessage{
+		ID:         env.ID,
+		Timestamp:  env.Timestamp,
+		Message:    string(env.Payload),
+		SenderID:   env.SenderID,
+		SenderNick: env.SenderNick,
+	}
+	if offer != nil {
+		cm.Message, cm.File = fileText(offer), offer
+	}
+	return cm, nil
+}
+
+// fileText returns the text of the messages sharing a file, which is what
+// the history keeps of them
+func fileText(offer *filetransfer.Offer) string {
+	return fmt.Sprintf("shared file %s (%s, id %s)", offer.Name, formatSize(offer.Size), offer.ShortID())
+}
+
+// formatSize returns a human readable file size
+func formatSize(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// nickChanged records the new nickname announced by a peer, and returns the
+// notice of the change, or nil if the announcement is outdated
+func (cr *ChatRoom) nickChanged(env *message.Envelope) (*ChatMessage, error) {
+	a, err := nickname.Decode(env.Payload)
+	if err != nil {
+		return nil, err
+	}
+	if a.Peer != env.SenderID {
+		return nil, fmt.Errorf("announcement of %s sent by %s", a.Peer, env.SenderID)
+	}
+	if cr.book != nil {
+		from, err := a.PeerID()
+		if err != nil {
+			return nil, err
+		}
+		// the announcement may already be known from a heartbeat, so only
+		// skip the ones superseded by a newer nickname
+		if _, err := cr.book.Update(from, env.Payload); err != nil {
+			return nil, err
+		}
+		if nick, _ := cr.book.Nick(from); nick != a.Nick {
+			return nil, nil
+		}
+	}
+	if a.Nick == env.SenderNick {
+		return nil, nil
+	}
+	return &ChatMessage{
+		ID:         env.ID,
+		Timestamp:  env.Timestamp,
+		Message:    fmt.Sprintf("%s is now known as %s", env.SenderNick, a.Nick),
+		SenderID:   env.SenderID,
+		SenderNick: a.Nick,
+		Notice:     true,
+	}, nil
+}
+
+// updateACL replaces the access control list of a restricted room with a
+// newer one signed by its owner, and saves it to the history store
+func (cr *ChatRoom) updateACL(data []byte) error {
+	if cr.members == nil {
+		return errors.New("access control list published in an open room")
+	}
+	next, err := acl.Decode(data)
+	if err != nil {
+		return err
+	}
+	if !cr.members.update(next) {
+		return nil
+	}
+	logger.Infof("Members of room %s updated: %d members", cr.roomName, len(next.Members))
+	if cr.store != nil {
+		if err := cr.store.PutACL(cr.roomName, data); err != nil {
+			logger.Warnf("failed to save access control list of room %s: %v", cr.roomName, err)
+		}
+	}
+	return nil
+}
+
 func topicName(roomName string) string {
 	return "chat-room:" + roomName
 }
+
+// roomTopic returns the topic of the room. Restricted rooms are joined on a
+// topic of their owner, so that they don't clash with open rooms of the same name.
+func roomTopic(roomName string, key *message.RoomKey, members *roomMembers) string {
+	topic := topicName(wireRoomName(roomName, key))
+	if members != nil {
+		topic += "/" + members.get().Owner
+	}
+	return topic
+}
+
+// historyName returns the name the messages of the room are saved under in
+// the history store: the room name carried by its envelopes, followed by the
+// owner of a restricted room, so that the rooms joined under the same name
+// with another passphrase or owner don't share their history.
+func historyName(roomName string, key *message.RoomKey, members *roomMembers) string {
+	name := wireRoomName(roomName, key)
+	if members != nil {
+		name += "/" + members.get().Owner
+	}
+	return name
+}
+
+// wireRoomName returns the room name carried by the envelopes of the room,
+// which is the room ID for encrypted rooms so that their name does not leak
+func wireRoomName(roomName string, key *message.RoomKey) string {
+	if key != nil {
+		return key.ID()
+	}
+	return roomName
+}
@@ -0,0 +1,571 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/alejoacosta74/libp2p-chat-app/history"
+	"github.com/alejoacosta74/libp2p-chat-app/p2p/node"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/rivo/tview"
+	"github.com/spf13/viper"
+)
+
+// connectTimeout bounds the time spent dialing a peer with /connect
+const connectTimeout = 30 * time.Second
+
+// errUsage is returned by the command handlers called with invalid arguments,
+// so that the usage of the command is shown
+var errUsage = errors.New("invalid arguments")
+
+// Command is a slash command typed in the input field of the terminal UI
+type Command struct {
+	Name    string   // name of the command, without the leading slash
+	Aliases []string // other names of the command
+	// Args is the argument spec shown in the usage of the command: <arg> is
+	// required, [arg] is optional, and a last argument ending with ... takes
+	// the rest of the line, e.g. "<nick|peerID> <text...>"
+	Args string
+	Help string
+	// NeedsRoom commands run in the active room, and fail if no room is joined
+	NeedsRoom bool
+	// Complete returns the candidates for the first argument of the command, used by tab completion
+	Complete func(ui *ChatUI) []string
+	Handler  func(ctx *CommandContext) error
+}
+
+// Usage returns the usage line of the command
+func (c *Command) Usage() string {
+	if c.Args == "" {
+		return "/" + c.Name
+	}
+	return "/" + c.Name + " " + c.Args
+}
+
+// escapedUsage returns the usage line escaped for the log window, where the
+// optional arguments would be taken for color tags
+func (c *Command) escapedUsage() string {
+	return tview.Escape(c.Usage())
+}
+
+// argSpec returns the number of required and optional arguments of the
+// command, and whether the last one takes the rest of the line
+func (c *Command) argSpec() (required, optional int, rest bool) {
+	for _, arg := range strings.Fields(c.Args) {
+		if strings.HasPrefix(arg, "<") {
+			required++
+		} else {
+			optional++
+		}
+		rest = strings.HasSuffix(strings.TrimRight(arg, ">]"), "...")
+	}
+	return required, optional, rest
+}
+
+// parseArgs splits the arguments typed after the command according to its spec
+func (c *Command) parseArgs(line string) ([]string, error) {
+	required, optional, rest := c.argSpec()
+	limit := required + optional
+	var args []string
+	if rest && limit > 0 {
+		args = splitN(line, limit)
+	} else {
+		args = strings.Fields(line)
+	}
+	if len(args) < required || len(args) > limit {
+		return nil, errUsage
+	}
+	return args, nil
+}
+
+// CommandContext is passed to the command handlers
+type CommandContext struct {
+	UI   *ChatUI
+	Node *node.Node
+	// Room is the active room, nil if no room is joined
+	Room *ChatRoom
+	Args []string
+}
+
+// Arg returns the i-th argument, or "" if it was not given
+func (ctx *CommandContext) Arg(i int) string {
+	if i < len(ctx.Args) {
+		return ctx.Args[i]
+	}
+	return ""
+}
+
+// CommandRegistry holds the slash commands of the terminal UI, by name and alias
+type CommandRegistry struct {
+	commands []*Command
+	byName   map[string]*Command
+}
+
+// NewCommandRegistry returns an empty registry
+func NewCommandRegistry() *CommandRegistry {
+	return &CommandRegistry{byName: make(map[string]*Command)}
+}
+
+// Register adds the command to the registry. It fails if its name or one of
+// its aliases is already taken.
+func (r *CommandRegistry) Register(c *Command) error {
+	if c.Name == "" || c.Handler == nil {
+		return errors.New("command must have a name and a handler")
+	}
+	names := append([]string{c.Name}, c.Aliases...)
+	for _, name := range names {
+		if _, ok := r.byName[name]; ok {
+			return fmt.Errorf("command /%s already registered", name)
+		}
+	}
+	for _, name := range names {
+		r.byName[name] = c
+	}
+	r.commands = append(r.commands, c)
+	return nil
+}
+
+// Lookup returns the command with the given name or alias, with or without the leading slash
+func (r *CommandRegistry) Lookup(name string) (*Command, bool) {
+	c, ok := r.byName[strings.TrimPrefix(name, "/")]
+	return c, ok
+}
+
+// Commands returns the registered commands sorted by name
+func (r *CommandRegistry) Commands() []*Command {
+	commands := append([]*Command(nil), r.commands...)
+	sort.Slice(commands, func(i, j int) bool { return commands[i].Name < commands[j].Name })
+	return commands
+}
+
+// Run runs the command typed in line, or reports it as unknown
+func (r *CommandRegistry) Run(ui *ChatUI, line string) {
+	name, rest, _ := strings.Cut(strings.TrimSpace(line), " ")
+	c, ok := r.Lookup(name)
+	if !ok {
+		ui.DisplayLog("[red]Unknown command %s, see /help[-]", tview.Escape(name))
+		return
+	}
+	args, err := c.parseArgs(rest)
+	if err != nil {
+		ui.DisplayLog("[red]Usage: %s[-]", c.escapedUsage())
+		return
+	}
+	ctx := &CommandContext{UI: ui, Node: ui.node, Args: args}
+	if cr, ok := ui.activeRoom(); ok {
+		ctx.Room = cr
+	} else if c.NeedsRoom {
+		ui.DisplayLog("[red]Not in any room, use /join <room>[-]")
+		return
+	}
+	if err := c.Handler(ctx); errors.Is(err, errUsage) {
+		ui.DisplayLog("[red]Usage: %s[-]", c.escapedUsage())
+	} else if err != nil {
+		ui.DisplayLog("[red]%s[-]", upperFirst(err.Error()))
+	}
+}
+
+// Complete returns the completions of the text typed in the input field: the
+// names of the commands, then the candidates for their first argument
+func (r *CommandRegistry) Complete(ui *ChatUI, text string) []string {
+	if !strings.HasPrefix(text, "/") {
+		return nil
+	}
+	name, arg, hasArg := strings.Cut(text, " ")
+	var completions []string
+	if !hasArg {
+		for _, c := range r.Commands() {
+			if strings.HasPrefix("/"+c.Name, name) {
+				completions = append(completions, "/"+c.Name+" ")
+			}
+		}
+		return completions
+	}
+	c, ok := r.Lookup(name)
+	if !ok || c.Complete == nil || strings.Contains(arg, " ") {
+		return nil
+	}
+	for _, candidate := range c.Complete(ui) {
+		if strings.HasPrefix(strings.ToLower(candidate), strings.ToLower(arg)) {
+			completions = append(completions, name+" "+candidate+" ")
+		}
+	}
+	sort.Strings(completions)
+	return completions
+}
+
+// defaultCommands returns the registry of the built-in commands
+func defaultCommands() *CommandRegistry {
+	r := NewCommandRegistry()
+	for _, c := range []*Command{
+		{Name: "help", Aliases: []string{"?"}, Args: "[command]", Help: "list the commands, or show the help of a command", Handler: cmdHelp, Complete: commandNames},
+		{Name: "join", Aliases: []string{"j"}, Args: "<room> [passphrase]", Help: "join a room, end-to-end encrypted if a passphrase is given", Handler: cmdJoin},
+		{Name: "create", Args: "<room> [passphrase]", Help: "create a room restricted to the members we invite", Handler: cmdCreate},
+		{Name: "accept", Args: "<room> [passphrase]", Help: "accept the invitation to a restricted room and join it", Handler: cmdAccept, Complete: invitedRooms},
+		{Name: "invite", Args: "<nick|peerID>", Help: "invite a peer to the active room, which we own", NeedsRoom: true, Handler: cmdInvite, Complete: peerNames},
+		{Name: "leave", Aliases: []string{"part"}, Args: "[room]", Help: "leave the active room, or the given one", Handler: cmdLeave, Complete: roomNames},
+		{Name: "msg", Aliases: []string{"dm"}, Args: "<nick|peerID> <text...>", Help: "send a direct message to a peer", Handler: cmdMsg, Complete: peerNames},
+		{Name: "send", Args: "<path...>", Help: "share a file in the active room", NeedsRoom: true, Handler: cmdSend},
+		{Name: "get", Args: "<id>", Help: "download a file shared in a room, or resume its download", Handler: cmdGet, Complete: fileIDs},
+		{Name: "history", Args: "[n]", Help: "show the last n messages of the active room", NeedsRoom: true, Handler: cmdHistory},
+		{Name: "search", Args: "<text...>", Help: "show the messages of the active room containing the text", NeedsRoom: true, Handler: cmdSearch},
+		{Name: "scores", Help: "toggle the peer scores in the Peers pane", Handler: cmdScores},
+		{Name: "status", Args: "[online|away|busy]", Help: "show or set the status announced in every room", Handler: cmdStatus, Complete: statusNames},
+		{Name: "nick", Args: "[name]", Help: "show or change our nickname", Handler: cmdNick},
+		{Name: "whoami", Help: "show our peer ID and addresses", Handler: cmdWhoami},
+		{Name: "rooms", Help: "list the joined rooms", Handler: cmdRooms},
+		{Name: "peers", Help: "list the peers of the active room", NeedsRoom: true, Handler: cmdPeers},
+		{Name: "connect", Args: "<multiaddr>", Help: "connect to a peer, e.g. /ip4/1.2.3.4/tcp/4001/p2p/12D3KooW...", Handler: cmdConnect},
+		{Name: "clear", Help: "clear the message window of the active room", NeedsRoom: true, Handler: cmdClear},
+		{Name: "quit", Aliases: []string{"exit"}, Help: "quit the chat", Handler: cmdQuit},
+	} {
+		if err := r.Register(c); err != nil {
+			panic(err)
+		}
+	}
+	return r
+}
+
+func cmdHelp(ctx *CommandContext) error {
+	ui := ctx.UI
+	if name := ctx.Arg(0); name != "" {
+		c, ok := ui.commands.Lookup(name)
+		if !ok {
+			return fmt.Errorf("unknown command %s", name)
+		}
+		ui.DisplayLog("%s: %s", c.escapedUsage(), c.Help)
+		if len(c.Aliases) > 0 {
+			ui.DisplayLog("  aliases: /%s", strings.Join(c.Aliases, ", /"))
+		}
+		return nil
+	}
+	for _, c := range ui.commands.Commands() {
+		ui.DisplayLog("%s%s %s", c.escapedUsage(), strings.Repeat(" ", max(0, 36-len(c.Usage()))), c.Help)
+	}
+	ui.DisplayLog("Press Tab to complete commands, rooms and nicknames")
+	return nil
+}
+
+func cmdJoin(ctx *CommandContext) error {
+	ui, roomName := ctx.UI, ctx.Arg(0)
+	var err error
+	if passphrase := ctx.Arg(1); passphrase != "" {
+		_, err = ui.rm.JoinEncrypted(roomName, passphrase)
+	} else {
+		_, err = ui.rm.Join(roomName)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to join room %s: %w", roomName, err)
+	}
+	ui.addRoom(roomName)
+	ui.replayHistory(roomName, viper.GetInt("history-size"))
+	ui.switchRoom(roomName)
+	ui.DisplayLog("Joined room %s", roomName)
+	return nil
+}
+
+func cmdCreate(ctx *CommandContext) error {
+	ui, roomName := ctx.UI, ctx.Arg(0)
+	if _, err := ui.rm.Create(roomName, ctx.Arg(1)); err != nil {
+		return fmt.Errorf("failed to create room %s: %w", roomName, err)
+	}
+	ui.addRoom(roomName)
+	ui.switchRoom(roomName)
+	ui.DisplayLog("Created room %s, invite members with /invite <nick|peerID>", roomName)
+	return nil
+}
+
+func cmdAccept(ctx *CommandContext) error {
+	ui, roomName := ctx.UI, ctx.Arg(0)
+	if _, err := ui.rm.Accept(roomName, ctx.Arg(1)); err != nil {
+		return fmt.Errorf("failed to accept invitation to room %s: %w", roomName, err)
+	}
+	ui.addRoom(roomName)
+	ui.replayHistory(roomName, viper.GetInt("history-size"))
+	ui.switchRoom(roomName)
+	ui.DisplayLog("Joined room %s", roomName)
+	return nil
+}
+
+func cmdInvite(ctx *CommandContext) error {
+	ui, cr, to := ctx.UI, ctx.Room, ctx.Arg(0)
+	p, err := ui.resolvePeer(to)
+	if err != nil {
+		return err
+	}
+	go func() {
+		if err := ui.rm.Invite(ui.rm.ctx, cr.Name(), p); err != nil {
+			ui.DisplayLog("[red]Failed to invite %s to room %s: %s[-]", to, cr.Name(), err.Error())
+			return
+		}
+		ui.DisplayLog("[green]Invited %s to room %s[-]", to, cr.Name())
+	}()
+	return nil
+}
+
+func cmdLeave(ctx *CommandContext) error {
+	ui, roomName := ctx.UI, ctx.Arg(0)
+	if roomName == "" && ctx.Room != nil {
+		roomName = ctx.Room.Name()
+	}
+	if len(ui.rm.Rooms()) == 1 {
+		return errors.New("cannot leave the last room, use /quit instead")
+	}
+	if err := ui.rm.Leave(roomName); err != nil {
+		return fmt.Errorf("failed to leave room %s: %w", roomName, err)
+	}
+	ui.removeRoom(roomName)
+	ui.cycleRoom(0)
+	ui.refreshTabs()
+	ui.DisplayLog("Left room %s", roomName)
+	return nil
+}
+
+func cmdMsg(ctx *CommandContext) error {
+	if strings.TrimSpace(ctx.Arg(1)) == "" {
+		return errUsage
+	}
+	ctx.UI.sendDirectMessage(ctx.Arg(0), ctx.Arg(1))
+	return nil
+}
+
+func cmdSend(ctx *CommandContext) error {
+	ctx.UI.sendFile(ctx.Room, ctx.Arg(0))
+	return nil
+}
+
+func cmdGet(ctx *CommandContext) error {
+	ctx.UI.fetchFile(ctx.Arg(0))
+	return nil
+}
+
+func cmdHistory(ctx *CommandContext) error {
+	n := viper.GetInt("history-size")
+	if arg := ctx.Arg(0); arg != "" {
+		var err error
+		if n, err = strconv.Atoi(arg); err != nil || n <= 0 {
+			return errUsage
+		}
+	}
+	ctx.UI.queryHistory(fmt.Sprintf("last %d messages", n), func(store *history.Store, historyName string) ([]*history.Record, error) {
+		return store.Last(historyName, n)
+	})
+	return nil
+}
+
+func cmdSearch(ctx *CommandContext) error {
+	query := strings.TrimSpace(ctx.Arg(0))
+	ctx.UI.queryHistory(fmt.Sprintf("messages matching %q", query), func(store *history.Store, historyName string) ([]*history.Record, error) {
+		return store.Search(historyName, query, searchLimit)
+	})
+	return nil
+}
+
+func cmdScores(ctx *CommandContext) error {
+	ui := ctx.UI
+	ui.mu.Lock()
+	ui.showScores = !ui.showScores
+	showScores := ui.showScores
+	ui.mu.Unlock()
+	ui.app.QueueUpdateDraw(func() {
+		if showScores {
+			ui.peersList.SetTitle("Peers (scores)")
+		} else {
+			ui.peersList.SetTitle("Peers")
+		}
+	})
+	ui.refreshPeers()
+	return nil
+}
+
+func cmdStatus(ctx *CommandContext) error {
+	ui := ctx.UI
+	if ctx.Arg(0) == "" {
+		ui.DisplayLog("Status: %s", ui.rm.Status())
+		return nil
+	}
+	status, err := ParseStatus(ctx.Arg(0))
+	if err != nil {
+		return errUsage
+	}
+	ui.rm.SetStatus(status)
+	ui.DisplayLog("Status set to %s", status)
+	ui.refreshStatus()
+	return nil
+}
+
+func cmdNick(ctx *CommandContext) error {
+	ui, nick := ctx.UI, ctx.Arg(0)
+	if nick == "" {
+		ui.DisplayLog("Nickname: %s", ui.rm.Nick())
+		return nil
+	}
+	if nick == ui.rm.Nick() {
+		return nil
+	}
+	return ui.setNick(nick)
+}
+
+func cmdWhoami(ctx *CommandContext) error {
+	ui := ctx.UI
+	ui.DisplayLog("Peer ID: %s, nickname: %s", ctx.Node.ID(), ui.rm.Nick())
+	for _, addr := range ctx.Node.Addrs() {
+		ui.DisplayLog("Listening on %s/p2p/%s", addr, ctx.Node.ID())
+	}
+	return nil
+}
+
+func cmdRooms(ctx *CommandContext) error {
+	ui := ctx.UI
+	for _, name := range ui.rm.Rooms() {
+		var flags string
+		if cr, ok := ui.rm.Room(name); ok {
+			if cr.Encrypted() {
+				flags += " " + lockMark + " encrypted,"
+			}
+			if roomACL := cr.ACL(); roomACL != nil {
+				flags += fmt.Sprintf(" restricted to %d members,", len(roomACL.Members))
+			}
+		}
+		ui.DisplayLog("Room %s:%s %d unread, %d throttled", name, flags, ui.rm.Unread(name), ui.rm.Throttled(name))
+	}
+	return nil
+}
+
+func cmdPeers(ctx *CommandContext) error {
+	ui, cr := ctx.UI, ctx.Room
+	states := make(map[peer.ID]*Presence)
+	for _, state := range cr.Presence() {
+		states[state.ID] = state
+	}
+	peers := cr.ListPeers()
+	ui.DisplayLog("%d peers in room %s:", len(peers), cr.Name())
+	for _, p := range peers {
+		state := states[p]
+		status := "unknown"
+		if state != nil {
+			status = string(state.Status)
+		}
+		var conns []string
+		for _, conn := range ctx.Node.Network().ConnsToPeer(p) {
+			conns = append(conns, conn.RemoteMultiaddr().String())
+		}
+		ui.DisplayLog("  %s %s (%s) %s", ui.peerName(p.String(), nickOf(state)), p, status, strings.Join(conns, ", "))
+	}
+	return nil
+}
+
+func cmdConnect(ctx *CommandContext) error {
+	ui, addr := ctx.UI, ctx.Arg(0)
+	go func() {
+		dialCtx, cancel := context.WithTimeout(ui.rm.ctx, connectTimeout)
+		defer cancel()
+		p, err := ctx.Node.ConnectAddr(dialCtx, addr)
+		if err != nil {
+			ui.DisplayLog("[red]%s[-]", upperFirst(err.Error()))
+			return
+		}
+		ui.DisplayLog("[green]Connected to %s[-]", p)
+	}()
+	return nil
+}
+
+func cmdClear(ctx *CommandContext) error {
+	ctx.UI.clearRoom(ctx.Room.Name())
+	return nil
+}
+
+func cmdQuit(ctx *CommandContext) error {
+	ctx.UI.app.Stop()
+	return nil
+}
+
+// commandNames completes the names of the commands
+func commandNames(ui *ChatUI) []string {
+	var names []string
+	for _, c := range ui.commands.Commands() {
+		names = append(names, c.Name)
+	}
+	return names
+}
+
+// roomNames completes the names of the joined rooms
+func roomNames(ui *ChatUI) []string {
+	return ui.rm.Rooms()
+}
+
+// invitedRooms completes the names of the rooms we are invited to
+func invitedRooms(ui *ChatUI) []string {
+	return ui.rm.Invited()
+}
+
+// peerNames completes the names of the peers in the address book
+func peerNames(ui *ChatUI) []string {
+	if book := ui.rm.AddressBook(); book != nil {
+		return book.Names()
+	}
+	return nil
+}
+
+// fileIDs completes the IDs of the files shared in the rooms
+func fileIDs(ui *ChatUI) []string {
+	ui.mu.Lock()
+	defer ui.mu.Unlock()
+	ids := make([]string, 0, len(ui.offers))
+	for id := range ui.offers {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// statusNames completes the statuses
+func statusNames(*ChatUI) []string {
+	return []string{string(StatusOnline), string(StatusAway), string(StatusBusy)}
+}
+
+// splitN splits the line in up to n space separated fields, the last one
+// holding the rest of the line
+func splitN(line string, n int) []string {
+	var fields []string
+	line = strings.TrimSpace(line)
+	for line != "" && len(fields) < n-1 {
+		field, rest, _ := strings.Cut(line, " ")
+		fields = append(fields, field)
+		line = strings.TrimSpace(rest)
+	}
+	if line != "" {
+		fields = append(fields, line)
+	}
+	return fields
+}
+
+// upperFirst returns s with its first letter in upper case
+func upperFirst(s string) string {
+	r, size := utf8.DecodeRuneInString(s)
+	return string(unicode.ToUpper(r)) + s[size:]
+}
+
+// commonPrefix returns the longest common prefix of the strings
+func commonPrefix(values []string) string {
+	if len(values) == 0 {
+		return ""
+	}
+	prefix := values[0]
+	for _, v := range values[1:] {
+		for !strings.HasPrefix(v, prefix) {
+			prefix = prefix[:len(prefix)-1]
+		}
+	}
+	// don't cut a multi-byte character in half
+	for !utf8.ValidString(prefix) {
+		prefix = prefix[:len(prefix)-1]
+	}
+	return prefix
+}
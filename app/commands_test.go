@@ -0,0 +1,158 @@
+package app
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestParseArgs(t *testing.T) {
+	tests := []struct {
+		args    string
+		line    string
+		want    []string
+		wantErr bool
+	}{
+		{args: "", line: "", want: []string{}},
+		{args: "", line: "extra", wantErr: true},
+		{args: "<room> [passphrase]", line: "lobby", want: []string{"lobby"}},
+		{args: "<room> [passphrase]", line: "  lobby   secret ", want: []string{"lobby", "secret"}},
+		{args: "<room> [passphrase]", line: "", wantErr: true},
+		{args: "<room> [passphrase]", line: "lobby secret extra", wantErr: true},
+		{args: "<nick|peerID> <text...>", line: "alice hello  there ", want: []string{"alice", "hello  there"}},
+		{args: "<nick|peerID> <text...>", line: "alice", wantErr: true},
+		{args: "<path...>", line: " /tmp/my file.txt", want: []string{"/tmp/my file.txt"}},
+		{args: "[n]", line: "", want: []string{}},
+		{args: "[n]", line: "10 20", wantErr: true},
+	}
+	for _, tt := range tests {
+		c := &Command{Name: "test", Args: tt.args}
+		got, err := c.parseArgs(tt.line)
+		if tt.wantErr {
+			if !errors.Is(err, errUsage) {
+				t.Errorf("%q with %q: got error %v, want %v", tt.args, tt.line, err, errUsage)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q with %q: %v", tt.args, tt.line, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%q with %q: got %q, want %q", tt.args, tt.line, got, tt.want)
+		}
+	}
+}
+
+func TestArgSpec(t *testing.T) {
+	tests := []struct {
+		args                   string
+		wantRequired, wantOpts int
+		wantRest               bool
+	}{
+		{args: ""},
+		{args: "<room> [passphrase]", wantRequired: 1, wantOpts: 1},
+		{args: "<nick|peerID> <text...>", wantRequired: 2, wantRest: true},
+		{args: "[text...]", wantOpts: 1, wantRest: true},
+		{args: "[online|away|busy]", wantOpts: 1},
+	}
+	for _, tt := range tests {
+		required, optional, rest := (&Command{Args: tt.args}).argSpec()
+		if required != tt.wantRequired || optional != tt.wantOpts || rest != tt.wantRest {
+			t.Errorf("%q: got %d, %d, %v, want %d, %d, %v", tt.args, required, optional, rest, tt.wantRequired, tt.wantOpts, tt.wantRest)
+		}
+	}
+}
+
+func TestSplitN(t *testing.T) {
+	tests := []struct {
+		line string
+		n    int
+		want []string
+	}{
+		{line: "", n: 2, want: nil},
+		{line: "   ", n: 2, want: nil},
+		{line: "a", n: 2, want: []string{"a"}},
+		{line: "a b c", n: 2, want: []string{"a", "b c"}},
+		{line: " a   b  c ", n: 2, want: []string{"a", "b  c"}},
+		{line: "a b c", n: 1, want: []string{"a b c"}},
+		{line: "a b c", n: 5, want: []string{"a", "b", "c"}},
+	}
+	for _, tt := range tests {
+		if got := splitN(tt.line, tt.n); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("splitN(%q, %d): got %q, want %q", tt.line, tt.n, got, tt.want)
+		}
+	}
+}
+
+func TestCommonPrefix(t *testing.T) {
+	tests := []struct {
+		values []string
+		want   string
+	}{
+		{values: nil, want: ""},
+		{values: []string{"/join "}, want: "/join "},
+		{values: []string{"/help ", "/history "}, want: "/h"},
+		{values: []string{"/quit ", "/rooms "}, want: "/"},
+		// é and è share their first byte
+		{values: []string{"/msg é", "/msg è"}, want: "/msg "},
+	}
+	for _, tt := range tests {
+		if got := commonPrefix(tt.values); got != tt.want {
+			t.Errorf("commonPrefix(%q): got %q, want %q", tt.values, got, tt.want)
+		}
+	}
+}
+
+func TestCommandRegistry(t *testing.T) {
+	handler := func(*CommandContext) error { return nil }
+	r := NewCommandRegistry()
+	if err := r.Register(&Command{Name: "leave", Aliases: []string{"part"}, Handler: handler}); err != nil {
+		t.Fatal(err)
+	}
+
+	invalid := []*Command{
+		{Name: "", Handler: handler},
+		{Name: "join"},
+		{Name: "leave", Handler: handler},
+		{Name: "part", Handler: handler},
+		{Name: "quit", Aliases: []string{"leave"}, Handler: handler},
+	}
+	for _, c := range invalid {
+		if err := r.Register(c); err == nil {
+			t.Errorf("registered %+v", c)
+		}
+	}
+	// a rejected command doesn't take any of its names
+	if _, ok := r.Lookup("quit"); ok {
+		t.Error("found a command rejected at registration")
+	}
+
+	for _, name := range []string{"leave", "/leave", "part", "/part"} {
+		if c, ok := r.Lookup(name); !ok || c.Name != "leave" {
+			t.Errorf("Lookup(%q): got %v, %v", name, c, ok)
+		}
+	}
+}
+
+func TestCommandRegistryComplete(t *testing.T) {
+	r := defaultCommands()
+	tests := []struct {
+		text string
+		want []string
+	}{
+		{text: "hello", want: nil},
+		{text: "/h", want: []string{"/help ", "/history "}},
+		{text: "/qu", want: []string{"/quit "}},
+		{text: "/nope", want: nil},
+		{text: "/status ", want: []string{"/status away ", "/status busy ", "/status online "}},
+		{text: "/status A", want: []string{"/status away "}},
+		{text: "/status away x", want: nil},
+		{text: "/whoami ", want: nil},
+	}
+	for _, tt := range tests {
+		if got := r.Complete(nil, tt.text); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("Complete(%q): got %q, want %q", tt.text, got, tt.want)
+		}
+	}
+}
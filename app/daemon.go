@@ -0,0 +1,48 @@
+package app
+
+import (
+	"context"
+
+	"github.com/alejoacosta74/go-logger"
+)
+
+// RunDaemon starts the node and the chat services without the terminal UI.
+// Received messages are written to the log. It blocks until ctx is cancelled,
+// then leaves the rooms, stops the discovery services and closes the host.
+func RunDaemon(ctx context.Context) error {
+	svc, err := startServices(ctx)
+	if err != nil {
+		return err
+	}
+	defer svc.close()
+
+	// Initialize the p2p node, starting discovery services and event listeners
+	if err := svc.node.Init(); err != nil {
+		return err
+	}
+	logger.Infof("Node %s started, listening on %v", svc.node.ID(), svc.node.Addrs())
+	for _, roomName := range svc.rm.Rooms() {
+		logger.Infof("Joined room %s", roomName)
+	}
+
+	// Drain the message channels, so that the rooms never block
+	for {
+		select {
+		case m := <-svc.rm.Messages():
+			if m.Error != "" {
+				logger.Warnf("[%s] undecryptable message from %s: %s", m.Room, m.SenderID, m.Error)
+				continue
+			}
+			logger.Infof("[%s] %s (%s): %s", m.Room, m.SenderNick, m.SenderID, m.Message)
+		case m := <-svc.dms.Messages():
+			logger.Infof("[dm] %s (%s): %s", m.SenderNick, m.SenderID, m.Message)
+		case inv := <-svc.rm.Invitations():
+			logger.Infof("Invited to room %s by %s (%s), accept it through the control API", inv.ACL.Room, inv.SenderNick, inv.ACL.Owner)
+		case res := <-svc.rm.Synced():
+			logger.Infof("Fetched %d missed messages in %s", len(res.Records), res.Room)
+		case <-ctx.Done():
+			logger.Info("Shutting down")
+			return nil
+		}
+	}
+}
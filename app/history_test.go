@@ -0,0 +1,224 @@
+package app
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/alejoacosta74/libp2p-chat-app/history"
+	"github.com/alejoacosta74/libp2p-chat-app/p2p/message"
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	pb "github.com/libp2p/go-libp2p-pubsub/pb"
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+	mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
+)
+
+// signMessage returns a pubsub message published by key, signed as pubsub
+// signs them
+func signMessage(t *testing.T, key crypto.PrivKey, topic string, env *message.Envelope) []byte {
+	t.Helper()
+	from, err := peer.IDFromPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := message.Encode(env, message.FormatProtobuf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &pb.Message{From: []byte(from), Data: data, Seqno: []byte{1}, Topic: &topic}
+	unsigned, err := m.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Signature, err = key.Sign(append([]byte(pubsub.SignPrefix), unsigned...)); err != nil {
+		t.Fatal(err)
+	}
+	signed, err := m.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed
+}
+
+func TestVerifyRecord(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	mn := mocknet.New()
+	defer mn.Close()
+	key, _ := newTestKey(t)
+	h, err := mn.AddPeer(key, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ps, err := pubsub.NewGossipSub(ctx, h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, err := history.Open(filepath.Join(t.TempDir(), "history.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	rm := NewRoomManager(ctx, ps, h.ID(), "owner", store)
+	rm.privKey = key
+	cr, err := rm.Create("private", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rm.Leave("private")
+
+	// our own messages are saved along with their signed message
+	if err := cr.Publish("hello"); err != nil {
+		t.Fatal(err)
+	}
+	var own *history.Record
+	for deadline := time.Now().Add(5 * time.Second); own == nil; {
+		if recs, _ := store.Last(cr.HistoryName(), 1); len(recs) == 1 {
+			own = recs[0]
+		} else if time.Now().After(deadline) {
+			t.Fatal("the published message was not saved")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if len(own.Signed) == 0 {
+		t.Fatal("the published message was saved without its signed message")
+	}
+
+	member, memberID := newTestKey(t)
+	mallory, malloryID := newTestKey(t)
+	if _, err := rm.addMember(cr, memberID, key); err != nil {
+		t.Fatal(err)
+	}
+	topic := cr.topic.String()
+	chat := func(sender peer.ID, ts time.Time) *message.Envelope {
+		env := message.New(message.TypeChat, "private", sender.String(), "nick", []byte("hi"))
+		env.Timestamp = ts.UnixMilli()
+		return env
+	}
+	record := func(env *message.Envelope, signed []byte) *history.Record {
+		return &history.Record{Room: "private", ID: env.ID, Timestamp: env.Timestamp, SenderID: env.SenderID, Message: "forged", Signed: signed}
+	}
+	valid := chat(memberID, time.Now().Add(-time.Hour))
+	tampered := append([]byte(nil), own.Signed...)
+	tampered[len(tampered)-1] ^= 0xff
+	future := chat(memberID, time.Now().Add(time.Hour))
+	spoofed := chat(h.ID(), time.Now())
+	outsider := chat(malloryID, time.Now())
+
+	tests := []struct {
+		name    string
+		record  *history.Record
+		wantErr bool
+	}{
+		{name: "own message", record: own},
+		{name: "member message", record: record(valid, signMessage(t, member, topic, valid))},
+		{name: "not signed", record: &history.Record{Room: "private", ID: own.ID, Message: own.Message}, wantErr: true},
+		{name: "tampered", record: &history.Record{Room: "private", ID: own.ID, Signed: tampered}, wantErr: true},
+		{name: "other message", record: &history.Record{Room: "private", ID: valid.ID, Signed: own.Signed}, wantErr: true},
+		{name: "other topic", record: record(valid, signMessage(t, member, topicName("private"), valid)), wantErr: true},
+		{name: "not a member", record: record(outsider, signMessage(t, mallory, topic, outsider)), wantErr: true},
+		{name: "spoofed sender", record: record(spoofed, signMessage(t, member, topic, spoofed)), wantErr: true},
+		{name: "future", record: record(future, signMessage(t, member, topic, future)), wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := cr.verifyRecord(tt.record, time.Minute)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want error %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			// the record is rebuilt from the signed message
+			if got.ID != tt.record.ID || got.Message == "forged" || got.Room != cr.HistoryName() {
+				t.Errorf("got record %+v", got)
+			}
+		})
+	}
+}
+
+func TestHistoryName(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	mn := mocknet.New()
+	defer mn.Close()
+	h, err := mn.GenPeer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ps, err := pubsub.NewGossipSub(ctx, h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, err := history.Open(filepath.Join(t.TempDir(), "history.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	rm := NewRoomManager(ctx, ps, h.ID(), "alice", store)
+	_, stranger := newTestKey(t)
+
+	// publish sends text to the room and waits for it to be saved
+	publish := func(cr *ChatRoom, text string) {
+		t.Helper()
+		if err := cr.Publish(text); err != nil {
+			t.Fatal(err)
+		}
+		for deadline := time.Now().Add(5 * time.Second); !time.Now().After(deadline); time.Sleep(10 * time.Millisecond) {
+			if recs, _ := store.Search(cr.HistoryName(), text, 1); len(recs) == 1 {
+				return
+			}
+		}
+		t.Fatalf("message %q not saved", text)
+	}
+	// messages returns the saved messages of the room
+	messages := func(cr *ChatRoom) []string {
+		t.Helper()
+		recs, err := store.Last(cr.HistoryName(), 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var texts []string
+		for _, r := range recs {
+			texts = append(texts, r.Message)
+		}
+		return texts
+	}
+
+	encrypted, err := rm.JoinEncrypted("foo", "passphrase")
+	if err != nil {
+		t.Fatal(err)
+	}
+	publish(encrypted, "secret")
+	if err := rm.Leave("foo"); err != nil {
+		t.Fatal(err)
+	}
+	plain, err := rm.Join("foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rm.Leave("foo")
+	// the history of open rooms keeps the name it was saved under before
+	if plain.HistoryName() != "foo" || encrypted.HistoryName() == "foo" {
+		t.Errorf("got history names %q and %q", plain.HistoryName(), encrypted.HistoryName())
+	}
+	publish(plain, "public")
+
+	if got := messages(plain); len(got) != 1 || got[0] != "public" {
+		t.Errorf("got messages %q in the clear room", got)
+	}
+	if got := messages(encrypted); len(got) != 1 || got[0] != "secret" {
+		t.Errorf("got messages %q in the encrypted room", got)
+	}
+	// the history of the encrypted room is not served by the clear one
+	if err := rm.authorizeHistory(encrypted.HistoryName(), stranger); err == nil {
+		t.Error("the history of the encrypted room is served")
+	}
+	if err := rm.authorizeHistory(plain.HistoryName(), stranger); err != nil {
+		t.Errorf("the history of the clear room is not served: %v", err)
+	}
+}
@@ -0,0 +1,35 @@
+package app
+
+import (
+	"github.com/alejoacosta74/libp2p-chat-app/p2p/node"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// metrics of the chat rooms, registered on the node's metrics registry
+var (
+	messagesPublished = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: node.MetricsNamespace,
+		Name:      "messages_published_total",
+		Help:      "Chat messages published, by room.",
+	}, []string{"room"})
+	messagesReceived = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: node.MetricsNamespace,
+		Name:      "messages_received_total",
+		Help:      "Chat messages received from other peers, by room.",
+	}, []string{"room"})
+	messagesThrottled = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: node.MetricsNamespace,
+		Name:      "messages_throttled_total",
+		Help:      "Chat messages dropped by the per-sender rate limit, by room.",
+	}, []string{"room"})
+)
+
+// registerMetrics registers the metrics of the chat rooms
+func registerMetrics(reg prometheus.Registerer) error {
+	for _, c := range []prometheus.Collector{messagesPublished, messagesReceived, messagesThrottled} {
+		if err := reg.Register(c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,388 @@
+package app
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/alejoacosta74/go-logger"
+	"github.com/alejoacosta74/libp2p-chat-app/p2p/message"
+	"github.com/alejoacosta74/libp2p-chat-app/p2p/nickname"
+	"github.com/alejoacosta74/libp2p-chat-app/p2p/ratelimit"
+	"github.com/libp2p/go-libp2p/core/peer"
+
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+)
+
+const (
+	// PresenceInterval is the period of the presence heartbeats
+	PresenceInterval = 10 * time.Second
+
+	// PresenceTTL is how long a heartbeat is valid for, so that a peer is
+	// forgotten after missing a few of them
+	PresenceTTL = 3 * PresenceInterval
+
+	// TypingTimeout is how long a peer is shown typing after a heartbeat saying so
+	TypingTimeout = 5 * time.Second
+
+	// typingRefresh is the minimum period of the heartbeats sent while typing
+	typingRefresh = 2 * time.Second
+
+	// greetDelay is how long to wait before greeting the peers joining the
+	// topic, so that gossipsub has grafted them in the mesh
+	greetDelay = 2 * time.Second
+)
+
+// presenceRateLimit limits the heartbeats of each peer to about one per
+// typingRefresh, the fastest an honest peer sends them, with a small burst
+// for the status changes and greetings
+var presenceRateLimit = &ratelimit.Config{
+	Rate:  float64(time.Second) / float64(typingRefresh),
+	Burst: 5,
+}
+
+// Status is the availability a peer announces in the rooms
+type Status string
+
+const (
+	StatusOnline Status = "online"
+	StatusAway   Status = "away"
+	StatusBusy   Status = "busy"
+)
+
+// ParseStatus returns the status with the given name
+func ParseStatus(s string) (Status, error) {
+	switch status := Status(s); status {
+	case StatusOnline, StatusAway, StatusBusy:
+		return status, nil
+	}
+	return "", fmt.Errorf("invalid status %q, must be one of online, away or busy", s)
+}
+
+// Presence is the last state announced by a peer of a room
+type Presence struct {
+	ID      peer.ID
+	Nick    string
+	Status  Status
+	Typing  bool
+	Expires time.Time
+}
+
+// heartbeat is the payload of the presence envelopes
+type heartbeat struct {
+	Status Status
+	Typing bool  `json:",omitempty"`
+	TTL    int64 // milliseconds the heartbeat is valid for, 0 when leaving the room
+	// Announcement is the signed nickname announcement of the sender, see AddressBook
+	Announcement []byte `json:",omitempty"`
+}
+
+// presence announces our status on the presence topic of a room, and tracks
+// the status of the other peers of the room
+type presence struct {
+	cr     *ChatRoom
+	topic  *pubsub.Topic
+	sub    *pubsub.Subscription
+	events *pubsub.TopicEventHandler // peers joining the topic, greeted with a heartbeat
+	// wake asks the loop to publish a heartbeat right away. The heartbeats are
+	// only published by the loop, so that they reach the peers in order.
+	wake    chan struct{}
+	leaving chan struct{} // closed by leave, the loop publishing the last heartbeat
+	stopped chan struct{} // closed when the loop returns
+
+	mu         sync.Mutex
+	status     Status
+	typing     bool
+	typingSent time.Time
+	peers      map[peer.ID]*Presence
+	typingEnd  map[peer.ID]time.Time
+}
+
+// presenceTopic returns the presence topic of the room with the given topic
+func presenceTopic(roomTopic string) string {
+	return roomTopic + "/presence"
+}
+
+// joinPresence subscribes to the presence topic of the room
+func joinPresence(cr *ChatRoom) (*presence, error) {
+	topic, err := cr.ps.Join(presenceTopic(cr.topic.String()))
+	if err != nil {
+		return nil, err
+	}
+	events, err := topic.EventHandler()
+	if err != nil {
+		topic.Close()
+		return nil, err
+	}
+	sub, err := topic.Subscribe()
+	if err != nil {
+		events.Cancel()
+		topic.Close()
+		return nil, err
+	}
+	return &presence{
+		cr:        cr,
+		topic:     topic,
+		sub:       sub,
+		events:    events,
+		wake:      make(chan struct{}, 1),
+		leaving:   make(chan struct{}),
+		stopped:   make(chan struct{}),
+		status:    StatusOnline,
+		peers:     make(map[peer.ID]*Presence),
+		typingEnd: make(map[peer.ID]time.Time),
+	}, nil
+}
+
+// setStatus announces the status right away if it changed
+func (p *presence) setStatus(status Status) {
+	p.mu.Lock()
+	changed := p.status != status
+	p.status = status
+	p.mu.Unlock()
+	if changed {
+		p.announceNow()
+	}
+}
+
+// setTyping announces that we started or stopped typing. While typing, the
+// heartbeat is repeated at most every typingRefresh.
+func (p *presence) setTyping(typing bool) {
+	p.mu.Lock()
+	send := typing != p.typing || (typing && time.Since(p.typingSent) >= typingRefresh)
+	p.typing = typing
+	if send && typing {
+		p.typingSent = time.Now()
+	}
+	p.mu.Unlock()
+	if send {
+		p.announceNow()
+	}
+}
+
+// announceNow asks the loop to publish a heartbeat with the current state,
+// without blocking. The requests made while one is pending are merged.
+func (p *presence) announceNow() {
+	select {
+	case p.wake <- struct{}{}:
+	default:
+	}
+}
+
+// announce publishes a heartbeat valid for ttl
+func (p *presence) announce(ttl time.Duration) {
+	p.mu.Lock()
+	hb := &heartbeat{Status: p.status, Typing: p.typing, TTL: ttl.Milliseconds()}
+	p.mu.Unlock()
+	if p.cr.book != nil {
+		hb.Announcement = p.cr.book.Self()
+	}
+	if p.cr.forwardOnly || !p.cr.IsMember(p.cr.self) {
+		return
+	}
+	payload, err := json.Marshal(hb)
+	if err != nil {
+		return
+	}
+	env := message.New(message.TypePresence, p.cr.roomName, p.cr.self.String(), p.cr.Nick(), payload)
+	if p.cr.key != nil {
+		if env, err = p.cr.key.Seal(env); err != nil {
+			logger.Warn("error encrypting heartbeat", err)
+			return
+		}
+	}
+	data, err := message.Encode(env, p.cr.format)
+	if err != nil {
+		logger.Warn("error marshalling heartbeat", err)
+		return
+	}
+	if err := p.topic.Publish(p.cr.ctx, data); err != nil && p.cr.ctx.Err() == nil {
+		logger.Debugf("error publishing heartbeat in room %s: %v", p.cr.roomName, err)
+	}
+}
+
+// loop sends the heartbeats and receives the ones of the other peers until
+// the room is left
+func (p *presence) loop() {
+	defer close(p.stopped)
+	go p.receive()
+	if !p.cr.forwardOnly {
+		go p.watchPeers()
+	}
+
+	ticker := time.NewTicker(PresenceInterval)
+	defer ticker.Stop()
+	for {
+		p.announce(PresenceTTL)
+		select {
+		case <-ticker.C:
+			p.expire()
+		case <-p.wake:
+			// our state changed, or a new peer must learn about us
+		case <-p.leaving:
+			p.announce(0)
+			return
+		case <-p.cr.ctx.Done():
+			return
+		}
+	}
+}
+
+// watchPeers wakes the loop up when peers join the presence topic
+func (p *presence) watchPeers() {
+	for {
+		ev, err := p.events.NextPeerEvent(p.cr.ctx)
+		if err != nil {
+			return
+		}
+		if ev.Type != pubsub.PeerJoin {
+			continue
+		}
+		select {
+		case <-time.After(greetDelay):
+		case <-p.cr.ctx.Done():
+			return
+		}
+		p.announceNow()
+	}
+}
+
+// receive records the heartbeats published in the room
+func (p *presence) receive() {
+	for {
+		msg, err := p.sub.Next(p.cr.ctx)
+		if err != nil {
+			if p.cr.ctx.Err() != nil || errors.Is(err, pubsub.ErrSubscriptionCancelled) {
+				return
+			}
+			logger.Warn("error receiving heartbeat", err)
+			continue
+		}
+		if msg.GetFrom() == p.cr.self || p.cr.forwardOnly {
+			continue
+		}
+		if err := p.update(msg); err != nil {
+			logger.Debugf("dropping heartbeat from %s in room %s: %v", msg.GetFrom(), p.cr.roomName, err)
+		}
+	}
+}
+
+// update decodes a heartbeat and records the state of its sender
+func (p *presence) update(msg *pubsub.Message) error {
+	env, err := message.Decode(msg.Data)
+	if err != nil {
+		return err
+	}
+	from := msg.GetFrom()
+	if env.SenderID != from.String() {
+		return fmt.Errorf("sender ID %s does not match signed origin %s", env.SenderID, from)
+	}
+	if !p.cr.IsMember(from) {
+		return errors.New("sender is not a member of the room")
+	}
+	if p.cr.key != nil {
+		if env, err = p.cr.key.Open(env); err != nil {
+			return err
+		}
+	} else if env.Encrypted {
+		return errors.New("encrypted heartbeat published in a clear room")
+	}
+	if env.Type != message.TypePresence || env.Room != p.cr.roomName {
+		return errors.New("not a heartbeat of the room")
+	}
+	hb := new(heartbeat)
+	if err := json.Unmarshal(env.Payload, hb); err != nil {
+		return err
+	}
+	if _, err := ParseStatus(string(hb.Status)); err != nil {
+		return err
+	}
+	// the nickname of the envelope is not signed, so it is only shown if the
+	// peer announced none
+	nick := env.SenderNick
+	if nick != "" {
+		if err := nickname.Validate(nick); err != nil {
+			return err
+		}
+	}
+	if p.cr.book != nil {
+		if len(hb.Announcement) > 0 {
+			if _, err := p.cr.book.Update(from, hb.Announcement); err != nil {
+				logger.Debugf("ignoring nickname announcement of %s: %v", from, err)
+			}
+		}
+		if announced, ok := p.cr.book.Nick(from); ok {
+			nick = announced
+		}
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if hb.TTL <= 0 {
+		delete(p.peers, from)
+		delete(p.typingEnd, from)
+		return nil
+	}
+	ttl := min(time.Duration(hb.TTL)*time.Millisecond, 2*PresenceTTL)
+	p.peers[from] = &Presence{
+		ID:      from,
+		Nick:    nick,
+		Status:  hb.Status,
+		Expires: time.Now().Add(ttl),
+	}
+	if hb.Typing {
+		p.typingEnd[from] = time.Now().Add(TypingTimeout)
+	} else {
+		delete(p.typingEnd, from)
+	}
+	return nil
+}
+
+// expire forgets the peers whose last heartbeat expired
+func (p *presence) expire() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := time.Now()
+	for id, state := range p.peers {
+		if now.After(state.Expires) {
+			delete(p.peers, id)
+			delete(p.typingEnd, id)
+		}
+	}
+}
+
+// list returns the state of the peers with an unexpired heartbeat, sorted by nickname
+func (p *presence) list() []*Presence {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := time.Now()
+	var peers []*Presence
+	for id, state := range p.peers {
+		if now.After(state.Expires) {
+			continue
+		}
+		s := *state
+		s.Typing = now.Before(p.typingEnd[id])
+		peers = append(peers, &s)
+	}
+	sort.Slice(peers, func(i, j int) bool {
+		if peers[i].Nick != peers[j].Nick {
+			return peers[i].Nick < peers[j].Nick
+		}
+		return peers[i].ID < peers[j].ID
+	})
+	return peers
+}
+
+// leave tells the other peers we are leaving, after any heartbeat the loop
+// was publishing, and closes the presence topic
+func (p *presence) leave() error {
+	close(p.leaving)
+	<-p.stopped
+	p.events.Cancel()
+	p.sub.Cancel()
+	return p.topic.Close()
+}
@@ -0,0 +1,73 @@
+package app
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/alejoacosta74/libp2p-chat-app/p2p/message"
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	pb "github.com/libp2p/go-libp2p-pubsub/pb"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// heartbeatFrom returns a heartbeat of the lobby room published by the peer
+// under the given nickname
+func heartbeatFrom(t *testing.T, from peer.ID, nick string, hb *heartbeat) *pubsub.Message {
+	t.Helper()
+	payload, err := json.Marshal(hb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := message.Encode(message.New(message.TypePresence, "lobby", from.String(), nick, payload), message.FormatProtobuf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &pubsub.Message{Message: &pb.Message{From: []byte(from), Data: data}}
+}
+
+func TestPresenceNick(t *testing.T) {
+	selfKey, _ := newTestKey(t)
+	aliceKey, alice := newTestKey(t)
+	_, bob := newTestKey(t)
+
+	book, err := NewAddressBook(selfKey, "me", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &presence{
+		cr:        &ChatRoom{roomName: "lobby", book: book},
+		peers:     make(map[peer.ID]*Presence),
+		typingEnd: make(map[peer.ID]time.Time),
+	}
+	ttl := PresenceTTL.Milliseconds()
+
+	tests := []struct {
+		name     string
+		msg      *pubsub.Message
+		wantErr  bool
+		wantNick string
+	}{
+		{name: "claimed nickname", msg: heartbeatFrom(t, bob, "bob", &heartbeat{Status: StatusOnline, TTL: ttl}), wantNick: "bob"},
+		{name: "no nickname", msg: heartbeatFrom(t, bob, "", &heartbeat{Status: StatusOnline, TTL: ttl})},
+		{name: "tags", msg: heartbeatFrom(t, bob, "alice[-]", &heartbeat{Status: StatusOnline, TTL: ttl}), wantErr: true},
+		{name: "several lines", msg: heartbeatFrom(t, bob, "alice\nis typing", &heartbeat{Status: StatusOnline, TTL: ttl}), wantErr: true},
+		// the signed announcement wins over the claimed nickname
+		{name: "announced nickname", msg: heartbeatFrom(t, alice, "mallory", &heartbeat{Status: StatusOnline, TTL: ttl, Announcement: announce(t, aliceKey, "alice")}), wantNick: "alice"},
+	}
+	for _, tt := range tests {
+		from := tt.msg.GetFrom()
+		delete(p.peers, from)
+		err := p.update(tt.msg)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: got error %v, want error %v", tt.name, err, tt.wantErr)
+		}
+		state, ok := p.peers[from]
+		if ok == tt.wantErr {
+			t.Errorf("%s: got recorded %v, want %v", tt.name, ok, !tt.wantErr)
+		}
+		if ok && state.Nick != tt.wantNick {
+			t.Errorf("%s: got nickname %q, want %q", tt.name, state.Nick, tt.wantNick)
+		}
+	}
+}
@@ -0,0 +1,131 @@
+package app
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/alejoacosta74/go-logger"
+	"github.com/alejoacosta74/libp2p-chat-app/p2p/discovery"
+	"github.com/alejoacosta74/libp2p-chat-app/p2p/identity"
+	"github.com/alejoacosta74/libp2p-chat-app/p2p/node"
+	"github.com/spf13/viper"
+)
+
+// DefaultRelayListenAddrs are the addresses the relay node listens on when none
+// are configured. Only the TCP one is used in a private network.
+var DefaultRelayListenAddrs = []string{"/ip4/0.0.0.0/tcp/4001", "/ip4/0.0.0.0/udp/4001/quic-v1"}
+
+// RunRelay runs an infrastructure node for the peers behind NATs: a circuit
+// relay v2 service, a DHT server, and the chat rooms in a forward-only role,
+// validating and gossiping their messages without storing or posting any.
+// It blocks until ctx is cancelled.
+func RunRelay(ctx context.Context) error {
+	// Load the persistent node identity, so that the relay multiaddrs stay the same across restarts
+	ks := identity.NewKeyStore(viper.GetString("identity"), viper.GetString("identity-passphrase"))
+	privKey, err := ks.LoadOrCreate()
+	if err != nil {
+		return fmt.Errorf("failed to load identity from %s: %w", ks.Path(), err)
+	}
+
+	nodeConfig := node.NewNodeConfig()
+	nodeConfig.PrivKey = privKey
+	if nodeConfig.SwarmKey, err = swarmKey(); err != nil {
+		return err
+	}
+	nodeConfig.ListenAddrs = viper.GetStringSlice("relay-service.listen")
+	if len(nodeConfig.ListenAddrs) == 0 {
+		nodeConfig.ListenAddrs = DefaultRelayListenAddrs
+		if len(nodeConfig.SwarmKey) > 0 {
+			nodeConfig.ListenAddrs = DefaultRelayListenAddrs[:1]
+		}
+	}
+	nodeConfig.Discovery = discoveryConfig()
+	nodeConfig.Discovery.DHTMode = discovery.DHTModeServer
+	nodeConfig.NAT.ForcePublic = viper.GetBool("relay-service.force-public")
+	nodeConfig.RelayService = node.NewRelayServiceConfig()
+	if v := viper.GetInt("relay-service.max-reservations"); v > 0 {
+		nodeConfig.RelayService.MaxReservations = v
+	}
+	if v := viper.GetInt("relay-service.max-reservations-per-ip"); v > 0 {
+		nodeConfig.RelayService.MaxReservationsPerIP = v
+	}
+	if v := viper.GetInt("relay-service.max-circuits"); v > 0 {
+		nodeConfig.RelayService.MaxCircuits = v
+	}
+	if v := viper.GetDuration("relay-service.reservation-ttl"); v > 0 {
+		nodeConfig.RelayService.ReservationTTL = v
+	}
+	if v := viper.GetDuration("relay-service.limit-duration"); v > 0 {
+		nodeConfig.RelayService.LimitDuration = v
+	}
+	if v := viper.GetInt64("relay-service.limit-data"); v > 0 {
+		nodeConfig.RelayService.LimitData = v
+	}
+	p2pNode, err := node.NewNode(ctx, nodeConfig)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := p2pNode.Close(); err != nil {
+			logger.Warnf("failed to close node: %v", err)
+		}
+	}()
+
+	if addr := viper.GetString("metrics"); addr != "" {
+		if err := registerMetrics(p2pNode.MetricsRegistry()); err != nil {
+			return fmt.Errorf("failed to register metrics: %w", err)
+		}
+		if err := p2pNode.ServeMetrics(addr); err != nil {
+			return fmt.Errorf("failed to serve metrics: %w", err)
+		}
+	}
+
+	ps, err := p2pNode.CreatePubSubService()
+	if err != nil {
+		return err
+	}
+
+	// Join the chat topics without a history store, nor heartbeats, so that
+	// the relay only validates and forwards their messages
+	rm := NewRoomManager(ctx, ps, p2pNode.ID(), "relay", nil)
+	rm.SetForwardOnly()
+	rm.SetValidator(p2pNode.Validator())
+	rm.SetTopicScoreParams(p2pNode.TopicScoreParams())
+	defer func() {
+		for _, roomName := range rm.Rooms() {
+			if err := rm.Leave(roomName); err != nil {
+				logger.Debugf("failed to leave room %s: %v", roomName, err)
+			}
+		}
+	}()
+	rooms := viper.GetStringSlice("relay-service.rooms")
+	if len(rooms) == 0 && viper.GetString("room") != "" {
+		rooms = []string{viper.GetString("room")}
+	}
+	for _, roomName := range rooms {
+		if _, err := rm.Join(roomName); err != nil {
+			return err
+		}
+		logger.Infof("Forwarding room %s", roomName)
+	}
+
+	if err := p2pNode.Init(); err != nil {
+		return err
+	}
+
+	// Print the full multiaddrs, for the clients to use as bootstrap peers and static relays
+	fmt.Printf("Relay %s listening on:\n", p2pNode.ID())
+	for _, addr := range p2pNode.Addrs() {
+		fmt.Printf("  %s/p2p/%s\n", addr, p2pNode.ID())
+	}
+
+	// Drain the room messages, so that the rooms never block
+	for {
+		select {
+		case <-rm.Messages():
+		case <-ctx.Done():
+			logger.Info("Shutting down")
+			return nil
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package app
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	"github.com/libp2p/go-libp2p/core/peer"
+	mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
+)
+
+// TestForwardOnlyRoom checks that a relay forwards the heartbeats of the
+// peers of a room between the peers it connects, without publishing its own
+func TestForwardOnlyRoom(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	mn, err := mocknet.FullMeshLinked(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mn.Close()
+	hosts := mn.Hosts()
+	alice, relay, carol := hosts[0], hosts[1], hosts[2]
+
+	managers := make([]*RoomManager, len(hosts))
+	for i, h := range hosts {
+		ps, err := pubsub.NewGossipSub(ctx, h)
+		if err != nil {
+			t.Fatal(err)
+		}
+		managers[i] = NewRoomManager(ctx, ps, h.ID(), h.ID().String(), nil)
+	}
+	managers[1].SetForwardOnly()
+
+	rooms := make([]*ChatRoom, len(managers))
+	for i, rm := range managers {
+		if rooms[i], err = rm.Join("lobby"); err != nil {
+			t.Fatal(err)
+		}
+		defer rm.Leave("lobby")
+	}
+	// alice and carol only reach each other through the relay
+	for _, h := range []peer.ID{alice.ID(), carol.ID()} {
+		if _, err := mn.ConnectPeers(relay.ID(), h); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	deadline := time.After(10 * time.Second)
+	for {
+		peers := rooms[0].Presence()
+		for _, p := range peers {
+			if p.ID == relay.ID() {
+				t.Fatal("the relay published a heartbeat")
+			}
+		}
+		if len(peers) == 1 && peers[0].ID == carol.ID() {
+			break
+		}
+		select {
+		case <-deadline:
+			t.Fatalf("the heartbeats of carol were not forwarded, got %d peers", len(peers))
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+	if peers := rooms[1].Presence(); len(peers) != 0 {
+		t.Errorf("the relay recorded %d peers", len(peers))
+	}
+}
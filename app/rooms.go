@@ -0,0 +1,604 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/alejoacosta74/go-logger"
+	"github.com/alejoacosta74/libp2p-chat-app/history"
+	"github.com/alejoacosta74/libp2p-chat-app/p2p/acl"
+	"github.com/alejoacosta74/libp2p-chat-app/p2p/historysync"
+	"github.com/alejoacosta74/libp2p-chat-app/p2p/message"
+	"github.com/alejoacosta74/libp2p-chat-app/p2p/nickname"
+	"github.com/alejoacosta74/libp2p-chat-app/p2p/ratelimit"
+	"github.com/alejoacosta74/libp2p-chat-app/p2p/validator"
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+const (
+	// syncWaitTimeout is how long a newly joined room waits for topic peers
+	// to ask for the messages it missed
+	syncWaitTimeout = 30 * time.Second
+
+	// maxSyncPeers is the maximum number of topic peers asked for missed messages
+	maxSyncPeers = 5
+)
+
+// RoomMessage is a ChatMessage tagged with the name of the room it was received in.
+type RoomMessage struct {
+	Room string
+	*ChatMessage
+}
+
+// SyncResult holds the messages of a room fetched from other peers after joining it.
+type SyncResult struct {
+	Room    string
+	Records []*history.Record
+}
+
+// roomLimiters holds the rate limiters of a room
+type roomLimiters struct {
+	topic    *ratelimit.Limiter // keyed by the signed origin of the messages, used by the topic validator
+	delivery *ratelimit.Limiter // keyed by the sender of the messages, used by the room event loop
+	presence *ratelimit.Limiter // keyed by the signed origin of the heartbeats, used by the presence topic validator
+}
+
+// RoomManager holds the chat rooms joined on a single PubSub service. Messages
+// received in any of the rooms are forwarded to the Messages channel.
+type RoomManager struct {
+	ctx         context.Context
+	ps          *pubsub.PubSub
+	self        peer.ID
+	nick        string
+	store       *history.Store
+	format      message.Format           // encoding of the envelopes published in the rooms
+	syncer      *historysync.Service     // optional, fetches missed messages when joining a room
+	validator   *validator.Validator     // optional, checks the messages of every room topic
+	scoreParams *pubsub.TopicScoreParams // optional, peer score parameters of every room topic
+	rateLimit   *ratelimit.Config        // optional, default per-peer rate limit of every room
+	roomLimits  map[string]*ratelimit.Config
+	invites     *acl.Service   // optional, delivers the invitations to restricted rooms
+	privKey     crypto.PrivKey // signs the access control lists of the rooms we own
+	status      Status         // availability announced in every room
+	book        *AddressBook   // optional, nicknames announced by the peers of every room
+	forwardOnly bool           // the rooms only relay the heartbeats of their peers, see SetForwardOnly
+
+	mu     sync.RWMutex
+	rooms  map[string]*ChatRoom
+	order  []string // room names in the order they were joined
+	unread map[string]int
+	limits map[string]*roomLimiters
+	// pending holds the invitations to restricted rooms not accepted yet, by room
+	pending map[string]*acl.Invitation
+
+	inboundChan chan *RoomMessage    // messages received from all the rooms
+	syncedChan  chan *SyncResult     // missed messages fetched from other peers
+	invitedChan chan *acl.Invitation // invitations to restricted rooms received from their owners
+
+	subsMu sync.Mutex
+	subs   map[chan *RoomMessage]struct{} // subscribers getting a copy of the received messages
+}
+
+// NewRoomManager creates an empty RoomManager for the given PubSub service.
+// The messages of every joined room are saved to store, unless it is nil.
+func NewRoomManager(ctx context.Context, ps *pubsub.PubSub, selfID peer.ID, nickname string, store *history.Store) *RoomManager {
+	return &RoomManager{
+		ctx:         ctx,
+		ps:          ps,
+		self:        selfID,
+		nick:        nickname,
+		store:       store,
+		format:      message.FormatProtobuf,
+		status:      StatusOnline,
+		rooms:       make(map[string]*ChatRoom),
+		unread:      make(map[string]int),
+		limits:      make(map[string]*roomLimiters),
+		pending:     make(map[string]*acl.Invitation),
+		inboundChan: make(chan *RoomMessage, ChatRoomBufSize),
+		syncedChan:  make(chan *SyncResult, 8),
+		invitedChan: make(chan *acl.Invitation, 8),
+		subs:        make(map[chan *RoomMessage]struct{}),
+	}
+}
+
+// SetValidator registers the validator on the topic of every room joined from now on.
+func (rm *RoomManager) SetValidator(v *validator.Validator) {
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+	rm.validator = v
+}
+
+// SetWireFormat sets the encoding of the envelopes published in every room
+// joined from now on.
+func (rm *RoomManager) SetWireFormat(format message.Format) {
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+	rm.format = format
+}
+
+// SetTopicScoreParams sets the peer score parameters of the topic of every
+// room joined from now on.
+func (rm *RoomManager) SetTopicScoreParams(params *pubsub.TopicScoreParams) {
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+	rm.scoreParams = params
+}
+
+// SetRateLimits throttles the messages of each peer in every room joined from
+// now on. The rate limits of a room can be overridden in rooms, keyed by the
+// lowercased room name.
+func (rm *RoomManager) SetRateLimits(defaults *ratelimit.Config, rooms map[string]*ratelimit.Config) {
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+	rm.rateLimit = defaults
+	rm.roomLimits = rooms
+}
+
+// SetForwardOnly makes every room joined from now on forward the heartbeats of
+// its peers without publishing ours, for the nodes that only relay the rooms.
+func (rm *RoomManager) SetForwardOnly() {
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+	rm.forwardOnly = true
+}
+
+// EnableHistorySync makes every room joined from now on ask its topic peers
+// for the messages published before we subscribed.
+func (rm *RoomManager) EnableHistorySync(syncer *historysync.Service) {
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+	rm.syncer = syncer
+}
+
+// EnableAddressBook announces our nickname in every room joined from now on,
+// and records the nicknames announced by their peers in book.
+func (rm *RoomManager) EnableAddressBook(book *AddressBook) {
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+	rm.book = book
+}
+
+// AddressBook returns the address book of the rooms, or nil if not enabled.
+func (rm *RoomManager) AddressBook() *AddressBook {
+	rm.mu.RLock()
+	defer rm.mu.RUnlock()
+	return rm.book
+}
+
+// Join subscribes to the room, returning the existing ChatRoom if the room
+// was already joined. Rooms we were invited to, or created, are restricted
+// to their members.
+func (rm *RoomManager) Join(roomName string) (*ChatRoom, error) {
+	return rm.join(roomName, "", nil)
+}
+
+// JoinEncrypted subscribes to the end-to-end encrypted room with the given
+// name and passphrase, returning the existing ChatRoom if the room was
+// already joined. Only the peers knowing both can read its messages.
+func (rm *RoomManager) JoinEncrypted(roomName, passphrase string) (*ChatRoom, error) {
+	if passphrase == "" {
+		return nil, errors.New("an encrypted room requires a passphrase")
+	}
+	return rm.join(roomName, passphrase, nil)
+}
+
+// join subscribes to the room. If roomACL is nil, the list saved in the
+// history store for the room, if any, restricts the room to its members.
+func (rm *RoomManager) join(roomName, passphrase string, roomACL *acl.ACL) (*ChatRoom, error) {
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+
+	if cr, ok := rm.rooms[roomName]; ok {
+		if cr.Encrypted() != (passphrase != "") {
+			return nil, fmt.Errorf("room %q already joined with another encryption setting", roomName)
+		}
+		return cr, nil
+	}
+
+	var key *message.RoomKey
+	if passphrase != "" {
+		var err error
+		if key, err = message.DeriveRoomKey(roomName, passphrase); err != nil {
+			return nil, err
+		}
+	}
+	if roomACL == nil {
+		roomACL = rm.storedACL(roomName)
+	}
+	var members *roomMembers
+	var isMember func(peer.ID) bool
+	if roomACL != nil {
+		members = newRoomMembers(roomACL)
+		isMember = members.IsMember
+	}
+	topic := roomTopic(roomName, key, members)
+
+	limits := rm.newLimiters(roomName)
+
+	// the validators must be in place before subscribing, so that no message
+	// skips them
+	if rm.validator != nil {
+		if err := rm.ps.RegisterTopicValidator(topic, rm.validator.TopicValidator(wireRoomName(roomName, key), limits.topic, isMember)); err != nil {
+			return nil, fmt.Errorf("failed to register topic validator: %w", err)
+		}
+		if err := rm.ps.RegisterTopicValidator(presenceTopic(topic), rm.validator.TopicValidator(wireRoomName(roomName, key), limits.presence, isMember)); err != nil {
+			rm.ps.UnregisterTopicValidator(topic)
+			return nil, fmt.Errorf("failed to register topic validator: %w", err)
+		}
+	}
+
+	cr, err := JoinChatRoom(rm.ctx, rm.ps, rm.self, rm.nick, roomName, RoomOptions{
+		Format:      rm.format,
+		Store:       rm.store,
+		Limiter:     limits.delivery,
+		Key:         key,
+		Members:     members,
+		Book:        rm.book,
+		ForwardOnly: rm.forwardOnly,
+	})
+	if err != nil {
+		if rm.validator != nil {
+			rm.ps.UnregisterTopicValidator(topic)
+			rm.ps.UnregisterTopicValidator(presenceTopic(topic))
+		}
+		return nil, err
+	}
+	if rm.status != StatusOnline {
+		cr.SetStatus(rm.status)
+	}
+	if rm.scoreParams != nil {
+		if err := cr.topic.SetScoreParams(rm.scoreParams); err != nil {
+			logger.Warnf("failed to set score parameters of room %s: %v", roomName, err)
+		}
+	}
+	rm.rooms[roomName] = cr
+	rm.limits[roomName] = limits
+	rm.order = append(rm.order, roomName)
+
+	go rm.forward(cr)
+	// the history sync protocol asks for the room by name, which would leak it
+	if rm.syncer != nil && key == nil {
+		go rm.syncHistory(cr, rm.syncer)
+	}
+	if members != nil {
+		go rm.announceACL(cr)
+	}
+	return cr, nil
+}
+
+// Leave unsubscribes from the room and forgets about it.
+func (rm *RoomManager) Leave(roomName string) error {
+	rm.mu.Lock()
+	cr, ok := rm.rooms[roomName]
+	if !ok {
+		rm.mu.Unlock()
+		return fmt.Errorf("not in room %q", roomName)
+	}
+	delete(rm.rooms, roomName)
+	delete(rm.unread, roomName)
+	delete(rm.limits, roomName)
+	for i, name := range rm.order {
+		if name == roomName {
+			rm.order = append(rm.order[:i], rm.order[i+1:]...)
+			break
+		}
+	}
+	hasValidator := rm.validator != nil
+	rm.mu.Unlock()
+
+	topic := cr.topic.String()
+	err := cr.Leave()
+	if hasValidator {
+		rm.ps.UnregisterTopicValidator(topic)
+		rm.ps.UnregisterTopicValidator(presenceTopic(topic))
+	}
+	return err
+}
+
+// Nick returns our nickname in the rooms.
+func (rm *RoomManager) Nick() string {
+	rm.mu.RLock()
+	defer rm.mu.RUnlock()
+	return rm.nick
+}
+
+// SetNick changes our nickname in every joined room, and the rooms joined
+// from now on. If the address book is enabled, the new nickname is announced
+// to the peers of the rooms.
+func (rm *RoomManager) SetNick(nick string) error {
+	if err := nickname.Validate(nick); err != nil {
+		return err
+	}
+	rm.mu.Lock()
+	rm.nick = nick
+	book := rm.book
+	rooms := make([]*ChatRoom, 0, len(rm.rooms))
+	for _, cr := range rm.rooms {
+		rooms = append(rooms, cr)
+	}
+	rm.mu.Unlock()
+
+	var announcement []byte
+	if book != nil {
+		if err := book.SetNick(nick); err != nil {
+			return fmt.Errorf("failed to sign nickname announcement: %w", err)
+		}
+		announcement = book.Self()
+	}
+	for _, cr := range rooms {
+		if err := cr.SetNick(nick, announcement); err != nil {
+			logger.Warnf("failed to announce nickname in room %s: %v", cr.Name(), err)
+		}
+	}
+	return nil
+}
+
+// SetStatus announces our availability in every joined room, and the rooms
+// joined from now on.
+func (rm *RoomManager) SetStatus(status Status) {
+	rm.mu.Lock()
+	rm.status = status
+	rooms := make([]*ChatRoom, 0, len(rm.rooms))
+	for _, cr := range rm.rooms {
+		rooms = append(rooms, cr)
+	}
+	rm.mu.Unlock()
+	for _, cr := range rooms {
+		cr.SetStatus(status)
+	}
+}
+
+// Status returns the availability announced in the rooms.
+func (rm *RoomManager) Status() Status {
+	rm.mu.RLock()
+	defer rm.mu.RUnlock()
+	return rm.status
+}
+
+// Room returns the joined room with the given name.
+func (rm *RoomManager) Room(roomName string) (*ChatRoom, bool) {
+	rm.mu.RLock()
+	defer rm.mu.RUnlock()
+	cr, ok := rm.rooms[roomName]
+	return cr, ok
+}
+
+// Rooms returns the names of the joined rooms in the order they were joined.
+func (rm *RoomManager) Rooms() []string {
+	rm.mu.RLock()
+	defer rm.mu.RUnlock()
+	return append([]string(nil), rm.order...)
+}
+
+// Unread returns the number of unread messages in the room.
+func (rm *RoomManager) Unread(roomName string) int {
+	rm.mu.RLock()
+	defer rm.mu.RUnlock()
+	return rm.unread[roomName]
+}
+
+// MarkUnread increments the unread counter of the room.
+func (rm *RoomManager) MarkUnread(roomName string) {
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+	if _, ok := rm.rooms[roomName]; ok {
+		rm.unread[roomName]++
+	}
+}
+
+// MarkRead resets the unread counter of the room.
+func (rm *RoomManager) MarkRead(roomName string) {
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+	delete(rm.unread, roomName)
+}
+
+// Flagged reports whether messages of the peer were recently throttled in the room.
+func (rm *RoomManager) Flagged(roomName string, p peer.ID) bool {
+	rm.mu.RLock()
+	limits, ok := rm.limits[roomName]
+	rm.mu.RUnlock()
+	if !ok {
+		return false
+	}
+	return (limits.topic != nil && limits.topic.Flagged(p)) ||
+		(limits.delivery != nil && limits.delivery.Flagged(p)) ||
+		limits.presence.Flagged(p)
+}
+
+// Throttled returns the number of messages throttled in the room.
+func (rm *RoomManager) Throttled(roomName string) uint64 {
+	rm.mu.RLock()
+	limits, ok := rm.limits[roomName]
+	rm.mu.RUnlock()
+	if !ok {
+		return 0
+	}
+	var n uint64
+	if limits.topic != nil {
+		n += limits.topic.Throttled()
+	}
+	if limits.delivery != nil {
+		n += limits.delivery.Throttled()
+	}
+	return n + limits.presence.Throttled()
+}
+
+// History returns the message store shared by the rooms, which may be nil.
+func (rm *RoomManager) History() *history.Store {
+	return rm.store
+}
+
+// Messages returns the channel of messages received in all the joined rooms.
+func (rm *RoomManager) Messages() <-chan *RoomMessage {
+	return rm.inboundChan
+}
+
+// Subscribe returns a channel receiving the messages of all the joined rooms,
+// alongside the Messages channel, until cancel is called. Messages are dropped
+// for subscribers that fall behind.
+func (rm *RoomManager) Subscribe() (ch <-chan *RoomMessage, cancel func()) {
+	sub := make(chan *RoomMessage, ChatRoomBufSize)
+	rm.subsMu.Lock()
+	rm.subs[sub] = struct{}{}
+	rm.subsMu.Unlock()
+	return sub, func() {
+		rm.subsMu.Lock()
+		delete(rm.subs, sub)
+		rm.subsMu.Unlock()
+	}
+}
+
+// Synced returns the channel of missed messages fetched after joining a room.
+func (rm *RoomManager) Synced() <-chan *SyncResult {
+	return rm.syncedChan
+}
+
+// newLimiters creates the rate limiters of the room. The chat messages are
+// not limited if rate limiting is disabled or its rate is zero, while the
+// heartbeats always are, as every one of them is verified and may be saved.
+// It must be called with the lock held.
+func (rm *RoomManager) newLimiters(roomName string) *roomLimiters {
+	limits := &roomLimiters{presence: ratelimit.NewLimiter(presenceRateLimit)}
+	cfg, ok := rm.roomLimits[strings.ToLower(roomName)]
+	if !ok {
+		cfg = rm.rateLimit
+	}
+	if cfg == nil || cfg.Rate <= 0 {
+		return limits
+	}
+	limits.topic = ratelimit.NewLimiter(cfg)
+	limits.delivery = ratelimit.NewLimiter(cfg)
+	return limits
+}
+
+// syncHistory waits for the room to have topic peers and asks them for the
+// messages we missed.
+func (rm *RoomManager) syncHistory(cr *ChatRoom, syncer *historysync.Service) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	timeout := time.After(syncWaitTimeout)
+
+	peers := cr.ListPeers()
+	for len(peers) == 0 {
+		select {
+		case <-ticker.C:
+			peers = cr.ListPeers()
+		case <-timeout:
+			logger.Debugf("no peers to sync history of room %s with", cr.roomName)
+			return
+		case <-cr.ctx.Done():
+			return
+		}
+	}
+	if len(peers) > maxSyncPeers {
+		peers = peers[:maxSyncPeers]
+	}
+
+	maxSkew := rm.maxClockSkew()
+	records, err := syncer.Sync(cr.ctx, cr.historyName, peers, func(r *history.Record) (*history.Record, error) {
+		return cr.verifyRecord(r, maxSkew)
+	})
+	if err != nil {
+		logger.Warnf("failed to sync history of room %s: %v", cr.roomName, err)
+	}
+	if len(records) == 0 {
+		return
+	}
+	select {
+	case rm.syncedChan <- &SyncResult{Room: cr.roomName, Records: records}:
+	case <-cr.ctx.Done():
+	}
+}
+
+// maxClockSkew returns how far in the future the timestamp of a message may
+// be, as enforced by the validator on the messages of the room topics
+func (rm *RoomManager) maxClockSkew() time.Duration {
+	rm.mu.RLock()
+	defer rm.mu.RUnlock()
+	if rm.validator != nil {
+		return rm.validator.MaxClockSkew()
+	}
+	return validator.NewValidatorConfig().MaxClockSkew
+}
+
+// authorizeHistory tells whether the peer may fetch the history saved under
+// the given name, see ChatRoom.HistoryName, over the history sync protocol:
+// the history of restricted rooms is only served to their members, and the
+// one of encrypted rooms, stored in clear, is never served.
+func (rm *RoomManager) authorizeHistory(historyName string, p peer.ID) error {
+	var cr *ChatRoom
+	rm.mu.RLock()
+	for _, room := range rm.rooms {
+		if room.historyName == historyName {
+			cr = room
+		}
+	}
+	rm.mu.RUnlock()
+	if cr == nil || !cr.IsMember(p) {
+		return errors.New("not a member of the room")
+	}
+	if cr.Encrypted() {
+		return errors.New("history of encrypted rooms is not shared")
+	}
+	return nil
+}
+
+// authorizeFile tells whether the peer may download the file with the given
+// hash over the file transfer protocol: the files are only served to the
+// peers subscribed to the topic of the rooms they were offered in, which is
+// derived from the passphrase of encrypted rooms, and that are members of the
+// restricted ones.
+func (rm *RoomManager) authorizeFile(hash string, p peer.ID) error {
+	rm.mu.RLock()
+	rooms := make([]*ChatRoom, 0, len(rm.rooms))
+	for _, cr := range rm.rooms {
+		rooms = append(rooms, cr)
+	}
+	rm.mu.RUnlock()
+	for _, cr := range rooms {
+		if cr.offered(hash) && cr.IsMember(p) && slices.Contains(cr.ListPeers(), p) {
+			return nil
+		}
+	}
+	return errors.New("file not shared with this peer")
+}
+
+// forward pushes the messages received in the room to the manager's inbound
+// channel until the room is left.
+func (rm *RoomManager) forward(cr *ChatRoom) {
+	for {
+		select {
+		case cm := <-cr.inboundChan:
+			m := &RoomMessage{Room: cr.roomName, ChatMessage: cm}
+			rm.broadcast(m)
+			select {
+			case rm.inboundChan <- m:
+			case <-cr.ctx.Done():
+				return
+			}
+		case <-cr.ctx.Done():
+			return
+		}
+	}
+}
+
+// broadcast sends the message to the subscribers that have room for it
+func (rm *RoomManager) broadcast(m *RoomMessage) {
+	rm.subsMu.Lock()
+	defer rm.subsMu.Unlock()
+	for sub := range rm.subs {
+		select {
+		case sub <- m:
+		default:
+			logger.Debugf("subscriber falling behind, dropping message %s", m.ID)
+		}
+	}
+}
@@ -0,0 +1,144 @@
+package app
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/alejoacosta74/libp2p-chat-app/p2p/ratelimit"
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	"github.com/libp2p/go-libp2p/core/peer"
+	mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
+)
+
+func TestNewLimiters(t *testing.T) {
+	tests := []struct {
+		name      string
+		rateLimit *ratelimit.Config
+		rooms     map[string]*ratelimit.Config
+		room      string
+		wantChat  bool
+	}{
+		{name: "disabled", room: "lobby"},
+		{name: "zero rate", rateLimit: &ratelimit.Config{Rate: 0, Burst: 10}, room: "lobby"},
+		{name: "enabled", rateLimit: ratelimit.NewRateLimitConfig(), room: "lobby", wantChat: true},
+		{name: "disabled in the room", rateLimit: ratelimit.NewRateLimitConfig(), rooms: map[string]*ratelimit.Config{"lobby": {}}, room: "Lobby"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rm := &RoomManager{rateLimit: tt.rateLimit, roomLimits: tt.rooms}
+			limits := rm.newLimiters(tt.room)
+			if got := limits.topic != nil && limits.delivery != nil; got != tt.wantChat {
+				t.Errorf("got chat messages limited %v, want %v", got, tt.wantChat)
+			}
+
+			// the heartbeats are always limited
+			p := peer.ID("mallory")
+			allowed := 0
+			for i := 0; i < 50; i++ {
+				if limits.presence.Allow(p) {
+					allowed++
+				}
+			}
+			if allowed != presenceRateLimit.Burst {
+				t.Errorf("got %d heartbeats allowed at once, want %d", allowed, presenceRateLimit.Burst)
+			}
+			rm.limits = map[string]*roomLimiters{tt.room: limits}
+			if !rm.Flagged(tt.room, p) || rm.Throttled(tt.room) == 0 {
+				t.Error("the peer flooding heartbeats is not flagged")
+			}
+		})
+	}
+}
+
+func TestAuthorizeFile(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	mn, err := mocknet.FullMeshConnected(4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mn.Close()
+	h := mn.Hosts()[0]
+	key := h.Peerstore().PrivKey(h.ID())
+	// the member and the outsider subscribe to the topics of the rooms, the
+	// stranger to none of them
+	peers := mn.Hosts()[1:]
+	member, outsider, stranger := peers[0].ID(), peers[1].ID(), peers[2].ID()
+	ps, err := pubsub.NewGossipSub(ctx, h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rm := NewRoomManager(ctx, ps, h.ID(), "owner", nil)
+	rm.privKey = key
+
+	open, err := rm.Join("lobby")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rm.Leave("lobby")
+	restricted, err := rm.Create("private", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rm.Leave("private")
+	if _, err := rm.addMember(restricted, member, key); err != nil {
+		t.Fatal(err)
+	}
+	encrypted, err := rm.JoinEncrypted("secret", "passphrase")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rm.Leave("secret")
+
+	rooms := []*ChatRoom{open, restricted, encrypted}
+	for _, p := range peers[:2] {
+		peerPS, err := pubsub.NewGossipSub(ctx, p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, cr := range rooms {
+			topic, err := peerPS.Join(cr.topic.String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := topic.Subscribe(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	for _, cr := range rooms {
+		for deadline := time.Now().Add(5 * time.Second); len(cr.ListPeers()) < 2; time.Sleep(10 * time.Millisecond) {
+			if time.Now().After(deadline) {
+				t.Fatalf("got peers %v subscribed to room %s", cr.ListPeers(), cr.Name())
+			}
+		}
+	}
+
+	for cr, hash := range map[*ChatRoom]string{open: "open", restricted: "restricted", encrypted: "encrypted"} {
+		cr.shared[hash] = true
+	}
+	tests := []struct {
+		hash    string
+		p       peer.ID
+		wantErr bool
+	}{
+		{hash: "open", p: member},
+		{hash: "open", p: outsider},
+		// the peers must be subscribed to the room, even an open one
+		{hash: "open", p: stranger, wantErr: true},
+		{hash: "restricted", p: member},
+		{hash: "restricted", p: outsider, wantErr: true},
+		{hash: "restricted", p: stranger, wantErr: true},
+		// the topic of encrypted rooms is derived from their passphrase
+		{hash: "encrypted", p: outsider},
+		{hash: "encrypted", p: stranger, wantErr: true},
+		{hash: "unknown", p: member, wantErr: true},
+	}
+	for _, tt := range tests {
+		if err := rm.authorizeFile(tt.hash, tt.p); (err != nil) != tt.wantErr {
+			t.Errorf("authorizeFile(%s, %s): got error %v, want error %v", tt.hash, tt.p, err, tt.wantErr)
+		}
+	}
+}
@@ -2,49 +2,100 @@ package app
 
 import (
 	"fmt"
-	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
+	"github.com/alejoacosta74/libp2p-chat-app/history"
+	"github.com/alejoacosta74/libp2p-chat-app/p2p/dm"
+	"github.com/alejoacosta74/libp2p-chat-app/p2p/filetransfer"
+	"github.com/alejoacosta74/libp2p-chat-app/p2p/nickname"
+	"github.com/alejoacosta74/libp2p-chat-app/p2p/node"
 	"github.com/gdamore/tcell/v2"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
 	"github.com/rivo/tview"
+	"github.com/spf13/viper"
 )
 
-// ChatUI is a Text User Interface (TUI) for a ChatRoom.
+// searchLimit is the maximum number of results shown by /search
+const searchLimit = 20
+
+// lockMark flags the end-to-end encrypted rooms
+const lockMark = "🔒"
+
+// fileMark flags the messages sharing a file
+const fileMark = "📎"
+
+// progressStep is the fraction of a download between two progress reports in the log window
+const progressStep = 0.1
+
+// sharedFile is a file offered by a peer in one of the rooms
+type sharedFile struct {
+	from  peer.ID
+	offer *filetransfer.Offer
+}
+
+// ChatUI is a Text User Interface (TUI) for a set of ChatRooms.
 // The Run method will draw the UI to the terminal in "fullscreen"
 // mode. You can quit with Ctrl-C, or by typing "/quit" into the
-// chat prompt.
+// chat prompt. Ctrl-N and Ctrl-P switch between the joined rooms.
 type ChatUI struct {
-	cr        *ChatRoom
+	node      *node.Node
+	rm        *RoomManager
+	dms       *dm.Service
+	files     *filetransfer.Service
+	commands  *CommandRegistry
 	app       *tview.Application
+	tabBar    *tview.TextView
+	pages     *tview.Pages
+	dmView    *tview.TextView
 	peersList *tview.TextView
 	logView   *tview.TextView
-	msgW      io.Writer
+	statusBar *tview.TextView
+	input     *tview.InputField
 	inputCh   chan string
 	doneCh    chan struct{}
+
+	mu         sync.Mutex
+	showScores bool                       // show the peer scores in the Peers panel
+	active     string                     // name of the room shown in the message window
+	msgViews   map[string]*tview.TextView // message window of each joined room
+	replayed   map[string]int             // length of the text of each message window after its history replay
+	nicks      map[string]peer.ID         // last peer seen using each nickname
+	offers     map[string]*sharedFile     // files shared in the rooms, keyed by short ID
+	fetching   map[string]bool            // short IDs of the files being downloaded
 }
 
 // NewChatUI returns a new ChatUI struct that controls the text UI.
 // It won't actually do anything until you call Run().
-func NewChatUI(cr *ChatRoom) *ChatUI {
+func NewChatUI(n *node.Node, rm *RoomManager, dms *dm.Service, files *filetransfer.Service) *ChatUI {
 	app := tview.NewApplication()
 
-	// make a text view to contain our chat messages
-	msgBox := tview.NewTextView()
-	msgBox.SetDynamicColors(true)
-	msgBox.SetBorder(true)
-	msgBox.SetTitle(fmt.Sprintf("Room: %s", cr.roomName))
+	// make a tab bar listing the joined rooms, and a set of pages holding
+	// the message window of each room
+	tabBar := tview.NewTextView()
+	tabBar.SetDynamicColors(true)
+	tabBar.SetRegions(true)
+	tabBar.SetWrap(false)
+	tabBar.SetChangedFunc(func() { app.Draw() })
 
-	// text views are io.Writers, but they don't automatically refresh.
-	// this sets a change handler to force the app to redraw when we get
-	// new messages to display.
-	msgBox.SetChangedFunc(func() {
-		app.Draw()
-	})
+	pages := tview.NewPages()
+
+	// make a text view to contain the direct message conversations
+	dmView := tview.NewTextView()
+	dmView.SetDynamicColors(true)
+	dmView.SetBorder(true)
+	dmView.SetTitle("Direct Messages")
+	dmView.SetChangedFunc(func() { app.Draw() })
 
 	// an input field for typing messages into
 	inputCh := make(chan string, 32)
 	input := tview.NewInputField().
-		SetLabel(cr.nick + " > ").
+		SetLabel(rm.Nick() + " > ").
 		SetFieldWidth(0).
 		SetFieldBackgroundColor(tcell.ColorBlack)
 
@@ -60,12 +111,6 @@ func NewChatUI(cr *ChatRoom) *ChatUI {
 			return
 		}
 
-		// bail if requested
-		if line == "/quit" {
-			app.Stop()
-			return
-		}
-
 		// send the line onto the input chan and reset the field text
 		// The inputCh is used to send messages to the chat room via the handleEvents() function
 		inputCh <- line
@@ -74,6 +119,7 @@ func NewChatUI(cr *ChatRoom) *ChatUI {
 
 	// make a text view to hold the list of peers in the room, updated by ui.refreshPeers()
 	peersList := tview.NewTextView()
+	peersList.SetDynamicColors(true)
 	peersList.SetBorder(true)
 	peersList.SetTitle("Peers")
 	peersList.SetChangedFunc(func() { app.Draw() })
@@ -107,27 +153,101 @@ func NewChatUI(cr *ChatRoom) *ChatUI {
 		return action, event
 	})
 
+	// make a status bar showing the reachability of the node, updated by ui.refreshStatus()
+	statusBar := tview.NewTextView()
+	statusBar.SetDynamicColors(true)
+	statusBar.SetWrap(false)
+
+	roomsPanel := tview.NewFlex().
+		SetDirection(tview.FlexRow).
+		AddItem(tabBar, 1, 0, false).
+		AddItem(pages, 0, 3, false).
+		AddItem(dmView, 0, 1, false)
+
 	topPanel := tview.NewFlex().
-		AddItem(msgBox, 0, 3, false).    // Messages take 3/4 of width
-		AddItem(peersList, 25, 1, false) // Peers list takes 25 columns
+		AddItem(roomsPanel, 0, 3, false). // Messages take 3/4 of width
+		AddItem(peersList, 25, 1, false)  // Peers list takes 25 columns
 
 	flex := tview.NewFlex().
 		SetDirection(tview.FlexRow).
 		AddItem(topPanel, 0, 2, false).
 		AddItem(logView, 20, 4, false).
+		AddItem(statusBar, 1, 0, false).
 		AddItem(input, 1, 1, true)
 
 	app.SetRoot(flex, true)
 
-	return &ChatUI{
-		cr:        cr,
+	ui := &ChatUI{
+		node:      n,
+		rm:        rm,
+		dms:       dms,
+		files:     files,
+		commands:  defaultCommands(),
 		app:       app,
+		tabBar:    tabBar,
+		pages:     pages,
+		dmView:    dmView,
 		peersList: peersList,
 		logView:   logView,
-		msgW:      msgBox,
+		statusBar: statusBar,
+		input:     input,
 		inputCh:   inputCh,
 		doneCh:    make(chan struct{}, 1),
+		msgViews:  make(map[string]*tview.TextView),
+		replayed:  make(map[string]int),
+		nicks:     make(map[string]peer.ID),
+		offers:    make(map[string]*sharedFile),
+		fetching:  make(map[string]bool),
+	}
+
+	// complete the commands and their first argument with Tab
+	input.SetInputCapture(func(event *tcell.EventKey) *tcell.EventKey {
+		if event.Key() != tcell.KeyTab {
+			return event
+		}
+		completions := ui.commands.Complete(ui, input.GetText())
+		switch len(completions) {
+		case 0:
+		case 1:
+			input.SetText(completions[0])
+		default:
+			input.SetText(commonPrefix(completions))
+			ui.DisplayLog("%s", strings.Join(completions, "  "))
+		}
+		return nil
+	})
+
+	// tell the peers of the active room when we are typing a message
+	input.SetChangedFunc(func(text string) {
+		if cr, ok := ui.activeRoom(); ok {
+			cr.SetTyping(text != "" && !strings.HasPrefix(text, "/"))
+		}
+	})
+
+	// switch rooms with Ctrl-N / Ctrl-P
+	app.SetInputCapture(func(event *tcell.EventKey) *tcell.EventKey {
+		switch event.Key() {
+		case tcell.KeyCtrlN:
+			ui.cycleRoom(1)
+			return nil
+		case tcell.KeyCtrlP:
+			ui.cycleRoom(-1)
+			return nil
+		}
+		return event
+	})
+
+	for _, roomName := range rm.Rooms() {
+		ui.addRoom(roomName)
+		ui.replayHistory(roomName, viper.GetInt("history-size"))
 	}
+	if rooms := rm.Rooms(); len(rooms) > 0 {
+		ui.active = rooms[0]
+		pages.SwitchToPage(ui.active)
+	}
+	ui.refreshTabs()
+
+	return ui
 }
 
 // Run starts the chat event loop in the background, then starts
@@ -144,33 +264,597 @@ func (ui *ChatUI) end() {
 	ui.doneCh <- struct{}{}
 }
 
-// refreshPeers pulls the list of peers currently in the chat room and
-// displays the last 8 chars of their peer id in the Peers panel in the ui.
+// addRoom creates the message window of a newly joined room.
+func (ui *ChatUI) addRoom(roomName string) {
+	ui.mu.Lock()
+	defer ui.mu.Unlock()
+	if _, ok := ui.msgViews[roomName]; ok {
+		return
+	}
+
+	// make a text view to contain our chat messages
+	msgBox := tview.NewTextView()
+	msgBox.SetDynamicColors(true)
+	msgBox.SetBorder(true)
+	title := fmt.Sprintf("Room: %s", roomName)
+	if cr, ok := ui.rm.Room(roomName); ok && cr.Encrypted() {
+		title = lockMark + " " + title
+	}
+	msgBox.SetTitle(title)
+
+	// text views are io.Writers, but they don't automatically refresh.
+	// this sets a change handler to force the app to redraw when we get
+	// new messages to display.
+	msgBox.SetChangedFunc(func() {
+		ui.app.Draw()
+	})
+
+	ui.msgViews[roomName] = msgBox
+	ui.pages.AddPage(roomName, msgBox, true, false)
+}
+
+// replayHistory writes the last n stored messages of the room to its message window.
+func (ui *ChatUI) replayHistory(roomName string, n int) {
+	store := ui.rm.History()
+	cr, ok := ui.rm.Room(roomName)
+	if store == nil || !ok || n <= 0 {
+		return
+	}
+	records, err := store.Last(cr.HistoryName(), n)
+	if err != nil {
+		ui.DisplayLog("[red]Failed to load history of room %s: %s[-]", roomName, err.Error())
+		return
+	}
+	ui.displayRecords(roomName, records)
+	ui.mu.Lock()
+	if v, ok := ui.msgViews[roomName]; ok {
+		ui.replayed[roomName] = len(v.GetText(false))
+	}
+	ui.mu.Unlock()
+}
+
+// displayRecords writes messages loaded from the history store to the room's
+// message window, prefixed with their timestamp.
+func (ui *ChatUI) displayRecords(roomName string, records []*history.Record) {
+	fmt.Fprint(ui.msgView(roomName), ui.formatRecords(records))
+}
+
+// formatRecords returns the lines showing messages loaded from the history store
+func (ui *ChatUI) formatRecords(records []*history.Record) string {
+	var sb strings.Builder
+	for _, r := range records {
+		color := "green"
+		if r.SenderID == ui.rm.self.String() {
+			color = "yellow"
+		}
+		prompt := withColor(color, fmt.Sprintf("<%s>:", ui.peerName(r.SenderID, r.SenderNick)))
+		fmt.Fprintf(&sb, "[gray]%s[-] %s %s\n", r.Time().Format("01-02 15:04"), prompt, r.Message)
+	}
+	return sb.String()
+}
+
+// insertMissed writes the messages fetched from other peers after joining the
+// room right after its history replay. They are older than the messages
+// received since, while the lines written after the replay, such as the
+// notices, are not in the store, so the window can't be redrawn from it.
+func (ui *ChatUI) insertMissed(roomName string, records []*history.Record) {
+	missed := ui.formatRecords(records)
+	ui.mu.Lock()
+	defer ui.mu.Unlock()
+	v, ok := ui.msgViews[roomName]
+	if !ok {
+		return
+	}
+	text := v.GetText(false)
+	at := min(ui.replayed[roomName], len(text))
+	v.SetText(text[:at] + missed + text[at:])
+	ui.replayed[roomName] = at + len(missed)
+}
+
+// clearRoom empties the message window of the room
+func (ui *ChatUI) clearRoom(roomName string) {
+	ui.mu.Lock()
+	defer ui.mu.Unlock()
+	if v, ok := ui.msgViews[roomName]; ok {
+		v.Clear()
+		ui.replayed[roomName] = 0
+	}
+}
+
+// removeRoom drops the message window of a room that was left.
+func (ui *ChatUI) removeRoom(roomName string) {
+	ui.mu.Lock()
+	defer ui.mu.Unlock()
+	delete(ui.msgViews, roomName)
+	delete(ui.replayed, roomName)
+	ui.pages.RemovePage(roomName)
+}
+
+// syncRooms adds the message windows of the rooms joined outside of the UI,
+// and removes the ones of the rooms left outside of it.
+func (ui *ChatUI) syncRooms() {
+	rooms := ui.rm.Rooms()
+	joined := make(map[string]bool, len(rooms))
+	var added, removed []string
+	ui.mu.Lock()
+	for _, name := range rooms {
+		joined[name] = true
+		if _, ok := ui.msgViews[name]; !ok {
+			added = append(added, name)
+		}
+	}
+	for name := range ui.msgViews {
+		if !joined[name] {
+			removed = append(removed, name)
+		}
+	}
+	ui.mu.Unlock()
+	if len(added) == 0 && len(removed) == 0 {
+		return
+	}
+
+	for _, name := range added {
+		ui.addRoom(name)
+		ui.replayHistory(name, viper.GetInt("history-size"))
+	}
+	for _, name := range removed {
+		ui.removeRoom(name)
+	}
+	if _, ok := ui.activeRoom(); !ok {
+		ui.cycleRoom(0)
+	}
+	ui.refreshTabs()
+}
+
+// activeRoom returns the room shown in the message window.
+func (ui *ChatUI) activeRoom() (*ChatRoom, bool) {
+	ui.mu.Lock()
+	active := ui.active
+	ui.mu.Unlock()
+	return ui.rm.Room(active)
+}
+
+// msgView returns the message window of the room, falling back to the active one.
+func (ui *ChatUI) msgView(roomName string) *tview.TextView {
+	ui.mu.Lock()
+	defer ui.mu.Unlock()
+	if v, ok := ui.msgViews[roomName]; ok {
+		return v
+	}
+	return ui.msgViews[ui.active]
+}
+
+// switchRoom shows the message window of the room and resets its unread counter.
+func (ui *ChatUI) switchRoom(roomName string) {
+	ui.mu.Lock()
+	if _, ok := ui.msgViews[roomName]; !ok {
+		ui.mu.Unlock()
+		return
+	}
+	ui.active = roomName
+	ui.mu.Unlock()
+
+	ui.rm.MarkRead(roomName)
+	ui.app.QueueUpdateDraw(func() {
+		ui.pages.SwitchToPage(roomName)
+	})
+	ui.refreshTabs()
+	ui.refreshPeers()
+}
+
+// cycleRoom switches to the next (or previous, for negative steps) joined room.
+func (ui *ChatUI) cycleRoom(step int) {
+	rooms := ui.rm.Rooms()
+	if len(rooms) == 0 {
+		return
+	}
+	ui.mu.Lock()
+	current := 0
+	for i, name := range rooms {
+		if name == ui.active {
+			current = i
+			break
+		}
+	}
+	ui.mu.Unlock()
+	next := (current + step + len(rooms)) % len(rooms)
+	ui.switchRoom(rooms[next])
+}
+
+// refreshTabs redraws the tab bar with the joined rooms and their unread counters.
+func (ui *ChatUI) refreshTabs() {
+	ui.mu.Lock()
+	active := ui.active
+	ui.mu.Unlock()
+
+	var sb strings.Builder
+	highlight := ""
+	for i, name := range ui.rm.Rooms() {
+		label := tview.Escape(name)
+		if cr, ok := ui.rm.Room(name); ok && cr.Encrypted() {
+			label = lockMark + label
+		}
+		if n := ui.rm.Unread(name); n > 0 {
+			label = fmt.Sprintf("%s [yellow](%d)[-]", label, n)
+		}
+		fmt.Fprintf(&sb, `["%d"] %s [""] `, i, label)
+		if name == active {
+			highlight = strconv.Itoa(i)
+		}
+	}
+
+	ui.app.QueueUpdateDraw(func() {
+		ui.tabBar.SetText(sb.String())
+		ui.tabBar.Highlight(highlight)
+	})
+}
+
+// refreshPeers pulls the list of peers currently in the active chat room and
+// displays their peer ids in the Peers panel in the ui. When /scores is on,
+// the last 8 chars of the peer ids are shown along with the peer scores.
+// Peers whose messages were recently throttled are flagged with a red mark.
+// In restricted rooms, the members are listed apart from the peers that only
+// relay the messages of the room.
 func (ui *ChatUI) refreshPeers() {
-	peers := ui.cr.ListPeers()
+	cr, ok := ui.activeRoom()
+	if !ok {
+		return
+	}
+	peers := cr.ListPeers()
+	ui.mu.Lock()
+	showScores := ui.showScores
+	ui.mu.Unlock()
+	var scores map[peer.ID]float64
+	if showScores {
+		scores = ui.node.PeerScores()
+	}
+	states := make(map[peer.ID]*Presence)
+	for _, state := range cr.Presence() {
+		states[state.ID] = state
+	}
+	writePeers := func(peers []peer.ID) {
+		for _, p := range peers {
+			mark := ui.throttleMark(cr, p)
+			state, ok := states[p]
+			if ok {
+				mark += statusMark(state.Status) + " "
+			}
+			switch {
+			case showScores:
+				fmt.Fprintf(ui.peersList, "%s%s %8.2f\n", mark, shortID(p), scores[p])
+			case ok || ui.knownPeer(p):
+				fmt.Fprintln(ui.peersList, mark+ui.peerName(p.String(), nickOf(state)))
+			default:
+				fmt.Fprintln(ui.peersList, mark+p.String())
+			}
+		}
+	}
 
 	// clear is thread-safe
 	ui.peersList.Clear()
 
+	if cr.ACL() == nil {
+		writePeers(peers)
+		ui.app.Draw()
+		return
+	}
+	var members, relayers []peer.ID
 	for _, p := range peers {
-		fmt.Fprintln(ui.peersList, p.String())
+		if cr.IsMember(p) {
+			members = append(members, p)
+		} else {
+			relayers = append(relayers, p)
+		}
 	}
+	fmt.Fprintf(ui.peersList, "[green]Members (%d)[-]\n", len(members))
+	writePeers(members)
+	fmt.Fprintf(ui.peersList, "[gray]Relayers (%d)[-]\n", len(relayers))
+	writePeers(relayers)
 
 	ui.app.Draw()
 }
 
-// displayChatMessage writes a ChatMessage from the room to the message window,
+// refreshStatus shows the reachability of the node, as detected by AutoNAT,
+// the number of connected peers, our status and the peers typing in the
+// active room in the status bar
+func (ui *ChatUI) refreshStatus() {
+	var reachability string
+	switch r := ui.node.Reachability(); r {
+	case network.ReachabilityPublic:
+		reachability = withColor("green", r.String())
+	case network.ReachabilityPrivate:
+		reachability = withColor("yellow", r.String())
+	default:
+		reachability = withColor("gray", r.String())
+	}
+	status := fmt.Sprintf(" Reachability: %s | Peers: %d", reachability, len(ui.node.Network().Peers()))
+	if ui.node.Relayed() {
+		status += " | " + withColor("yellow", "relayed")
+	}
+	status += " | " + statusMark(ui.rm.Status()) + " " + string(ui.rm.Status())
+	if cr, ok := ui.activeRoom(); ok {
+		if typing := ui.typingText(cr.Presence()); typing != "" {
+			status += " | " + withColor("gray", typing)
+		}
+	}
+
+	ui.app.QueueUpdateDraw(func() {
+		ui.statusBar.SetText(status)
+	})
+}
+
+// statusMark returns the mark shown next to the peers with the given status
+func statusMark(status Status) string {
+	switch status {
+	case StatusAway:
+		return "[yellow]◐[-]"
+	case StatusBusy:
+		return "[red]⊘[-]"
+	default:
+		return "[green]●[-]"
+	}
+}
+
+// typingText returns the "X is typing…" notice of the room, or "" if nobody is typing
+func (ui *ChatUI) typingText(peers []*Presence) string {
+	var nicks []string
+	for _, state := range peers {
+		if state.Typing {
+			nicks = append(nicks, ui.peerName(state.ID.String(), state.Nick))
+		}
+	}
+	switch len(nicks) {
+	case 0:
+		return ""
+	case 1:
+		return nicks[0] + " is typing…"
+	case 2, 3:
+		return strings.Join(nicks, ", ") + " are typing…"
+	default:
+		return "several people are typing…"
+	}
+}
+
+// throttleMark returns the mark shown in the Peers panel next to the peers
+// exceeding their rate limit in the room
+func (ui *ChatUI) throttleMark(cr *ChatRoom, p peer.ID) string {
+	if ui.rm.Flagged(cr.Name(), p) {
+		return "[red]![-]"
+	}
+	return ""
+}
+
+// displayChatMessage writes a ChatMessage from the room to the room's message window,
 // with the sender's nick highlighted in green.
-func (ui *ChatUI) displayChatMessage(cm *ChatMessage) {
-	prompt := withColor("green", fmt.Sprintf("<%s>:", cm.SenderNick))
-	fmt.Fprintf(ui.msgW, "%s %s\n", prompt, cm.Message)
+func (ui *ChatUI) displayChatMessage(roomName string, cm *ChatMessage) {
+	if cm.Error != "" {
+		sender := cm.SenderID
+		if id, err := peer.Decode(cm.SenderID); err == nil {
+			sender = shortID(id)
+		}
+		fmt.Fprintf(ui.msgView(roomName), "[red]%s undecryptable message from %s: %s[-]\n", lockMark, sender, cm.Error)
+		return
+	}
+	prompt := withColor("green", fmt.Sprintf("<%s>:", ui.peerName(cm.SenderID, cm.SenderNick)))
+	if cm.Notice {
+		// the notices quote the nicknames claimed by the peers
+		fmt.Fprintf(ui.msgView(roomName), "[gray]* %s[-]\n", tview.Escape(cm.Message))
+		return
+	}
+	if cm.File != nil {
+		// the text quotes the file name chosen by the peer
+		fmt.Fprintf(ui.msgView(roomName), "%s %s %s, download it with /get %s\n", prompt, fileMark, tview.Escape(cm.Message), cm.File.ShortID())
+		return
+	}
+	fmt.Fprintf(ui.msgView(roomName), "%s %s\n", prompt, cm.Message)
 }
 
-// displaySelfMessage writes a message from ourselves to the message window,
+// displaySelfMessage writes a message from ourselves to the room's message window,
 // with our nick highlighted in yellow.
-func (ui *ChatUI) displaySelfMessage(msg string) {
-	prompt := withColor("yellow", fmt.Sprintf("<%s>:", ui.cr.nick))
-	fmt.Fprintf(ui.msgW, "%s %s\n", prompt, msg)
+func (ui *ChatUI) displaySelfMessage(roomName string, msg string) {
+	prompt := withColor("yellow", fmt.Sprintf("<%s>:", ui.rm.Nick()))
+	fmt.Fprintf(ui.msgView(roomName), "%s %s\n", prompt, msg)
+}
+
+// displayDirectMessage writes a direct message to the DM window. Incoming messages
+// show the sender's nick in green, outgoing ones the recipient in yellow.
+func (ui *ChatUI) displayDirectMessage(msg *dm.Message, to string) {
+	if to != "" {
+		prompt := withColor("yellow", fmt.Sprintf("<%s -> %s>:", ui.rm.Nick(), to))
+		fmt.Fprintf(ui.dmView, "%s %s\n", prompt, msg.Message)
+		return
+	}
+	prompt := withColor("green", fmt.Sprintf("<%s>:", ui.peerName(msg.SenderID, msg.SenderNick)))
+	fmt.Fprintf(ui.dmView, "%s %s\n", prompt, msg.Message)
+}
+
+// peerName returns the name a peer is shown with, as announced in the address
+// book, or nick if the peer announced none. Nicknames used by several peers
+// get a suffix of the peer ID. The signed announcement wins over the nickname
+// claimed in a message, which is only appended when they differ, e.g. for the
+// posts of the web sessions of a node: alice/bob. The name is escaped, as it
+// is written to views with dynamic colors.
+func (ui *ChatUI) peerName(senderID, nick string) string {
+	book := ui.rm.AddressBook()
+	id, err := peer.Decode(senderID)
+	if book == nil || err != nil {
+		return tview.Escape(nick)
+	}
+	name := book.Name(id, nick)
+	if announced, ok := book.Nick(id); ok && nick != "" && !strings.EqualFold(nick, announced) {
+		name += "/" + nick
+	}
+	return tview.Escape(name)
+}
+
+// knownPeer reports whether the peer announced a nickname
+func (ui *ChatUI) knownPeer(p peer.ID) bool {
+	if book := ui.rm.AddressBook(); book != nil {
+		_, ok := book.Nick(p)
+		return ok
+	}
+	return false
+}
+
+// nickOf returns the nickname of a presence heartbeat, if any
+func nickOf(state *Presence) string {
+	if state == nil {
+		return ""
+	}
+	return state.Nick
+}
+
+// rememberNick records the peer behind a nickname so it can be used in /msg
+func (ui *ChatUI) rememberNick(nick, senderID string) {
+	id, err := peer.Decode(senderID)
+	if err != nil || nickname.Validate(nick) != nil {
+		return
+	}
+	ui.mu.Lock()
+	defer ui.mu.Unlock()
+	ui.nicks[nick] = id
+}
+
+// resolvePeer returns the peer ID for a nickname or a peer ID string
+func (ui *ChatUI) resolvePeer(nickOrID string) (peer.ID, error) {
+	if book := ui.rm.AddressBook(); book != nil {
+		if id, ok := book.Lookup(nickOrID); ok {
+			return id, nil
+		}
+	}
+	ui.mu.Lock()
+	id, ok := ui.nicks[nickOrID]
+	ui.mu.Unlock()
+	if ok {
+		return id, nil
+	}
+	id, err := peer.Decode(nickOrID)
+	if err != nil {
+		return "", fmt.Errorf("unknown nickname or peer ID %q", nickOrID)
+	}
+	return id, nil
+}
+
+// sendDirectMessage delivers a direct message in the background and reports
+// the delivery acknowledgement in the log window.
+func (ui *ChatUI) sendDirectMessage(to string, text string) {
+	p, err := ui.resolvePeer(to)
+	if err != nil {
+		ui.DisplayLog("[red]%s[-]", err.Error())
+		return
+	}
+	go func() {
+		msg, err := ui.dms.Send(ui.rm.ctx, p, text)
+		ui.displayDirectMessage(msg, to)
+		if err != nil {
+			ui.DisplayLog("[red]Direct message to %s not delivered: %s[-]", to, err.Error())
+			return
+		}
+		ui.DisplayLog("[green]Direct message delivered to %s[-]", to)
+	}()
+}
+
+// setNick changes our nickname in the rooms and the direct messages, tells
+// the peers of the rooms, and saves it to the config file for the next runs
+func (ui *ChatUI) setNick(nick string) error {
+	old := ui.rm.Nick()
+	if err := ui.rm.SetNick(nick); err != nil {
+		return fmt.Errorf("failed to change nickname: %w", err)
+	}
+	ui.dms.SetNick(nick)
+	viper.Set("nickname", nick)
+	ui.app.QueueUpdateDraw(func() {
+		ui.input.SetLabel(nick + " > ")
+	})
+	for _, roomName := range ui.rm.Rooms() {
+		fmt.Fprintf(ui.msgView(roomName), "[gray]* %s is now known as %s[-]\n", tview.Escape(old), tview.Escape(nick))
+	}
+	ui.DisplayLog("Nickname changed to %s", nick)
+	if err := saveSetting("nickname", nick); err != nil {
+		return fmt.Errorf("failed to save nickname: %w", err)
+	}
+	return nil
+}
+
+// rememberFile records a file shared in a room so it can be downloaded with /get
+func (ui *ChatUI) rememberFile(cm *ChatMessage) {
+	id, err := peer.Decode(cm.SenderID)
+	if err != nil || cm.File == nil {
+		return
+	}
+	ui.mu.Lock()
+	defer ui.mu.Unlock()
+	ui.offers[cm.File.ShortID()] = &sharedFile{from: id, offer: cm.File}
+}
+
+// sendFile shares a local file and announces it in the room
+func (ui *ChatUI) sendFile(cr *ChatRoom, path string) {
+	if strings.HasPrefix(path, "~/") {
+		if home, err := os.UserHomeDir(); err == nil {
+			path = filepath.Join(home, path[2:])
+		}
+	}
+	go func() {
+		// hashing a large file takes a while, so don't block the event loop
+		offer, err := ui.files.Share(path)
+		if err != nil {
+			ui.DisplayLog("[red]Failed to share %s: %s[-]", path, err.Error())
+			return
+		}
+		cm, err := cr.PublishFile(offer)
+		if err != nil {
+			ui.DisplayLog("[red]Failed to announce %s: %s[-]", tview.Escape(offer.Name), err.Error())
+			return
+		}
+		ui.displaySelfMessage(cr.Name(), fileMark+" "+tview.Escape(cm.Message))
+		ui.DisplayLog("[green]Sharing %s in room %s[-]", tview.Escape(offer.Name), cr.Name())
+	}()
+}
+
+// fetchFile downloads a file shared in a room in the background, reporting
+// its progress in the log window. Fetching a file again after a failure
+// resumes the download where it stopped.
+func (ui *ChatUI) fetchFile(id string) {
+	ui.mu.Lock()
+	f, ok := ui.offers[id]
+	busy := ui.fetching[id]
+	if ok && !busy {
+		ui.fetching[id] = true
+	}
+	ui.mu.Unlock()
+	if !ok {
+		ui.DisplayLog("[red]Unknown file %s[-]", id)
+		return
+	}
+	// the file name is chosen by the peer offering it
+	name := tview.Escape(f.offer.Name)
+	if busy {
+		ui.DisplayLog("[red]%s is already being downloaded[-]", name)
+		return
+	}
+
+	go func() {
+		defer func() {
+			ui.mu.Lock()
+			delete(ui.fetching, id)
+			ui.mu.Unlock()
+		}()
+		ui.DisplayLog("Downloading %s (%s) from %s", name, formatSize(f.offer.Size), shortID(f.from))
+		next := progressStep
+		path, err := ui.files.Fetch(ui.rm.ctx, f.from, f.offer, viper.GetString("downloads"), func(received, total int64) {
+			if done := float64(received) / float64(total); done >= next && received < total {
+				ui.DisplayLog("Downloading %s: %d%% (%s of %s)", name, int(done*100), formatSize(received), formatSize(total))
+				for next <= done {
+					next += progressStep
+				}
+			}
+		})
+		if err != nil {
+			ui.DisplayLog("[red]Failed to download %s: %s, run /get %s to resume[-]", name, tview.Escape(err.Error()), id)
+			return
+		}
+		ui.DisplayLog("[green]Downloaded %s to %s[-]", name, tview.Escape(path))
+	}()
 }
 
 // Add a method to display logs
@@ -181,8 +865,27 @@ func (ui *ChatUI) DisplayLog(format string, args ...interface{}) {
 	ui.logView.ScrollToEnd()
 }
 
-// handleEvents runs an event loop that sends user input to the chat room
-// and displays messages received from the chat room. It also periodically
+// queryHistory runs a query against the history store for the active room and
+// writes the results to the room's message window.
+func (ui *ChatUI) queryHistory(title string, query func(*history.Store, string) ([]*history.Record, error)) {
+	store := ui.rm.History()
+	cr, ok := ui.activeRoom()
+	if store == nil || !ok {
+		ui.DisplayLog("[red]Chat history is not available[-]")
+		return
+	}
+	records, err := query(store, cr.HistoryName())
+	if err != nil {
+		ui.DisplayLog("[red]Failed to query history: %s[-]", err.Error())
+		return
+	}
+	fmt.Fprintf(ui.msgView(cr.Name()), "[gray]--- %s (%d found) ---[-]\n", title, len(records))
+	ui.displayRecords(cr.Name(), records)
+	fmt.Fprintf(ui.msgView(cr.Name()), "[gray]---[-]\n")
+}
+
+// handleEvents runs an event loop that sends user input to the active chat room
+// and displays messages received from all the chat rooms. It also periodically
 // refreshes the list of peers in the UI.
 func (ui *ChatUI) handleEvents() {
 	peerRefreshTicker := time.NewTicker(time.Second)
@@ -191,25 +894,65 @@ func (ui *ChatUI) handleEvents() {
 	for {
 		select {
 		case input := <-ui.inputCh:
+			if strings.HasPrefix(input, "//") {
+				// a double slash publishes a line starting with a slash
+				input = input[1:]
+			} else if strings.HasPrefix(input, "/") {
+				ui.commands.Run(ui, input)
+				continue
+			}
+			cr, ok := ui.activeRoom()
+			if !ok {
+				ui.DisplayLog("[red]Not in any room, use /join <room>[-]")
+				continue
+			}
 			ui.DisplayLog("Publishing message: %s", input)
 			// when the user types in a line, publish it to the chat room and print to the message window
-			err := ui.cr.Publish(input)
+			err := cr.Publish(input)
 			if err != nil {
-				ui.DisplayLog("[red]Failed to publish message: %s", err.Error())
+				ui.DisplayLog("[red]Failed to publish message: %s[-]", err.Error())
+				continue
 			}
-			ui.displaySelfMessage(input)
+			ui.displaySelfMessage(cr.Name(), input)
 			ui.DisplayLog("[green]Message sent successfully[-]")
 
-		case m := <-ui.cr.inboundChan:
-			ui.DisplayLog("Received message from %s", m.SenderNick)
-			// when we receive a message from the chat room, print it to the message window
-			ui.displayChatMessage(m)
+		case m := <-ui.rm.Messages():
+			if !m.Notice {
+				ui.DisplayLog("Received message from %s in %s", ui.peerName(m.SenderID, m.SenderNick), tview.Escape(m.Room))
+			}
+			ui.rememberNick(m.SenderNick, m.SenderID)
+			ui.rememberFile(m.ChatMessage)
+			// when we receive a message from a chat room, print it to the room's message window
+			ui.displayChatMessage(m.Room, m.ChatMessage)
+			if cr, ok := ui.activeRoom(); !ok || cr.Name() != m.Room {
+				ui.rm.MarkUnread(m.Room)
+				ui.refreshTabs()
+			}
+
+		case m := <-ui.dms.Messages():
+			ui.DisplayLog("Received direct message from %s", ui.peerName(m.SenderID, m.SenderNick))
+			ui.rememberNick(m.SenderNick, m.SenderID)
+			ui.displayDirectMessage(m, "")
+
+		case inv := <-ui.rm.Invitations():
+			accept := "/accept " + inv.ACL.Room
+			if inv.Encrypted {
+				accept += " <passphrase>"
+			}
+			ui.DisplayLog("[green]%s (%s) invited you to room %s, accept it with %s[-]", tview.Escape(inv.SenderNick), inv.ACL.Owner, tview.Escape(inv.ACL.Room), tview.Escape(accept))
+
+		case res := <-ui.rm.Synced():
+			ui.DisplayLog("Fetched %d missed messages in %s", len(res.Records), res.Room)
+			ui.insertMissed(res.Room, res.Records)
 
 		case <-peerRefreshTicker.C:
+			// pick up the rooms joined or left through the control API, and
 			// refresh the list of peers in the chat room periodically
+			ui.syncRooms()
 			ui.refreshPeers()
+			ui.refreshStatus()
 
-		case <-ui.cr.ctx.Done():
+		case <-ui.rm.ctx.Done():
 			return
 
 		case <-ui.doneCh:
@@ -218,6 +961,15 @@ func (ui *ChatUI) handleEvents() {
 	}
 }
 
+// shortID returns the last 8 chars of a peer id
+func shortID(p peer.ID) string {
+	s := p.String()
+	if len(s) <= 8 {
+		return s
+	}
+	return s[len(s)-8:]
+}
+
 // withColor wraps a string with color tags for display in the messages text box.
 func withColor(color, msg string) string {
 	return fmt.Sprintf("[%s]%s[-]", color, msg)
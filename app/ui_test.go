@@ -0,0 +1,37 @@
+package app
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/alejoacosta74/libp2p-chat-app/history"
+	"github.com/rivo/tview"
+)
+
+func TestInsertMissed(t *testing.T) {
+	view := tview.NewTextView().SetDynamicColors(true)
+	ui := &ChatUI{
+		rm:       &RoomManager{},
+		msgViews: map[string]*tview.TextView{"lobby": view},
+		replayed: make(map[string]int),
+	}
+	ui.displayRecords("lobby", []*history.Record{{ID: "1", Timestamp: 1000, SenderNick: "alice", Message: "stored"}})
+	ui.replayed["lobby"] = len(view.GetText(false))
+	// the lines written since the replay are not in the store
+	view.Write([]byte("[gray]* bob is now known as carol[-]\n<dave>: live\n"))
+
+	ui.insertMissed("lobby", []*history.Record{
+		{ID: "2", Timestamp: 2000, SenderNick: "bob", Message: "missed 1"},
+		{ID: "3", Timestamp: 3000, SenderNick: "bob", Message: "missed 2"},
+	})
+	ui.insertMissed("lobby", []*history.Record{{ID: "4", Timestamp: 4000, SenderNick: "bob", Message: "missed 3"}})
+
+	var got []string
+	for _, line := range strings.Split(strings.TrimSpace(view.GetText(true)), "\n") {
+		got = append(got, line[strings.LastIndex(line, ">")+1:])
+	}
+	want := []string{": stored", ": missed 1", ": missed 2", ": missed 3", "* bob is now known as carol", ": live"}
+	if strings.Join(got, "|") != strings.Join(want, "|") {
+		t.Errorf("got lines %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,356 @@
+package app
+
+import (
+	"crypto/subtle"
+	"embed"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/alejoacosta74/go-logger"
+	"github.com/alejoacosta74/libp2p-chat-app/p2p/nickname"
+	"github.com/gorilla/websocket"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/spf13/viper"
+)
+
+const (
+	// maxWebNickLength is the maximum length in bytes of the nickname of a web
+	// session, shorter than the nicknames announced by the peers
+	maxWebNickLength = 32
+
+	// webWriteTimeout is the maximum time to write a frame to a browser
+	webWriteTimeout = 10 * time.Second
+
+	// webPingInterval is how often the browsers are pinged to keep the connection alive
+	webPingInterval = 30 * time.Second
+
+	// webSessionBufSize is the number of events buffered for each browser
+	webSessionBufSize = 256
+)
+
+// webFS holds the static files of the web client
+//
+//go:embed web
+var webFS embed.FS
+
+// Event types sent to the browsers
+const (
+	webEventWelcome = "welcome"
+	webEventMessage = "message"
+	webEventRooms   = "rooms"
+	webEventError   = "error"
+)
+
+// webEvent is a JSON frame sent to the browsers
+type webEvent struct {
+	Type string
+	Room string `json:",omitempty"`
+	*ChatMessage
+	Rooms  []string `json:",omitempty"`
+	PeerID string   `json:",omitempty"`
+	Nick   string   `json:",omitempty"`
+	Error  string   `json:",omitempty"`
+}
+
+// messageEvent returns the event carrying a message of the room. The error of
+// an undecryptable message is copied to the event, as the Error field of the
+// event hides the one of the embedded ChatMessage.
+func messageEvent(roomName string, cm *ChatMessage) *webEvent {
+	return &webEvent{Type: webEventMessage, Room: roomName, ChatMessage: cm, Error: cm.Error}
+}
+
+// webPost is a JSON frame received from a browser, publishing a message to a room
+type webPost struct {
+	Room    string
+	Message string
+}
+
+// webSession is a browser connected to the bridge. Each session publishes
+// under its own nickname, signed with the node's identity.
+type webSession struct {
+	conn *websocket.Conn
+	nick string
+	send chan *webEvent
+	done chan struct{}
+	once sync.Once
+}
+
+// WebBridge serves a minimal web chat client and a WebSocket endpoint relaying
+// the messages of the joined rooms to the browsers, and their posts to the rooms.
+// The browsers must connect from the page served by the bridge and, unless it
+// listens on a loopback address, give the token of the bridge.
+type WebBridge struct {
+	rm       *RoomManager
+	self     peer.ID
+	token    string // required from the browsers if not empty
+	loopback bool   // whether the bridge only listens on a loopback address
+	server   *http.Server
+	upgrader websocket.Upgrader
+
+	mu       sync.Mutex
+	sessions map[*webSession]struct{}
+}
+
+// NewWebBridge creates the web bridge of the rooms managed by rm. If token is
+// not empty, the browsers must give it to connect.
+func NewWebBridge(rm *RoomManager, token string) *WebBridge {
+	b := &WebBridge{
+		rm:       rm,
+		self:     rm.self,
+		token:    token,
+		sessions: make(map[*webSession]struct{}),
+	}
+	b.upgrader = websocket.Upgrader{ReadBufferSize: 4096, WriteBufferSize: 4096, CheckOrigin: sameOrigin}
+
+	// Sub only fails on invalid paths
+	static, _ := fs.Sub(webFS, "web")
+	mux := http.NewServeMux()
+	mux.Handle("GET /", http.FileServerFS(static))
+	mux.HandleFunc("GET /ws", b.handleWebSocket)
+	b.server = &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	return b
+}
+
+// Listen starts serving the web client on the TCP address addr, on the
+// loopback address if addr has no host. A token is required to listen on
+// other addresses.
+func (b *WebBridge) Listen(addr string) error {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return fmt.Errorf("invalid web address %q: %w", addr, err)
+	}
+	if host == "" {
+		host = "127.0.0.1"
+	}
+	b.loopback = isLoopbackHost(host)
+	if !b.loopback && b.token == "" {
+		return fmt.Errorf("web address %q is not a loopback address, set P2P_CHAT_WEB_TOKEN to expose the web client", addr)
+	}
+	ln, err := net.Listen("tcp", net.JoinHostPort(host, port))
+	if err != nil {
+		return err
+	}
+	go func() {
+		if err := b.server.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logger.Errorf("web bridge stopped: %v", err)
+		}
+	}()
+	go b.relay()
+	if b.token != "" {
+		logger.Infof("Web client available at http://%s/?token=<P2P_CHAT_WEB_TOKEN>", ln.Addr())
+	} else {
+		logger.Infof("Web client available at http://%s", ln.Addr())
+	}
+	return nil
+}
+
+// Close stops the web server and disconnects the browsers
+func (b *WebBridge) Close() error {
+	err := b.server.Close()
+	b.mu.Lock()
+	for s := range b.sessions {
+		s.close()
+	}
+	b.mu.Unlock()
+	return err
+}
+
+// handleWebSocket upgrades the connection of a browser and serves its session
+func (b *WebBridge) handleWebSocket(w http.ResponseWriter, r *http.Request) {
+	// a page rebinding its domain to the loopback address has a foreign host
+	if b.loopback && !isLoopbackHost(r.Host) {
+		http.Error(w, "host is not a loopback address", http.StatusForbidden)
+		return
+	}
+	if b.token != "" && subtle.ConstantTimeCompare([]byte(r.URL.Query().Get("token")), []byte(b.token)) != 1 {
+		http.Error(w, "invalid token", http.StatusUnauthorized)
+		return
+	}
+	nick := strings.TrimSpace(r.URL.Query().Get("nick"))
+	if err := nickname.Validate(nick); err != nil {
+		http.Error(w, fmt.Sprintf("invalid nickname: %v", err), http.StatusBadRequest)
+		return
+	}
+	if len(nick) > maxWebNickLength {
+		http.Error(w, fmt.Sprintf("invalid nickname: longer than %d bytes", maxWebNickLength), http.StatusBadRequest)
+		return
+	}
+	conn, err := b.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		logger.Debugf("web bridge: failed to upgrade connection: %v", err)
+		return
+	}
+	conn.SetReadLimit(maxAPIRequestSize)
+
+	s := &webSession{
+		conn: conn,
+		nick: nick,
+		send: make(chan *webEvent, webSessionBufSize),
+		done: make(chan struct{}),
+	}
+	b.mu.Lock()
+	b.sessions[s] = struct{}{}
+	b.mu.Unlock()
+	logger.Infof("Web session %s connected from %s", nick, r.RemoteAddr)
+
+	go s.writeLoop()
+	s.push(&webEvent{Type: webEventWelcome, PeerID: b.self.String(), Nick: nick, Rooms: b.rm.Rooms()})
+	b.replayHistory(s)
+	b.readLoop(s)
+
+	b.mu.Lock()
+	delete(b.sessions, s)
+	b.mu.Unlock()
+	s.close()
+	logger.Infof("Web session %s disconnected", nick)
+}
+
+// sameOrigin accepts the WebSocket connections opened by the page of the
+// bridge, and by clients which are not browsers and send no Origin
+func sameOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	return err == nil && strings.EqualFold(u.Host, r.Host)
+}
+
+// readLoop publishes the posts of the browser until it disconnects
+func (b *WebBridge) readLoop(s *webSession) {
+	for {
+		var post webPost
+		if err := s.conn.ReadJSON(&post); err != nil {
+			return
+		}
+		if strings.TrimSpace(post.Message) == "" {
+			continue
+		}
+		cr, ok := b.rm.Room(post.Room)
+		if !ok {
+			s.push(&webEvent{Type: webEventError, Error: "not in room " + post.Room})
+			continue
+		}
+		msg, err := cr.PublishAs(s.nick, post.Message)
+		if err != nil {
+			s.push(&webEvent{Type: webEventError, Error: "failed to publish message: " + err.Error()})
+			continue
+		}
+		// published messages are not received back from the topic, so echo
+		// them to every browser, the sender included
+		b.broadcast(messageEvent(post.Room, msg))
+	}
+}
+
+// replayHistory sends the last stored messages of every joined room to the browser
+func (b *WebBridge) replayHistory(s *webSession) {
+	store := b.rm.History()
+	if store == nil {
+		return
+	}
+	for _, roomName := range b.rm.Rooms() {
+		cr, ok := b.rm.Room(roomName)
+		if !ok {
+			continue
+		}
+		records, err := store.Last(cr.HistoryName(), viper.GetInt("history-size"))
+		if err != nil {
+			logger.Warnf("web bridge: failed to load history of room %s: %v", roomName, err)
+			continue
+		}
+		for _, r := range records {
+			s.push(messageEvent(roomName, &ChatMessage{
+				ID:         r.ID,
+				Timestamp:  r.Timestamp,
+				Message:    r.Message,
+				SenderID:   r.SenderID,
+				SenderNick: r.SenderNick,
+			}))
+		}
+	}
+}
+
+// relay forwards the messages received in the rooms to the browsers, and
+// tells them when rooms are joined or left
+func (b *WebBridge) relay() {
+	msgs, cancel := b.rm.Subscribe()
+	defer cancel()
+	ticker := time.NewTicker(2 * time.Second)
+	defer ticker.Stop()
+
+	rooms := b.rm.Rooms()
+	for {
+		select {
+		case m := <-msgs:
+			b.broadcast(messageEvent(m.Room, m.ChatMessage))
+		case <-ticker.C:
+			if current := b.rm.Rooms(); !slices.Equal(current, rooms) {
+				rooms = current
+				b.broadcast(&webEvent{Type: webEventRooms, Rooms: rooms})
+			}
+		case <-b.rm.ctx.Done():
+			return
+		}
+	}
+}
+
+// broadcast sends the event to every connected browser
+func (b *WebBridge) broadcast(e *webEvent) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for s := range b.sessions {
+		s.push(e)
+	}
+}
+
+// push queues an event for the browser, dropping it if the browser falls behind
+func (s *webSession) push(e *webEvent) {
+	select {
+	case s.send <- e:
+	case <-s.done:
+	default:
+		logger.Debugf("web session %s falling behind, dropping event", s.nick)
+	}
+}
+
+// writeLoop writes the queued events to the browser and keeps the connection alive
+func (s *webSession) writeLoop() {
+	ping := time.NewTicker(webPingInterval)
+	defer ping.Stop()
+	for {
+		select {
+		case e := <-s.send:
+			s.conn.SetWriteDeadline(time.Now().Add(webWriteTimeout))
+			if err := s.conn.WriteJSON(e); err != nil {
+				s.close()
+				return
+			}
+		case <-ping.C:
+			if err := s.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(webWriteTimeout)); err != nil {
+				s.close()
+				return
+			}
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// close disconnects the browser
+func (s *webSession) close() {
+	s.once.Do(func() {
+		close(s.done)
+		s.conn.Close()
+	})
+}
@@ -0,0 +1,37 @@
+package app
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestWebBridgeNick(t *testing.T) {
+	b := NewWebBridge(&RoomManager{}, "")
+	tests := []struct {
+		nick    string
+		wantErr bool
+	}{
+		{nick: "alice"},
+		{nick: "  alice  "},
+		{nick: strings.Repeat("a", maxWebNickLength)},
+		{nick: "", wantErr: true},
+		{nick: "   ", wantErr: true},
+		{nick: strings.Repeat("a", maxWebNickLength+1), wantErr: true},
+		{nick: "alice\nbob", wantErr: true},
+		{nick: "alice\x1b[2J", wantErr: true},
+		{nick: "alice\xff", wantErr: true},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/ws?nick="+url.QueryEscape(tt.nick), nil)
+		rec := httptest.NewRecorder()
+		b.handleWebSocket(rec, req)
+		// the valid nicknames go on to the websocket upgrade, which fails on a plain request
+		gotErr := strings.HasPrefix(rec.Body.String(), "invalid nickname")
+		if gotErr != tt.wantErr {
+			t.Errorf("nick %q: got status %d %q, want nickname error %v", tt.nick, rec.Code, rec.Body.String(), tt.wantErr)
+		}
+	}
+}
@@ -0,0 +1,78 @@
+/*
+Copyright © 2024 Alejo Acosta
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/alejoacosta74/libp2p-chat-app/app"
+
+	"github.com/alejoacosta74/go-logger"
+	"github.com/spf13/cobra"
+)
+
+// daemonCmd runs the chat node without the terminal UI
+var daemonCmd = &cobra.Command{
+	Use:   "daemon",
+	Short: "Run the chat node without the terminal UI",
+	Long: `Run the libp2p node, peer discovery and the chat rooms in the foreground
+	without the terminal UI, e.g. on a server or in CI. Received messages are logged
+	to stdout, or to the file given by --logfile. The node shuts down cleanly on
+	SIGINT or SIGTERM.`,
+	Args:         cobra.NoArgs,
+	RunE:         runDaemon,
+	SilenceUsage: true,
+}
+
+func init() {
+	daemonCmd.Flags().AddFlagSet(nodeFlags)
+	daemonCmd.Flags().StringP("logfile", "f", "", "log file name (default stdout)")
+	rootCmd.AddCommand(daemonCmd)
+}
+
+func runDaemon(cmd *cobra.Command, args []string) error {
+	if err := promptPassphrase(); err != nil {
+		return fmt.Errorf("failed to read passphrase: %w", err)
+	}
+
+	logfile, _ := cmd.Flags().GetString("logfile")
+	if logfile != "" {
+		logger.NullOutput()
+		if err := logger.AddFileOutputHook(logfile, nil); err != nil {
+			return fmt.Errorf("failed to open log file %s: %w", logfile, err)
+		}
+	} else {
+		logger.SetOutput(os.Stdout)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	if err := app.RunDaemon(ctx); err != nil {
+		return fmt.Errorf("failed to run daemon: %w", err)
+	}
+	logger.Info("shutdown complete")
+	return nil
+}
@@ -0,0 +1,239 @@
+/*
+Copyright © 2024 Alejo Acosta
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/alejoacosta74/libp2p-chat-app/p2p/identity"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"golang.org/x/term"
+)
+
+// identityCmd groups the subcommands used to manage the node identity key
+var identityCmd = &cobra.Command{
+	Use:   "identity",
+	Short: "Manage the node identity key",
+	Long: `Manage the private key that determines the node's peer ID.
+	The key is stored in the file given by --identity. Set P2P_CHAT_IDENTITY_PASSPHRASE
+	to encrypt the key at rest.`,
+}
+
+var identityShowCmd = &cobra.Command{
+	Use:   "show",
+	Short: "Show the peer ID of the stored identity",
+	Args:  cobra.NoArgs,
+	RunE:  runIdentityShow,
+}
+
+var identityExportCmd = &cobra.Command{
+	Use:   "export",
+	Short: "Export the identity key in PEM format",
+	Args:  cobra.NoArgs,
+	RunE:  runIdentityExport,
+}
+
+var identityImportCmd = &cobra.Command{
+	Use:   "import <file>",
+	Short: "Import an identity key from a PEM file",
+	Args:  cobra.ExactArgs(1),
+	RunE:  runIdentityImport,
+}
+
+var identityRotateCmd = &cobra.Command{
+	Use:   "rotate",
+	Short: "Replace the identity key with a new one",
+	Long: `Generate a new identity key. The previous key is kept as a backup
+	next to the key file.`,
+	Args: cobra.NoArgs,
+	RunE: runIdentityRotate,
+}
+
+func init() {
+	identityExportCmd.Flags().StringP("out", "o", "", "output file (default stdout)")
+	identityExportCmd.Flags().Bool("force", false, "overwrite an existing output file")
+	identityImportCmd.Flags().Bool("force", false, "overwrite an existing identity key")
+
+	identityCmd.AddCommand(identityShowCmd, identityExportCmd, identityImportCmd, identityRotateCmd)
+	rootCmd.AddCommand(identityCmd)
+}
+
+// keyStore returns the key store configured through viper
+func keyStore() *identity.KeyStore {
+	return identity.NewKeyStore(viper.GetString("identity"), viper.GetString("identity-passphrase"))
+}
+
+// promptPassphrase asks for the identity passphrase on the terminal when the
+// stored key is encrypted and no passphrase was provided in the environment.
+func promptPassphrase() error {
+	if viper.GetString("identity-passphrase") != "" {
+		return nil
+	}
+	encrypted, err := keyStore().Encrypted()
+	if err != nil || !encrypted {
+		// a missing key is generated later on, other errors are reported when loading it
+		return nil
+	}
+	if !term.IsTerminal(int(os.Stdin.Fd())) {
+		return identity.ErrPassphraseRequired
+	}
+
+	fmt.Fprint(os.Stderr, "Identity passphrase: ")
+	passphrase, err := term.ReadPassword(int(os.Stdin.Fd()))
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return err
+	}
+	viper.Set("identity-passphrase", string(passphrase))
+	return nil
+}
+
+func runIdentityShow(cmd *cobra.Command, args []string) error {
+	if err := promptPassphrase(); err != nil {
+		return err
+	}
+	ks := keyStore()
+	key, err := ks.Load()
+	if err != nil {
+		return err
+	}
+	id, err := identity.PeerID(key)
+	if err != nil {
+		return err
+	}
+	encrypted, err := ks.Encrypted()
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(cmd.OutOrStdout(), "Peer ID:   %s\n", id)
+	fmt.Fprintf(cmd.OutOrStdout(), "Key type:  %s\n", key.Type())
+	fmt.Fprintf(cmd.OutOrStdout(), "Key file:  %s\n", ks.Path())
+	fmt.Fprintf(cmd.OutOrStdout(), "Encrypted: %t\n", encrypted)
+	return nil
+}
+
+func runIdentityExport(cmd *cobra.Command, args []string) error {
+	if err := promptPassphrase(); err != nil {
+		return err
+	}
+	key, err := keyStore().Load()
+	if err != nil {
+		return err
+	}
+	// the exported key is protected with the same passphrase as the key store
+	data, err := identity.Encode(key, []byte(viper.GetString("identity-passphrase")))
+	if err != nil {
+		return err
+	}
+
+	out, _ := cmd.Flags().GetString("out")
+	if out == "" {
+		_, err = cmd.OutOrStdout().Write(data)
+		return err
+	}
+	flags := os.O_WRONLY | os.O_CREATE | os.O_EXCL
+	if force, _ := cmd.Flags().GetBool("force"); force {
+		flags = os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	}
+	f, err := os.OpenFile(out, flags, 0o600)
+	if err != nil {
+		if errors.Is(err, os.ErrExist) {
+			return fmt.Errorf("%s already exists, use --force to overwrite it", out)
+		}
+		return err
+	}
+	// an overwritten file would keep its permissions otherwise
+	if err := f.Chmod(0o600); err != nil {
+		f.Close()
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func runIdentityImport(cmd *cobra.Command, args []string) error {
+	// the imported key replacing an encrypted one is encrypted as well
+	if err := promptPassphrase(); err != nil {
+		return err
+	}
+	data, err := os.ReadFile(args[0])
+	if err != nil {
+		return err
+	}
+	key, err := identity.Decode(data, []byte(viper.GetString("identity-passphrase")))
+	if err != nil {
+		return err
+	}
+
+	force, _ := cmd.Flags().GetBool("force")
+	ks := keyStore()
+	if err := ks.Save(key, force); err != nil {
+		if errors.Is(err, identity.ErrKeyExists) {
+			return fmt.Errorf("%w at %s, use --force to overwrite it", err, ks.Path())
+		}
+		return err
+	}
+
+	id, err := identity.PeerID(key)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(cmd.OutOrStdout(), "Imported identity %s into %s\n", id, ks.Path())
+	return nil
+}
+
+func runIdentityRotate(cmd *cobra.Command, args []string) error {
+	if err := promptPassphrase(); err != nil {
+		return err
+	}
+	ks := keyStore()
+	var oldID string
+	if key, err := ks.Load(); err == nil {
+		id, _ := identity.PeerID(key)
+		oldID = id.String()
+	} else if !errors.Is(err, identity.ErrNoKey) {
+		return err
+	}
+
+	key, backup, err := ks.Rotate()
+	if err != nil {
+		return err
+	}
+	id, err := identity.PeerID(key)
+	if err != nil {
+		return err
+	}
+
+	if oldID != "" {
+		fmt.Fprintf(cmd.OutOrStdout(), "Previous identity %s saved to %s\n", oldID, backup)
+	}
+	fmt.Fprintf(cmd.OutOrStdout(), "New identity: %s\n", id)
+	return nil
+}
@@ -0,0 +1,97 @@
+/*
+Copyright © 2024 Alejo Acosta
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/alejoacosta74/libp2p-chat-app/app"
+
+	"github.com/alejoacosta74/go-logger"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// relayCmd runs an infrastructure node helping the chat peers to reach each other
+var relayCmd = &cobra.Command{
+	Use:   "relay",
+	Short: "Run a relay and bootstrap node for the chat peers",
+	Long: `Run a long-lived infrastructure node on a publicly reachable host. It offers
+	a circuit relay v2 service to the peers behind NATs, answers DHT queries as a
+	DHT server, and forwards the messages of the given chat rooms without taking
+	part in them. It prints its full multiaddrs on startup, to be passed to the
+	clients with --bootstrap or --relay.`,
+	Args:         cobra.NoArgs,
+	RunE:         runRelay,
+	SilenceUsage: true,
+}
+
+func init() {
+	relayCmd.Flags().StringSlice("listen", nil, fmt.Sprintf("multiaddrs to listen on (default %v)", app.DefaultRelayListenAddrs))
+	relayCmd.Flags().StringSlice("rooms", nil, "chat rooms to forward (default the room of the config file)")
+	relayCmd.Flags().Int("max-reservations", 0, "maximum number of relay reservations (default libp2p limit)")
+	relayCmd.Flags().Int("max-reservations-per-ip", 0, "maximum number of relay reservations from the same IP (default libp2p limit)")
+	relayCmd.Flags().Int("max-circuits", 0, "maximum number of relayed connections per peer (default libp2p limit)")
+	relayCmd.Flags().Duration("reservation-ttl", 0, "lifetime of a relay reservation (default libp2p limit)")
+	relayCmd.Flags().Duration("limit-duration", 0, "maximum duration of a relayed connection (default libp2p limit)")
+	relayCmd.Flags().Int64("limit-data", 0, "maximum bytes relayed in each direction of a connection (default libp2p limit)")
+	relayCmd.Flags().Bool("force-public", true, "assume the host is publicly reachable instead of waiting for AutoNAT")
+	relayCmd.Flags().AddFlag(nodeFlags.Lookup("metrics"))
+	relayCmd.Flags().AddFlag(nodeFlags.Lookup("bootstrap"))
+	relayCmd.Flags().AddFlag(nodeFlags.Lookup("dht-prefix"))
+	relayCmd.Flags().AddFlag(nodeFlags.Lookup("swarm-key"))
+	relayCmd.Flags().StringP("logfile", "f", "", "log file name (default stdout)")
+
+	for _, name := range []string{"listen", "rooms", "max-reservations", "max-reservations-per-ip", "max-circuits",
+		"reservation-ttl", "limit-duration", "limit-data", "force-public"} {
+		viper.BindPFlag("relay-service."+name, relayCmd.Flags().Lookup(name))
+	}
+	rootCmd.AddCommand(relayCmd)
+}
+
+func runRelay(cmd *cobra.Command, args []string) error {
+	if err := promptPassphrase(); err != nil {
+		return fmt.Errorf("failed to read passphrase: %w", err)
+	}
+
+	logfile, _ := cmd.Flags().GetString("logfile")
+	if logfile != "" {
+		logger.NullOutput()
+		if err := logger.AddFileOutputHook(logfile, nil); err != nil {
+			return fmt.Errorf("failed to open log file %s: %w", logfile, err)
+		}
+	} else {
+		logger.SetOutput(os.Stdout)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	if err := app.RunRelay(ctx); err != nil {
+		return fmt.Errorf("failed to run relay: %w", err)
+	}
+	logger.Info("shutdown complete")
+	return nil
+}
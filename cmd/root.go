@@ -23,12 +23,20 @@ package cmd
 
 import (
 	"context"
+	"errors"
 	"os"
+	"path/filepath"
+	"time"
 
 	"github.com/alejoacosta74/libp2p-chat-app/app"
+	"github.com/alejoacosta74/libp2p-chat-app/history"
+	"github.com/alejoacosta74/libp2p-chat-app/p2p/filetransfer"
+	"github.com/alejoacosta74/libp2p-chat-app/p2p/identity"
+	"github.com/alejoacosta74/libp2p-chat-app/p2p/node"
 
 	"github.com/alejoacosta74/go-logger"
 	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
 	"github.com/spf13/viper"
 )
 
@@ -51,18 +59,75 @@ func Execute() {
 	}
 }
 
+// nodeFlags holds the flags shared by the commands running a chat node. It is
+// built before any init function runs, so that every command can add it.
+var nodeFlags = newNodeFlags()
+
+func newNodeFlags() *pflag.FlagSet {
+	fs := pflag.NewFlagSet("node", pflag.ContinueOnError)
+	fs.StringP("nickname", "n", "", "nickname")
+	fs.StringP("room", "r", "", "chat room name")
+	fs.StringP("log", "l", "info", "log level")
+	fs.String("history", "", "path to the chat history database (default "+history.DefaultPath()+")")
+	fs.String("downloads", "", "directory the files shared in the rooms are downloaded to (default "+filetransfer.DefaultPath()+")")
+	fs.Int("history-size", 50, "number of messages replayed from the history when joining a room")
+	fs.String("wire-format", "protobuf", "encoding of the published messages [json|protobuf]")
+	fs.Int("max-message-size", 64*1024, "maximum size of a chat message in bytes")
+	fs.Duration("max-clock-skew", 5*time.Minute, "maximum clock skew accepted on message timestamps")
+	fs.Float64("rate-limit", 2, "messages per second accepted from each peer in a room (0 disables rate limiting)")
+	fs.Int("rate-burst", 10, "number of messages a peer can send at once in a room")
+	fs.StringSlice("listen", node.DefaultListenAddrs, "multiaddrs to listen on, e.g. /ip4/0.0.0.0/tcp/4001,/ip4/0.0.0.0/udp/4001/quic-v1")
+	fs.StringSlice("relay", nil, "multiaddrs of the static circuit relays used when behind NAT, ending with /p2p/<peerID>")
+	fs.StringSlice("bootstrap", nil, "multiaddrs of the DHT bootstrap peers, ending with /p2p/<peerID> (default the public IPFS ones)")
+	fs.String("dht-mode", "auto", "DHT mode [auto|client|server]")
+	fs.String("dht-prefix", "", "DHT protocol prefix isolating a private network from the public IPFS DHT, e.g. /myteam")
+	fs.String("swarm-key", "", "path to the swarm key file of a private network, see 'p2p-chat swarmkey generate'")
+	fs.String("metrics", "", "serve the Prometheus metrics on http://host:port/metrics (disabled if empty)")
+	fs.String("web", "", "serve the web chat client on host:port, 127.0.0.1 if no host is given (disabled if empty)")
+	fs.String("api", "", "serve the local control API on unix:<path> or a loopback host:port (disabled if empty)")
+	return fs
+}
+
 func init() {
-	rootCmd.Flags().StringP("nickname", "n", "", "nickname")
-	rootCmd.Flags().StringP("room", "r", "", "chat room name")
-	rootCmd.Flags().StringP("log", "l", "info", "log level")
+	rootCmd.Flags().AddFlagSet(nodeFlags)
 	rootCmd.Flags().StringP("logfile", "f", "chat.log", "log file name")
-	viper.BindPFlag("nickname", rootCmd.Flags().Lookup("nickname"))
-	viper.BindPFlag("room", rootCmd.Flags().Lookup("room"))
-	viper.BindPFlag("log", rootCmd.Flags().Lookup("log"))
+	rootCmd.PersistentFlags().String("config", "", "config file (default "+defaultConfigPath()+")")
+	rootCmd.PersistentFlags().String("identity", "", "path to the identity key file (default "+identity.DefaultPath()+")")
+	viper.BindPFlag("nickname", nodeFlags.Lookup("nickname"))
+	viper.BindPFlag("room", nodeFlags.Lookup("room"))
+	viper.BindPFlag("log", nodeFlags.Lookup("log"))
 	viper.BindPFlag("logfile", rootCmd.Flags().Lookup("logfile"))
+	viper.BindPFlag("history", nodeFlags.Lookup("history"))
+	viper.BindPFlag("downloads", nodeFlags.Lookup("downloads"))
+	viper.BindPFlag("history-size", nodeFlags.Lookup("history-size"))
+	viper.BindPFlag("wire-format", nodeFlags.Lookup("wire-format"))
+	viper.BindPFlag("max-message-size", nodeFlags.Lookup("max-message-size"))
+	viper.BindPFlag("max-clock-skew", nodeFlags.Lookup("max-clock-skew"))
+	viper.BindPFlag("rate-limit.rate", nodeFlags.Lookup("rate-limit"))
+	viper.BindPFlag("rate-limit.burst", nodeFlags.Lookup("rate-burst"))
+	viper.BindPFlag("api", nodeFlags.Lookup("api"))
+	viper.BindPFlag("web", nodeFlags.Lookup("web"))
+	viper.BindPFlag("metrics", nodeFlags.Lookup("metrics"))
+	viper.BindPFlag("listen", nodeFlags.Lookup("listen"))
+	viper.BindPFlag("relay", nodeFlags.Lookup("relay"))
+	viper.BindPFlag("swarm-key", nodeFlags.Lookup("swarm-key"))
+	viper.BindPFlag("dht.bootstrap", nodeFlags.Lookup("bootstrap"))
+	viper.BindPFlag("dht.mode", nodeFlags.Lookup("dht-mode"))
+	viper.BindPFlag("dht.protocol-prefix", nodeFlags.Lookup("dht-prefix"))
+	viper.BindPFlag("config", rootCmd.PersistentFlags().Lookup("config"))
+	viper.BindPFlag("identity", rootCmd.PersistentFlags().Lookup("identity"))
+	// the passphrases and the web token are only read from the environment so they do not end up in the shell history
+	viper.BindEnv("identity-passphrase", "P2P_CHAT_IDENTITY_PASSPHRASE")
+	viper.BindEnv("room-passphrase", "P2P_CHAT_ROOM_PASSPHRASE")
+	viper.BindEnv("web-token", "P2P_CHAT_WEB_TOKEN")
 }
 
 func run(cmd *cobra.Command, args []string) {
+	if err := promptPassphrase(); err != nil {
+		logger.WithFields("error", err.Error()).Error("failed to read passphrase")
+		return
+	}
+
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 	go func() {
@@ -77,6 +142,10 @@ func run(cmd *cobra.Command, args []string) {
 }
 
 func preRun(cmd *cobra.Command, args []string) error {
+	if err := readConfig(); err != nil {
+		return err
+	}
+
 	logLevel := viper.GetString("log")
 	if logLevel == "" {
 		logLevel = "info"
@@ -84,3 +153,26 @@ func preRun(cmd *cobra.Command, args []string) error {
 	logger.SetLevel(logLevel)
 	return nil
 }
+
+// defaultConfigPath returns the location of the config file used when --config is not set
+func defaultConfigPath() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "config.yaml"
+	}
+	return filepath.Join(dir, "p2p-chat", "config.yaml")
+}
+
+// readConfig loads the config file. A missing file is only an error if it
+// was explicitly requested with --config.
+func readConfig() error {
+	if cfgFile := viper.GetString("config"); cfgFile != "" {
+		viper.SetConfigFile(cfgFile)
+		return viper.ReadInConfig()
+	}
+	viper.SetConfigFile(defaultConfigPath())
+	if err := viper.ReadInConfig(); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,90 @@
+/*
+Copyright © 2024 Alejo Acosta
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/alejoacosta74/libp2p-chat-app/p2p/node"
+
+	"github.com/spf13/cobra"
+)
+
+// swarmKeyCmd groups the subcommands used to manage the key of a private network
+var swarmKeyCmd = &cobra.Command{
+	Use:   "swarmkey",
+	Short: "Manage the pre-shared key of a private network",
+	Long: `Manage the pre-shared key (PSK) isolating a private network. Nodes started
+	with --swarm-key only connect to the peers holding the same key file, and
+	refuse every other connection. QUIC and WebTransport cannot be used in a
+	private network.`,
+}
+
+var swarmKeyGenerateCmd = &cobra.Command{
+	Use:   "generate",
+	Short: "Generate a new swarm key file",
+	Args:  cobra.NoArgs,
+	RunE:  runSwarmKeyGenerate,
+}
+
+func init() {
+	swarmKeyGenerateCmd.Flags().StringP("out", "o", "", "output file (default stdout)")
+	swarmKeyGenerateCmd.Flags().Bool("force", false, "overwrite an existing swarm key file")
+
+	swarmKeyCmd.AddCommand(swarmKeyGenerateCmd)
+	rootCmd.AddCommand(swarmKeyCmd)
+}
+
+func runSwarmKeyGenerate(cmd *cobra.Command, args []string) error {
+	data, err := node.GenerateSwarmKey()
+	if err != nil {
+		return err
+	}
+
+	out, _ := cmd.Flags().GetString("out")
+	if out == "" {
+		_, err = cmd.OutOrStdout().Write(data)
+		return err
+	}
+	flags := os.O_WRONLY | os.O_CREATE | os.O_EXCL
+	if force, _ := cmd.Flags().GetBool("force"); force {
+		flags = os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	}
+	f, err := os.OpenFile(out, flags, 0o600)
+	if err != nil {
+		if errors.Is(err, os.ErrExist) {
+			return fmt.Errorf("swarm key %s already exists, use --force to overwrite it", out)
+		}
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	fmt.Fprintf(cmd.OutOrStdout(), "Swarm key written to %s, share it with the peers of the private network\n", out)
+	return nil
+}
@@ -0,0 +1,332 @@
+package history
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	// DefaultFile is the name of the history database inside the default config directory
+	DefaultFile = "history.db"
+)
+
+var (
+	// bucket layout: rooms/room:<room>/msgs holds the records keyed by message ID,
+	// rooms/room:<room>/time indexes the message IDs by timestamp, and
+	// rooms/room:<room>/meta holds the settings of the room, and peers holds
+	// the nickname announcements of the address book keyed by peer ID
+	roomsBucket = []byte("rooms")
+	peersBucket = []byte("peers")
+	msgsBucket  = []byte("msgs")
+	timeBucket  = []byte("time")
+	metaBucket  = []byte("meta")
+
+	// aclKey is the key of the access control list in the meta bucket of a room
+	aclKey = []byte("acl")
+)
+
+// Record is a chat message persisted in the store
+type Record struct {
+	Room       string
+	ID         string
+	Timestamp  int64 // unix milliseconds
+	SenderID   string
+	SenderNick string
+	Message    string
+	// Signed is the pubsub message the record was published in, signed by
+	// its sender, so that the peers fetching the record can verify it
+	Signed []byte `json:",omitempty"`
+}
+
+// Time returns the record timestamp as a time.Time
+func (r *Record) Time() time.Time {
+	return time.UnixMilli(r.Timestamp)
+}
+
+// Store is an embedded message store keyed by room and message ID
+type Store struct {
+	db *bolt.DB
+}
+
+// DefaultPath returns the default location of the history database
+func DefaultPath() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return DefaultFile
+	}
+	return filepath.Join(dir, "p2p-chat", DefaultFile)
+}
+
+// Open opens (creating it if needed) the history database at path. If path
+// is empty the default location is used.
+func Open(path string) (*Store, error) {
+	if path == "" {
+		path = DefaultPath()
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create history directory: %w", err)
+	}
+	db, err := bolt.Open(path, 0o600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open history database: %w", err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(roomsBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &Store{db: db}, nil
+}
+
+// Close closes the underlying database
+func (s *Store) Close() error {
+	return s.db.Close()
+}
+
+// Put stores the record. Storing a message ID that already exists in the
+// room is a no-op.
+func (s *Store) Put(r *Record) error {
+	if r.ID == "" {
+		return fmt.Errorf("record has no message ID")
+	}
+	data, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		room, err := tx.Bucket(roomsBucket).CreateBucketIfNotExists(roomKey(r.Room))
+		if err != nil {
+			return err
+		}
+		msgs, err := room.CreateBucketIfNotExists(msgsBucket)
+		if err != nil {
+			return err
+		}
+		index, err := room.CreateBucketIfNotExists(timeBucket)
+		if err != nil {
+			return err
+		}
+		if msgs.Get([]byte(r.ID)) != nil {
+			return nil
+		}
+		if err := msgs.Put([]byte(r.ID), data); err != nil {
+			return err
+		}
+		return index.Put(timeKey(r.Timestamp, r.ID), []byte(r.ID))
+	})
+}
+
+// PutACL stores the encoded access control list of the room, replacing the previous one
+func (s *Store) PutACL(roomName string, data []byte) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		room, err := tx.Bucket(roomsBucket).CreateBucketIfNotExists(roomKey(roomName))
+		if err != nil {
+			return err
+		}
+		meta, err := room.CreateBucketIfNotExists(metaBucket)
+		if err != nil {
+			return err
+		}
+		return meta.Put(aclKey, data)
+	})
+}
+
+// ACL returns the encoded access control list of the room, or nil if none is stored
+func (s *Store) ACL(roomName string) ([]byte, error) {
+	var data []byte
+	err := s.db.View(func(tx *bolt.Tx) error {
+		if meta := s.bucket(tx, roomName, metaBucket); meta != nil {
+			data = append([]byte(nil), meta.Get(aclKey)...)
+		}
+		return nil
+	})
+	if len(data) == 0 {
+		return nil, err
+	}
+	return data, err
+}
+
+// PutPeer stores the encoded nickname announcement of the peer, replacing the previous one
+func (s *Store) PutPeer(peerID string, data []byte) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		peers, err := tx.CreateBucketIfNotExists(peersBucket)
+		if err != nil {
+			return err
+		}
+		return peers.Put([]byte(peerID), data)
+	})
+}
+
+// Peers returns the encoded nickname announcements of the address book, keyed by peer ID
+func (s *Store) Peers() (map[string][]byte, error) {
+	entries := make(map[string][]byte)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		peers := tx.Bucket(peersBucket)
+		if peers == nil {
+			return nil
+		}
+		return peers.ForEach(func(k, v []byte) error {
+			entries[string(k)] = append([]byte(nil), v...)
+			return nil
+		})
+	})
+	return entries, err
+}
+
+// Has reports whether the message ID is stored for the room
+func (s *Store) Has(roomName, id string) bool {
+	found := false
+	s.db.View(func(tx *bolt.Tx) error {
+		msgs := s.bucket(tx, roomName, msgsBucket)
+		found = msgs != nil && msgs.Get([]byte(id)) != nil
+		return nil
+	})
+	return found
+}
+
+// Get returns the message with the given ID, or nil if it is not stored
+func (s *Store) Get(roomName, id string) (*Record, error) {
+	var r *Record
+	err := s.db.View(func(tx *bolt.Tx) error {
+		msgs := s.bucket(tx, roomName, msgsBucket)
+		if msgs == nil {
+			return nil
+		}
+		data := msgs.Get([]byte(id))
+		if data == nil {
+			return nil
+		}
+		var err error
+		r, err = decode(data)
+		return err
+	})
+	return r, err
+}
+
+// Latest returns the most recent message of the room, or nil if the room has no messages
+func (s *Store) Latest(roomName string) (*Record, error) {
+	records, err := s.Last(roomName, 1)
+	if err != nil || len(records) == 0 {
+		return nil, err
+	}
+	return records[0], nil
+}
+
+// Last returns the last n messages of the room, oldest first
+func (s *Store) Last(roomName string, n int) ([]*Record, error) {
+	var records []*Record
+	err := s.db.View(func(tx *bolt.Tx) error {
+		index, msgs := s.bucket(tx, roomName, timeBucket), s.bucket(tx, roomName, msgsBucket)
+		if index == nil || msgs == nil {
+			return nil
+		}
+		c := index.Cursor()
+		for k, id := c.Last(); k != nil && len(records) < n; k, id = c.Prev() {
+			r, err := decode(msgs.Get(id))
+			if err != nil {
+				return err
+			}
+			records = append(records, r)
+		}
+		return nil
+	})
+	reverse(records)
+	return records, err
+}
+
+// Since returns up to limit messages of the room with a timestamp strictly
+// greater than since (unix milliseconds), oldest first
+func (s *Store) Since(roomName string, since int64, limit int) ([]*Record, error) {
+	var records []*Record
+	err := s.db.View(func(tx *bolt.Tx) error {
+		index, msgs := s.bucket(tx, roomName, timeBucket), s.bucket(tx, roomName, msgsBucket)
+		if index == nil || msgs == nil {
+			return nil
+		}
+		c := index.Cursor()
+		for k, id := c.Seek(timeKey(since+1, "")); k != nil && len(records) < limit; k, id = c.Next() {
+			r, err := decode(msgs.Get(id))
+			if err != nil {
+				return err
+			}
+			records = append(records, r)
+		}
+		return nil
+	})
+	return records, err
+}
+
+// Search returns the last limit messages of the room whose text or sender
+// nickname contains the query (case insensitive), oldest first
+func (s *Store) Search(roomName, query string, limit int) ([]*Record, error) {
+	query = strings.ToLower(query)
+	var records []*Record
+	err := s.db.View(func(tx *bolt.Tx) error {
+		index, msgs := s.bucket(tx, roomName, timeBucket), s.bucket(tx, roomName, msgsBucket)
+		if index == nil || msgs == nil {
+			return nil
+		}
+		c := index.Cursor()
+		for k, id := c.Last(); k != nil && len(records) < limit; k, id = c.Prev() {
+			r, err := decode(msgs.Get(id))
+			if err != nil {
+				return err
+			}
+			if strings.Contains(strings.ToLower(r.Message), query) ||
+				strings.Contains(strings.ToLower(r.SenderNick), query) {
+				records = append(records, r)
+			}
+		}
+		return nil
+	})
+	reverse(records)
+	return records, err
+}
+
+// bucket returns the nested bucket of the room, or nil if the room has no messages
+func (s *Store) bucket(tx *bolt.Tx, roomName string, name []byte) *bolt.Bucket {
+	room := tx.Bucket(roomsBucket).Bucket(roomKey(roomName))
+	if room == nil {
+		return nil
+	}
+	return room.Bucket(name)
+}
+
+// roomKey returns the bucket name of the room. The prefix keeps the name
+// valid for the default room, which is the empty string
+func roomKey(roomName string) []byte {
+	return []byte("room:" + roomName)
+}
+
+// timeKey builds the index key so that records sort by timestamp, then by ID
+func timeKey(ts int64, id string) []byte {
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.BigEndian, uint64(ts))
+	buf.WriteString(id)
+	return buf.Bytes()
+}
+
+func decode(data []byte) (*Record, error) {
+	r := new(Record)
+	if err := json.Unmarshal(data, r); err != nil {
+		return nil, fmt.Errorf("failed to decode history record: %w", err)
+	}
+	return r, nil
+}
+
+func reverse(records []*Record) {
+	for i, j := 0, len(records)-1; i < j; i, j = i+1, j-1 {
+		records[i], records[j] = records[j], records[i]
+	}
+}
@@ -0,0 +1,203 @@
+package history
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+)
+
+func openStore(t *testing.T) *Store {
+	t.Helper()
+	s, err := Open(filepath.Join(t.TempDir(), "history.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+// ids returns the message IDs of the records, in order
+func ids(records []*Record) string {
+	var ids []string
+	for _, r := range records {
+		ids = append(ids, r.ID)
+	}
+	return fmt.Sprint(ids)
+}
+
+func TestPut(t *testing.T) {
+	s := openStore(t)
+	if err := s.Put(&Record{Room: "lobby", Timestamp: 1000, Message: "no ID"}); err == nil {
+		t.Error("expected an error storing a record without message ID")
+	}
+
+	r := &Record{Room: "lobby", ID: "1", Timestamp: 1000, SenderNick: "alice", Message: "hello"}
+	if err := s.Put(r); err != nil {
+		t.Fatal(err)
+	}
+	// a duplicate is ignored, and not indexed again under its new timestamp
+	if err := s.Put(&Record{Room: "lobby", ID: "1", Timestamp: 2000, Message: "edited"}); err != nil {
+		t.Fatal(err)
+	}
+	got, err := s.Get("lobby", "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got == nil || got.Message != r.Message || got.Timestamp != r.Timestamp || got.SenderNick != r.SenderNick {
+		t.Errorf("got record %+v, want %+v", got, r)
+	}
+	if records, err := s.Last("lobby", 10); err != nil || len(records) != 1 {
+		t.Errorf("got %d records, %v", len(records), err)
+	}
+
+	// message IDs are scoped to their room
+	if err := s.Put(&Record{Room: "other", ID: "1", Timestamp: 1000, Message: "elsewhere"}); err != nil {
+		t.Fatal(err)
+	}
+	if !s.Has("other", "1") || s.Has("other", "2") || s.Has("unknown", "1") {
+		t.Error("Has reports the wrong messages")
+	}
+	if got, err := s.Get("lobby", "2"); got != nil || err != nil {
+		t.Errorf("got record %+v, %v for an unknown message", got, err)
+	}
+	if got, err := s.Get("unknown", "1"); got != nil || err != nil {
+		t.Errorf("got record %+v, %v in an unknown room", got, err)
+	}
+}
+
+func TestTimeIndex(t *testing.T) {
+	s := openStore(t)
+	// stored out of order, with two messages sharing a timestamp ordered by ID
+	for _, r := range []*Record{
+		{ID: "c", Timestamp: 3000},
+		{ID: "a", Timestamp: 1000},
+		{ID: "e", Timestamp: 5000},
+		{ID: "d2", Timestamp: 4000},
+		{ID: "d1", Timestamp: 4000},
+		{ID: "b", Timestamp: 2000},
+	} {
+		r.Room = "lobby"
+		if err := s.Put(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name  string
+		query func() ([]*Record, error)
+		want  string
+	}{
+		{name: "last", query: func() ([]*Record, error) { return s.Last("lobby", 3) }, want: "[d1 d2 e]"},
+		{name: "last of all", query: func() ([]*Record, error) { return s.Last("lobby", 10) }, want: "[a b c d1 d2 e]"},
+		{name: "last of an unknown room", query: func() ([]*Record, error) { return s.Last("unknown", 10) }, want: "[]"},
+		{name: "since", query: func() ([]*Record, error) { return s.Since("lobby", 2000, 10) }, want: "[c d1 d2 e]"},
+		{name: "since with a limit", query: func() ([]*Record, error) { return s.Since("lobby", 0, 2) }, want: "[a b]"},
+		{name: "since the end", query: func() ([]*Record, error) { return s.Since("lobby", 5000, 10) }, want: "[]"},
+		{name: "since in an unknown room", query: func() ([]*Record, error) { return s.Since("unknown", 0, 10) }, want: "[]"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			records, err := tt.query()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := ids(records); got != tt.want {
+				t.Errorf("got records %s, want %s", got, tt.want)
+			}
+		})
+	}
+
+	latest, err := s.Latest("lobby")
+	if err != nil || latest == nil || latest.ID != "e" {
+		t.Errorf("got latest record %+v, %v", latest, err)
+	}
+	if latest, err := s.Latest("unknown"); latest != nil || err != nil {
+		t.Errorf("got latest record %+v, %v in an unknown room", latest, err)
+	}
+}
+
+func TestSearch(t *testing.T) {
+	s := openStore(t)
+	for i, r := range []*Record{
+		{ID: "1", SenderNick: "alice", Message: "Hello everyone"},
+		{ID: "2", SenderNick: "bob", Message: "hi alice"},
+		{ID: "3", SenderNick: "carol", Message: "good morning"},
+		{ID: "4", SenderNick: "Alice", Message: "how are you?"},
+	} {
+		r.Room, r.Timestamp = "lobby", int64(i+1)*1000
+		if err := s.Put(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Put(&Record{Room: "other", ID: "5", Timestamp: 5000, SenderNick: "alice", Message: "hello"}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		query string
+		limit int
+		want  string
+	}{
+		// the text and the nickname are matched, ignoring the case
+		{query: "ALICE", limit: 10, want: "[1 2 4]"},
+		{query: "hello", limit: 10, want: "[1]"},
+		// the last matches are kept
+		{query: "alice", limit: 2, want: "[2 4]"},
+		{query: "nobody", limit: 10, want: "[]"},
+	}
+	for _, tt := range tests {
+		records, err := s.Search("lobby", tt.query, tt.limit)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := ids(records); got != tt.want {
+			t.Errorf("Search(%q, %d): got records %s, want %s", tt.query, tt.limit, got, tt.want)
+		}
+	}
+}
+
+func TestACL(t *testing.T) {
+	s := openStore(t)
+	if data, err := s.ACL("private"); data != nil || err != nil {
+		t.Errorf("got ACL %q, %v before storing one", data, err)
+	}
+	for _, acl := range []string{"first", "second"} {
+		if err := s.PutACL("private", []byte(acl)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the last ACL replaces the previous one
+	if data, err := s.ACL("private"); string(data) != "second" || err != nil {
+		t.Errorf("got ACL %q, %v, want %q", data, err, "second")
+	}
+	// the ACL is kept apart from the messages of the room
+	if records, err := s.Last("private", 10); len(records) != 0 || err != nil {
+		t.Errorf("got %d records, %v", len(records), err)
+	}
+	if data, err := s.ACL("other"); data != nil || err != nil {
+		t.Errorf("got ACL %q, %v of another room", data, err)
+	}
+}
+
+func TestPeers(t *testing.T) {
+	s := openStore(t)
+	if peers, err := s.Peers(); len(peers) != 0 || err != nil {
+		t.Errorf("got peers %v, %v before storing any", peers, err)
+	}
+	for _, p := range []struct{ id, data string }{
+		{"alice", "old"},
+		{"bob", "bob"},
+		{"alice", "new"},
+	} {
+		if err := s.PutPeer(p.id, []byte(p.data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	peers, err := s.Peers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(peers) != 2 || string(peers["alice"]) != "new" || string(peers["bob"]) != "bob" {
+		t.Errorf("got peers %q", peers)
+	}
+}
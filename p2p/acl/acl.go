@@ -0,0 +1,132 @@
+package acl
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// signaturePrefix separates the signatures of the lists from the other
+// signatures made with the node identity
+const signaturePrefix = "p2p-chat acl:"
+
+var (
+	// ErrInvalidSignature is returned when a list is not signed by its owner
+	ErrInvalidSignature = errors.New("invalid access control list signature")
+	// ErrNotOwner is returned when a peer other than the owner tries to sign a list
+	ErrNotOwner = errors.New("only the room owner can change its members")
+)
+
+// ACL is the access control list of a restricted room: the members allowed
+// to publish in the room, signed by the owner of the room. It is encoded as
+// JSON on the wire and in the history store.
+type ACL struct {
+	Room    string
+	Owner   string   // peer ID of the owner, always a member
+	Members []string // peer IDs of the members
+	// Seq is incremented on every change, so that peers keep the latest list
+	Seq       uint64
+	Signature []byte `json:",omitempty"`
+}
+
+// New creates the list of a room owned by owner, who is its only member. The
+// list must be signed before it is shared.
+func New(roomName string, owner peer.ID) *ACL {
+	return &ACL{
+		Room:    roomName,
+		Owner:   owner.String(),
+		Members: []string{owner.String()},
+	}
+}
+
+// Decode parses an encoded list and checks its signature
+func Decode(data []byte) (*ACL, error) {
+	a := new(ACL)
+	if err := json.Unmarshal(data, a); err != nil {
+		return nil, fmt.Errorf("invalid access control list: %w", err)
+	}
+	if err := a.Verify(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// Encode serializes the list
+func (a *ACL) Encode() ([]byte, error) {
+	return json.Marshal(a)
+}
+
+// OwnerID returns the peer ID of the owner
+func (a *ACL) OwnerID() (peer.ID, error) {
+	return peer.Decode(a.Owner)
+}
+
+// IsMember reports whether the peer is allowed to publish in the room
+func (a *ACL) IsMember(p peer.ID) bool {
+	return slices.Contains(a.Members, p.String())
+}
+
+// Add returns a copy of the list with the peer added to the members and the
+// sequence number incremented. The copy must be signed again.
+func (a *ACL) Add(p peer.ID) *ACL {
+	next := *a
+	next.Members = append(slices.Clone(a.Members), p.String())
+	next.Seq++
+	next.Signature = nil
+	return &next
+}
+
+// Sign signs the list with the private key of the owner
+func (a *ACL) Sign(key crypto.PrivKey) error {
+	id, err := peer.IDFromPrivateKey(key)
+	if err != nil {
+		return err
+	}
+	if id.String() != a.Owner {
+		return ErrNotOwner
+	}
+	data, err := a.signedData()
+	if err != nil {
+		return err
+	}
+	a.Signature, err = key.Sign(data)
+	return err
+}
+
+// Verify checks the list is signed by its owner, and the owner is a member
+func (a *ACL) Verify() error {
+	owner, err := a.OwnerID()
+	if err != nil {
+		return fmt.Errorf("invalid room owner: %w", err)
+	}
+	if !a.IsMember(owner) {
+		return errors.New("room owner is not a member")
+	}
+	pub, err := owner.ExtractPublicKey()
+	if err != nil {
+		return fmt.Errorf("failed to extract public key of room owner: %w", err)
+	}
+	data, err := a.signedData()
+	if err != nil {
+		return err
+	}
+	if ok, err := pub.Verify(data, a.Signature); err != nil || !ok {
+		return ErrInvalidSignature
+	}
+	return nil
+}
+
+// signedData returns the bytes covered by the signature: the list without its signature
+func (a *ACL) signedData() ([]byte, error) {
+	unsigned := *a
+	unsigned.Signature = nil
+	data, err := json.Marshal(&unsigned)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(signaturePrefix), data...), nil
+}
@@ -0,0 +1,134 @@
+package acl
+
+import (
+	"crypto/rand"
+	"errors"
+	"testing"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+func newKey(t *testing.T) (crypto.PrivKey, peer.ID) {
+	t.Helper()
+	key, _, err := crypto.GenerateEd25519Key(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := peer.IDFromPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key, id
+}
+
+func TestSignVerify(t *testing.T) {
+	ownerKey, owner := newKey(t)
+	_, member := newKey(t)
+
+	a := New("private", owner)
+	if err := a.Sign(ownerKey); err != nil {
+		t.Fatal(err)
+	}
+	next := a.Add(member)
+	if err := next.Sign(ownerKey); err != nil {
+		t.Fatal(err)
+	}
+	if next.Seq != a.Seq+1 {
+		t.Errorf("got seq %d after adding a member, want %d", next.Seq, a.Seq+1)
+	}
+	if a.IsMember(member) || !next.IsMember(member) || !next.IsMember(owner) {
+		t.Error("Add modified the previous list or didn't add the member")
+	}
+
+	data, err := next.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := Decode(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !decoded.IsMember(member) || decoded.Seq != next.Seq {
+		t.Errorf("got %+v, want %+v", decoded, next)
+	}
+}
+
+func TestSignNotOwner(t *testing.T) {
+	_, owner := newKey(t)
+	otherKey, _ := newKey(t)
+	if err := New("private", owner).Sign(otherKey); !errors.Is(err, ErrNotOwner) {
+		t.Errorf("got error %v, want %v", err, ErrNotOwner)
+	}
+}
+
+func TestVerifyErrors(t *testing.T) {
+	ownerKey, owner := newKey(t)
+	malloryKey, mallory := newKey(t)
+	signed := New("private", owner)
+	if err := signed.Sign(ownerKey); err != nil {
+		t.Fatal(err)
+	}
+	// edit returns a copy of the signed list modified by fn
+	edit := func(fn func(a *ACL)) *ACL {
+		a := *signed
+		a.Members = append([]string(nil), signed.Members...)
+		fn(&a)
+		return &a
+	}
+	// selfSigned is a list claiming owner, but signed by mallory as its own
+	selfSigned := edit(func(a *ACL) { a.Owner = mallory.String() })
+	if err := selfSigned.Sign(malloryKey); err != nil {
+		t.Fatal(err)
+	}
+	selfSigned.Owner = owner.String()
+
+	tests := []struct {
+		name    string
+		acl     *ACL
+		wantErr error
+	}{
+		{name: "unsigned", acl: edit(func(a *ACL) { a.Signature = nil }), wantErr: ErrInvalidSignature},
+		{name: "added member", acl: edit(func(a *ACL) { a.Members = append(a.Members, mallory.String()) }), wantErr: ErrInvalidSignature},
+		{name: "bumped seq", acl: edit(func(a *ACL) { a.Seq++ }), wantErr: ErrInvalidSignature},
+		{name: "renamed room", acl: edit(func(a *ACL) { a.Room = "other" }), wantErr: ErrInvalidSignature},
+		{name: "signed by another peer", acl: selfSigned, wantErr: ErrInvalidSignature},
+		{name: "invalid owner", acl: edit(func(a *ACL) { a.Owner = "not a peer ID" })},
+		{name: "owner not a member", acl: edit(func(a *ACL) { a.Members = []string{mallory.String()} })},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.acl.Verify()
+			if err == nil {
+				t.Fatal("expected an error")
+			}
+			if tt.wantErr != nil && !errors.Is(err, tt.wantErr) {
+				t.Errorf("got error %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestDecodeErrors(t *testing.T) {
+	_, owner := newKey(t)
+	unsigned, err := New("private", owner).Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{name: "empty", data: nil},
+		{name: "invalid JSON", data: []byte(`{"Room":`)},
+		{name: "wrong types", data: []byte(`{"Room":"private","Members":"all"}`)},
+		{name: "unsigned", data: unsigned},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if a, err := Decode(tt.data); err == nil {
+				t.Errorf("expected an error, got %+v", a)
+			}
+		})
+	}
+}
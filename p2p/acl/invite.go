@@ -0,0 +1,164 @@
+package acl
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/alejoacosta74/go-logger"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+)
+
+const (
+	// ProtocolID is the stream protocol used to deliver invitations
+	ProtocolID protocol.ID = "/p2p-chat/invite/1.0.0"
+
+	// MaxInvitationSize is the maximum size of an encoded invitation
+	MaxInvitationSize = 256 * 1024
+
+	// StreamTimeout bounds the time spent sending an invitation and waiting for its acknowledgement
+	StreamTimeout = 10 * time.Second
+
+	// inboxSize is the number of incoming invitations to buffer
+	inboxSize = 16
+)
+
+// Invitation is sent by the owner of a restricted room to a new member. It is
+// encoded as JSON on the stream.
+type Invitation struct {
+	// ACL is the signed list of the room, including the invited peer
+	ACL *ACL
+	// Encrypted tells the room is end-to-end encrypted, in which case the
+	// passphrase must be shared out of band
+	Encrypted  bool
+	SenderNick string
+}
+
+// Ack is written back by the invited peer once the invitation has been received.
+type Ack struct {
+	Error string `json:",omitempty"`
+}
+
+// Service sends and receives invitations over the ProtocolID stream protocol.
+type Service struct {
+	host host.Host
+	ctx  context.Context
+
+	inboundChan chan *Invitation // invitations received from room owners
+}
+
+// NewService registers the invitation protocol handler on the host.
+func NewService(ctx context.Context, h host.Host) *Service {
+	s := &Service{
+		host:        h,
+		ctx:         ctx,
+		inboundChan: make(chan *Invitation, inboxSize),
+	}
+	h.SetStreamHandler(ProtocolID, s.handleStream)
+	return s
+}
+
+// Close removes the protocol handler from the host.
+func (s *Service) Close() {
+	s.host.RemoveStreamHandler(ProtocolID)
+}
+
+// Invitations returns the channel of invitations received from room owners.
+// The lists they carry are verified, and include this peer.
+func (s *Service) Invitations() <-chan *Invitation {
+	return s.inboundChan
+}
+
+// Send delivers the invitation to the peer and waits for its acknowledgement.
+func (s *Service) Send(ctx context.Context, p peer.ID, inv *Invitation) error {
+	ctx, cancel := context.WithTimeout(ctx, StreamTimeout)
+	defer cancel()
+
+	str, err := s.host.NewStream(ctx, p, ProtocolID)
+	if err != nil {
+		return fmt.Errorf("failed to open stream to %s: %w", p, err)
+	}
+	defer str.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		str.SetDeadline(deadline)
+	}
+
+	if err := json.NewEncoder(str).Encode(inv); err != nil {
+		str.Reset()
+		return fmt.Errorf("failed to send invitation: %w", err)
+	}
+	if err := str.CloseWrite(); err != nil {
+		str.Reset()
+		return fmt.Errorf("failed to send invitation: %w", err)
+	}
+
+	ack := new(Ack)
+	if err := json.NewDecoder(io.LimitReader(str, MaxInvitationSize)).Decode(ack); err != nil {
+		str.Reset()
+		return fmt.Errorf("no acknowledgement: %w", err)
+	}
+	if ack.Error != "" {
+		return fmt.Errorf("invitation rejected: %s", ack.Error)
+	}
+	return nil
+}
+
+// handleStream reads an invitation from the remote peer, checks it was sent
+// by the owner of the room, delivers it to the inbound channel and writes
+// back the acknowledgement.
+func (s *Service) handleStream(str network.Stream) {
+	defer str.Close()
+	str.SetDeadline(time.Now().Add(StreamTimeout))
+	from := str.Conn().RemotePeer()
+
+	inv := new(Invitation)
+	if err := json.NewDecoder(io.LimitReader(str, MaxInvitationSize)).Decode(inv); err != nil {
+		logger.Debugf("failed to read invitation from %s: %v", from, err)
+		str.Reset()
+		return
+	}
+
+	ack := new(Ack)
+	if err := s.check(from, inv); err != nil {
+		logger.Debugf("rejecting invitation from %s: %v", from, err)
+		ack.Error = err.Error()
+	} else {
+		select {
+		case s.inboundChan <- inv:
+		case <-s.ctx.Done():
+			str.Reset()
+			return
+		default:
+			ack.Error = "inbox full"
+		}
+	}
+
+	if err := json.NewEncoder(str).Encode(ack); err != nil {
+		logger.Debugf("failed to acknowledge invitation from %s: %v", from, err)
+		str.Reset()
+	}
+}
+
+// check verifies the invitation was sent by the owner of the room, and lists this peer as a member
+func (s *Service) check(from peer.ID, inv *Invitation) error {
+	if inv.ACL == nil {
+		return errors.New("missing access control list")
+	}
+	if err := inv.ACL.Verify(); err != nil {
+		return err
+	}
+	// the remote peer is authenticated by the secure channel
+	if inv.ACL.Owner != from.String() {
+		return ErrNotOwner
+	}
+	if !inv.ACL.IsMember(s.host.ID()) {
+		return errors.New("invitation does not list us as a member")
+	}
+	return nil
+}
@@ -1,6 +1,21 @@
 package discovery
 
-import "time"
+import (
+	"fmt"
+	"time"
+
+	dht "github.com/libp2p/go-libp2p-kad-dht"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+// DHT modes, see DiscoveryConfig.DHTMode
+const (
+	DHTModeAuto   = "auto"
+	DHTModeClient = "client"
+	DHTModeServer = "server"
+)
 
 // DiscoveryConfig holds common configuration for peer discovery
 type DiscoveryConfig struct {
@@ -10,13 +25,91 @@ type DiscoveryConfig struct {
 	RetryTimeout time.Duration
 	// MaxPeers is the maximum number of peers to discover
 	MaxPeers int
+	// DHTMode is the mode of the DHT: auto (server only when publicly
+	// reachable), client or server
+	DHTMode string
+	// DHTProtocolPrefix isolates the DHT from the public IPFS one when set,
+	// e.g. /myteam. Only the peers using the same prefix take part in it.
+	DHTProtocolPrefix string
+	// BootstrapPeers are the multiaddrs, including the peer ID, of the peers
+	// used to join the DHT. The public IPFS bootstrap peers are used if empty.
+	BootstrapPeers []string
+	// BootstrapTimeout is how long to wait for the connection to each bootstrap peer
+	BootstrapTimeout time.Duration
 }
 
 // NewDiscoveryConfig creates a default discovery configuration
 func NewDiscoveryConfig() *DiscoveryConfig {
 	return &DiscoveryConfig{
-		ServiceTag:   "pubsub-chat-example",
-		RetryTimeout: time.Second * 10,
-		MaxPeers:     10,
+		ServiceTag:       "pubsub-chat-example",
+		RetryTimeout:     time.Second * 10,
+		MaxPeers:         10,
+		DHTMode:          DHTModeAuto,
+		BootstrapTimeout: time.Second * 15,
+	}
+}
+
+// Validate checks the configuration before the discovery services are started
+func (c *DiscoveryConfig) Validate() error {
+	if _, err := c.dhtMode(); err != nil {
+		return err
+	}
+	_, err := c.bootstrapPeers()
+	return err
+}
+
+// dhtOptions returns the options of the DHT
+func (c *DiscoveryConfig) dhtOptions() ([]dht.Option, error) {
+	mode, err := c.dhtMode()
+	if err != nil {
+		return nil, err
+	}
+	peers, err := c.bootstrapPeers()
+	if err != nil {
+		return nil, err
+	}
+	opts := []dht.Option{dht.Mode(mode), dht.BootstrapPeers(peers...)}
+	if c.DHTProtocolPrefix != "" {
+		opts = append(opts, dht.ProtocolPrefix(protocol.ID(c.DHTProtocolPrefix)))
+	}
+	return opts, nil
+}
+
+// bootstrapPeers parses the configured bootstrap peers, merging the addresses
+// of the same peer. It returns the public IPFS bootstrap peers if none are
+// configured and the DHT is not isolated by a protocol prefix.
+func (c *DiscoveryConfig) bootstrapPeers() ([]peer.AddrInfo, error) {
+	if len(c.BootstrapPeers) == 0 {
+		if c.DHTProtocolPrefix != "" {
+			return nil, nil
+		}
+		return peer.AddrInfosFromP2pAddrs(dht.DefaultBootstrapPeers...)
+	}
+	addrs := make([]ma.Multiaddr, 0, len(c.BootstrapPeers))
+	for _, s := range c.BootstrapPeers {
+		addr, err := ma.NewMultiaddr(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid bootstrap peer %q: %w", s, err)
+		}
+		addrs = append(addrs, addr)
+	}
+	peers, err := peer.AddrInfosFromP2pAddrs(addrs...)
+	if err != nil {
+		return nil, fmt.Errorf("invalid bootstrap peer: %w", err)
+	}
+	return peers, nil
+}
+
+// dhtMode converts the configured DHT mode into the DHT option value
+func (c *DiscoveryConfig) dhtMode() (dht.ModeOpt, error) {
+	switch c.DHTMode {
+	case DHTModeAuto, "":
+		return dht.ModeAuto, nil
+	case DHTModeClient:
+		return dht.ModeClient, nil
+	case DHTModeServer:
+		return dht.ModeServer, nil
+	default:
+		return 0, fmt.Errorf("unknown DHT mode %q", c.DHTMode)
 	}
 }
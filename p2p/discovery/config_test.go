@@ -0,0 +1,125 @@
+package discovery
+
+import (
+	"testing"
+
+	dht "github.com/libp2p/go-libp2p-kad-dht"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+func TestDHTMode(t *testing.T) {
+	tests := []struct {
+		mode    string
+		want    dht.ModeOpt
+		wantErr bool
+	}{
+		{mode: "", want: dht.ModeAuto},
+		{mode: DHTModeAuto, want: dht.ModeAuto},
+		{mode: DHTModeClient, want: dht.ModeClient},
+		{mode: DHTModeServer, want: dht.ModeServer},
+		{mode: "Server", wantErr: true},
+		{mode: "relay", wantErr: true},
+	}
+	for _, tt := range tests {
+		c := NewDiscoveryConfig()
+		c.DHTMode = tt.mode
+		got, err := c.dhtMode()
+		if (err != nil) != tt.wantErr {
+			t.Errorf("dhtMode(%q): got error %v, want error %v", tt.mode, err, tt.wantErr)
+		}
+		if err == nil && got != tt.want {
+			t.Errorf("dhtMode(%q): got %v, want %v", tt.mode, got, tt.want)
+		}
+		if err := c.Validate(); (err != nil) != tt.wantErr {
+			t.Errorf("Validate with mode %q: got error %v, want error %v", tt.mode, err, tt.wantErr)
+		}
+	}
+}
+
+func TestBootstrapPeers(t *testing.T) {
+	const (
+		alice = "12D3KooWJWoaqZhDaoEFshF7Rh1bpY9ohihFhzcW6d69Lr2NASuq"
+		bob   = "12D3KooWNTZX4oNhFNGKVpmvnKTKbpEQvNTWvGB7LkxqHHZ1vo9N"
+	)
+	publicPeers, err := peer.AddrInfosFromP2pAddrs(dht.DefaultBootstrapPeers...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		peers   []string
+		prefix  string
+		want    map[string]int // number of addresses of each peer
+		wantErr bool
+	}{
+		{name: "public", want: addrCounts(publicPeers)},
+		{name: "prefix without peers", prefix: "/myteam", want: map[string]int{}},
+		{
+			name:  "merged addresses",
+			peers: []string{"/ip4/10.0.0.1/tcp/4001/p2p/" + alice, "/ip4/10.0.0.1/udp/4001/quic-v1/p2p/" + alice, "/dns4/bob.example.com/tcp/4001/p2p/" + bob},
+			want:  map[string]int{alice: 2, bob: 1},
+		},
+		{
+			name:   "prefix with peers",
+			peers:  []string{"/ip4/10.0.0.1/tcp/4001/p2p/" + alice},
+			prefix: "/myteam",
+			want:   map[string]int{alice: 1},
+		},
+		{name: "invalid address", peers: []string{"10.0.0.1:4001"}, wantErr: true},
+		{name: "missing peer ID", peers: []string{"/ip4/10.0.0.1/tcp/4001"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := NewDiscoveryConfig()
+			c.BootstrapPeers = tt.peers
+			c.DHTProtocolPrefix = tt.prefix
+			peers, err := c.bootstrapPeers()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want error %v", err, tt.wantErr)
+			}
+			if err := c.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("Validate: got error %v, want error %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			got := addrCounts(peers)
+			if len(got) != len(tt.want) {
+				t.Fatalf("got peers %v, want %v", got, tt.want)
+			}
+			for id, n := range tt.want {
+				if got[id] != n {
+					t.Errorf("got %d addresses of %s, want %d", got[id], id, n)
+				}
+			}
+		})
+	}
+}
+
+func TestDHTOptions(t *testing.T) {
+	c := NewDiscoveryConfig()
+	c.DHTProtocolPrefix = "/myteam"
+	opts, err := c.dhtOptions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// mode, bootstrap peers and protocol prefix
+	if len(opts) != 3 {
+		t.Errorf("got %d options, want 3", len(opts))
+	}
+
+	c.DHTMode = "relay"
+	if _, err := c.dhtOptions(); err == nil {
+		t.Error("expected an error with an unknown DHT mode")
+	}
+}
+
+// addrCounts returns the number of addresses of each peer
+func addrCounts(peers []peer.AddrInfo) map[string]int {
+	counts := make(map[string]int, len(peers))
+	for _, p := range peers {
+		counts[p.ID.String()] = len(p.Addrs)
+	}
+	return counts
+}
@@ -35,12 +35,21 @@ func NewDHTDiscovery(h host.Host, config *DiscoveryConfig) *DHTDiscovery {
 	}
 }
 
+// Name implements the PeerDiscovery interface
+func (d *DHTDiscovery) Name() string {
+	return "dht"
+}
+
 // Start initializes the DHT and begins peer discovery
 func (d *DHTDiscovery) Start(ctx context.Context) error {
 	d.ctx, d.cancel = context.WithCancel(ctx)
 
 	// Initialize the DHT
-	kadDHT, err := dht.New(d.ctx, d.host)
+	opts, err := d.config.dhtOptions()
+	if err != nil {
+		return err
+	}
+	kadDHT, err := dht.New(d.ctx, d.host, opts...)
 	if err != nil {
 		return fmt.Errorf("failed to create DHT: %w", err)
 	}
@@ -61,29 +70,39 @@ func (d *DHTDiscovery) Start(ctx context.Context) error {
 	return nil
 }
 
-// bootstrap connects to the default bootstrap peers
+// bootstrap connects to the bootstrap peers, waiting at most
+// BootstrapTimeout for each of them
 func (d *DHTDiscovery) bootstrap() error {
 	if err := d.dht.Bootstrap(d.ctx); err != nil {
 		return fmt.Errorf("failed to bootstrap DHT: %w", err)
 	}
 
-	var wg sync.WaitGroup
-	for _, peerAddr := range dht.DefaultBootstrapPeers {
-		peerInfo, err := peer.AddrInfoFromP2pAddr(peerAddr)
-		if err != nil {
-			logger.Errorf("failed to parse bootstrap peer address: %v", err)
-			continue
-		}
+	peers, err := d.config.bootstrapPeers()
+	if err != nil {
+		return err
+	}
+	if len(peers) == 0 {
+		logger.Warn("no DHT bootstrap peers configured, only peers on the local network will be found")
+		return nil
+	}
 
+	timeout := d.config.BootstrapTimeout
+	if timeout <= 0 {
+		timeout = NewDiscoveryConfig().BootstrapTimeout
+	}
+	var wg sync.WaitGroup
+	for _, pi := range peers {
 		wg.Add(1)
-		go func(pi *peer.AddrInfo) {
+		go func(pi peer.AddrInfo) {
 			defer wg.Done()
-			if err := d.host.Connect(d.ctx, *pi); err != nil {
+			ctx, cancel := context.WithTimeout(d.ctx, timeout)
+			defer cancel()
+			if err := d.host.Connect(ctx, pi); err != nil {
 				logger.Debugf("failed to connect to bootstrap peer %s: %s", pi.ID, err)
 			} else {
 				logger.Infof("connected to bootstrap peer: %s", pi.ID)
 			}
-		}(peerInfo)
+		}(pi)
 	}
 	wg.Wait()
 
@@ -128,7 +147,7 @@ func (d *DHTDiscovery) DiscoverPeers(ctx context.Context) (<-chan peer.AddrInfo,
 				peers, err := d.discovery.FindPeers(ctx, d.config.ServiceTag)
 				if err != nil {
 					logger.Errorf("failed to find peers: %v", err)
-					time.Sleep(d.config.RetryTimeout)
+					d.wait(ctx)
 					continue
 				}
 
@@ -149,10 +168,21 @@ func (d *DHTDiscovery) DiscoverPeers(ctx context.Context) (<-chan peer.AddrInfo,
 				}
 
 				// Wait before next discovery attempt
-				time.Sleep(d.config.RetryTimeout)
+				d.wait(ctx)
 			}
 		}
 	}()
 
 	return peerChan, nil
 }
+
+// wait pauses between discovery attempts, returning early if the discovery is stopped
+func (d *DHTDiscovery) wait(ctx context.Context) {
+	timer := time.NewTimer(d.config.RetryTimeout)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-ctx.Done():
+	case <-d.ctx.Done():
+	}
+}
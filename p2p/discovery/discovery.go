@@ -8,6 +8,8 @@ import (
 
 // PeerDiscovery defines the interface for peer discovery mechanisms
 type PeerDiscovery interface {
+	// Name identifies the discovery mechanism, e.g. in metrics
+	Name() string
 	// Start begins the peer discovery process
 	Start(context.Context) error
 	// Stop halts the peer discovery process
@@ -2,6 +2,7 @@ package discovery
 
 import (
 	"context"
+	"fmt"
 	"runtime/debug"
 	"sync"
 	"time"
@@ -25,6 +26,7 @@ type MDNSDiscovery struct {
 	ctx    context.Context
 	// Channel to receive discovered peers from HandlePeerFound
 	peerChan chan peer.AddrInfo
+	service  mdns.Service
 	cancel   context.CancelFunc
 	wg       sync.WaitGroup
 }
@@ -44,6 +46,11 @@ func NewMDNSDiscovery(h host.Host, config *DiscoveryConfig) *MDNSDiscovery {
 	}
 }
 
+// Name implements the PeerDiscovery interface
+func (d *MDNSDiscovery) Name() string {
+	return "mdns"
+}
+
 func (d *MDNSDiscovery) Start(ctx context.Context) error {
 	discoveryNotifee := &discoveryNotifee{
 		h:       d.host,
@@ -51,13 +58,19 @@ func (d *MDNSDiscovery) Start(ctx context.Context) error {
 		retries: DefaultRetries,
 		md:      d,
 	}
-	discovery := mdns.NewMdnsService(d.host, d.config.ServiceTag, discoveryNotifee)
-	return discovery.Start()
+	d.service = mdns.NewMdnsService(d.host, d.config.ServiceTag, discoveryNotifee)
+	return d.service.Start()
 }
 
+// Stop shuts down the mDNS service and waits for the discovered peers to be forwarded
 func (d *MDNSDiscovery) Stop() error {
 	d.cancel()
 	d.wg.Wait()
+	if d.service != nil {
+		if err := d.service.Close(); err != nil {
+			return fmt.Errorf("failed to close mDNS service: %w", err)
+		}
+	}
 	return nil
 }
 
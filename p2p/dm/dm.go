@@ -0,0 +1,176 @@
+package dm
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/alejoacosta74/go-logger"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+)
+
+const (
+	// ProtocolID is the stream protocol used to exchange direct messages
+	ProtocolID protocol.ID = "/p2p-chat/dm/1.0.0"
+
+	// MaxMessageSize is the maximum size of an encoded direct message
+	MaxMessageSize = 64 * 1024
+
+	// StreamTimeout bounds the time spent sending a message and waiting for its acknowledgement
+	StreamTimeout = 10 * time.Second
+
+	// inboxSize is the number of incoming direct messages to buffer
+	inboxSize = 32
+)
+
+// Message is a direct message sent to a single peer. It is encoded as JSON
+// on the stream.
+type Message struct {
+	ID         string
+	Message    string
+	SenderID   string
+	SenderNick string
+	Timestamp  int64
+}
+
+// Ack is written back by the receiver once the message has been delivered.
+type Ack struct {
+	ID    string
+	Error string `json:",omitempty"`
+}
+
+// Service sends and receives direct messages over the ProtocolID stream protocol.
+type Service struct {
+	host host.Host
+	ctx  context.Context
+
+	mu   sync.RWMutex
+	nick string
+
+	inboundChan chan *Message // direct messages received from other peers
+}
+
+// NewService registers the direct message protocol handler on the host.
+func NewService(ctx context.Context, h host.Host, nickname string) *Service {
+	s := &Service{
+		host:        h,
+		ctx:         ctx,
+		nick:        nickname,
+		inboundChan: make(chan *Message, inboxSize),
+	}
+	h.SetStreamHandler(ProtocolID, s.handleStream)
+	return s
+}
+
+// Close removes the protocol handler from the host.
+func (s *Service) Close() {
+	s.host.RemoveStreamHandler(ProtocolID)
+}
+
+// SetNick changes the nickname sent with the direct messages
+func (s *Service) SetNick(nick string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.nick = nick
+}
+
+// Messages returns the channel of direct messages received from other peers.
+func (s *Service) Messages() <-chan *Message {
+	return s.inboundChan
+}
+
+// Send delivers a direct message to the peer and waits for its acknowledgement.
+func (s *Service) Send(ctx context.Context, p peer.ID, text string) (*Message, error) {
+	s.mu.RLock()
+	nick := s.nick
+	s.mu.RUnlock()
+
+	msg := &Message{
+		ID:         newMessageID(),
+		Message:    text,
+		SenderID:   s.host.ID().String(),
+		SenderNick: nick,
+		Timestamp:  time.Now().UnixMilli(),
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, StreamTimeout)
+	defer cancel()
+
+	str, err := s.host.NewStream(ctx, p, ProtocolID)
+	if err != nil {
+		return msg, fmt.Errorf("failed to open stream to %s: %w", p, err)
+	}
+	defer str.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		str.SetDeadline(deadline)
+	}
+
+	if err := json.NewEncoder(str).Encode(msg); err != nil {
+		str.Reset()
+		return msg, fmt.Errorf("failed to send message: %w", err)
+	}
+	if err := str.CloseWrite(); err != nil {
+		str.Reset()
+		return msg, fmt.Errorf("failed to send message: %w", err)
+	}
+
+	ack := new(Ack)
+	if err := json.NewDecoder(io.LimitReader(str, MaxMessageSize)).Decode(ack); err != nil {
+		str.Reset()
+		return msg, fmt.Errorf("no delivery acknowledgement: %w", err)
+	}
+	if ack.ID != msg.ID {
+		return msg, errors.New("acknowledgement does not match the message")
+	}
+	if ack.Error != "" {
+		return msg, fmt.Errorf("message rejected: %s", ack.Error)
+	}
+	return msg, nil
+}
+
+// handleStream reads a direct message from the remote peer, delivers it to
+// the inbound channel and writes back the acknowledgement.
+func (s *Service) handleStream(str network.Stream) {
+	defer str.Close()
+	str.SetDeadline(time.Now().Add(StreamTimeout))
+
+	msg := new(Message)
+	if err := json.NewDecoder(io.LimitReader(str, MaxMessageSize)).Decode(msg); err != nil {
+		logger.Debugf("failed to read direct message from %s: %v", str.Conn().RemotePeer(), err)
+		str.Reset()
+		return
+	}
+	// the remote peer is authenticated by the secure channel, don't trust the declared sender
+	msg.SenderID = str.Conn().RemotePeer().String()
+
+	ack := &Ack{ID: msg.ID}
+	select {
+	case s.inboundChan <- msg:
+	case <-s.ctx.Done():
+		str.Reset()
+		return
+	default:
+		ack.Error = "inbox full"
+	}
+
+	if err := json.NewEncoder(str).Encode(ack); err != nil {
+		logger.Debugf("failed to acknowledge direct message from %s: %v", msg.SenderID, err)
+		str.Reset()
+	}
+}
+
+// newMessageID returns a random message identifier
+func newMessageID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,136 @@
+package dm
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/host"
+	mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
+)
+
+// newPair returns two connected hosts running the direct message service
+func newPair(t *testing.T, ctx context.Context) (alice, bob host.Host, aliceSvc, bobSvc *Service) {
+	t.Helper()
+	mn, err := mocknet.FullMeshConnected(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { mn.Close() })
+	alice, bob = mn.Hosts()[0], mn.Hosts()[1]
+	aliceSvc, bobSvc = NewService(ctx, alice, "alice"), NewService(ctx, bob, "bob")
+	t.Cleanup(aliceSvc.Close)
+	t.Cleanup(bobSvc.Close)
+	return alice, bob, aliceSvc, bobSvc
+}
+
+func TestSendReceive(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	alice, bob, aliceSvc, bobSvc := newPair(t, ctx)
+
+	sent, err := aliceSvc.Send(ctx, bob.ID(), "hello bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sent.SenderID != alice.ID().String() || sent.SenderNick != "alice" || sent.ID == "" {
+		t.Errorf("got sent message %+v", sent)
+	}
+	select {
+	case got := <-bobSvc.Messages():
+		if *got != *sent {
+			t.Errorf("got %+v, want %+v", got, sent)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("message not received")
+	}
+
+	// the nickname is changed for the next messages
+	bobSvc.SetNick("robert")
+	if sent, err = bobSvc.Send(ctx, alice.ID(), "hi alice"); err != nil {
+		t.Fatal(err)
+	}
+	if got := <-aliceSvc.Messages(); got.SenderNick != "robert" || got.Message != "hi alice" {
+		t.Errorf("got %+v, want %+v", got, sent)
+	}
+}
+
+func TestForgedSender(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	alice, bob, _, bobSvc := newPair(t, ctx)
+
+	str, err := alice.NewStream(ctx, bob.ID(), ProtocolID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer str.Close()
+	msg := &Message{ID: "1", Message: "hello", SenderID: bob.ID().String(), SenderNick: "bob"}
+	if err := json.NewEncoder(str).Encode(msg); err != nil {
+		t.Fatal(err)
+	}
+	str.CloseWrite()
+	ack := new(Ack)
+	if err := json.NewDecoder(str).Decode(ack); err != nil || ack.ID != "1" || ack.Error != "" {
+		t.Fatalf("got acknowledgement %+v, %v", ack, err)
+	}
+	// the sender is the authenticated remote peer
+	if got := <-bobSvc.Messages(); got.SenderID != alice.ID().String() {
+		t.Errorf("got sender %s, want %s", got.SenderID, alice.ID())
+	}
+}
+
+func TestInvalidMessages(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	alice, bob, _, bobSvc := newPair(t, ctx)
+
+	tests := []struct {
+		name string
+		data string
+	}{
+		{name: "oversize", data: `{"ID":"1","Message":"` + strings.Repeat("a", MaxMessageSize) + `"}`},
+		{name: "invalid JSON", data: `{"ID":`},
+		{name: "wrong types", data: `{"ID":1,"Message":"hello"}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			str, err := alice.NewStream(ctx, bob.ID(), ProtocolID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer str.Close()
+			str.SetDeadline(time.Now().Add(5 * time.Second))
+			// the stream may be reset before the whole message is written
+			str.Write([]byte(tt.data))
+			str.CloseWrite()
+			if resp, err := io.ReadAll(str); err == nil && len(resp) > 0 {
+				t.Errorf("got acknowledgement %q", resp)
+			}
+		})
+	}
+	select {
+	case got := <-bobSvc.Messages():
+		t.Errorf("got message %+v", got)
+	default:
+	}
+}
+
+func TestInboxFull(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	_, bob, aliceSvc, _ := newPair(t, ctx)
+
+	// nobody reads the messages of bob
+	for i := 0; i < inboxSize; i++ {
+		if _, err := aliceSvc.Send(ctx, bob.ID(), "hello"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := aliceSvc.Send(ctx, bob.ID(), "hello"); err == nil || !strings.Contains(err.Error(), "inbox full") {
+		t.Errorf("got error %v, want inbox full", err)
+	}
+}
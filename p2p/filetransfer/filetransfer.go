@@ -0,0 +1,415 @@
+package filetransfer
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/alejoacosta74/go-logger"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+)
+
+const (
+	// ProtocolID is the stream protocol used to fetch the shared files
+	ProtocolID protocol.ID = "/p2p-chat/file/1.0.0"
+
+	// ChunkSize is the size of the chunks the files are sent in
+	ChunkSize = 64 * 1024
+
+	// MaxHeaderSize is the maximum size of an encoded request or response header
+	MaxHeaderSize = 4 * 1024
+
+	// ChunkTimeout bounds the time spent waiting for each chunk
+	ChunkTimeout = 30 * time.Second
+
+	// DefaultDir is the name of the download directory inside the default config directory
+	DefaultDir = "downloads"
+
+	// partSuffix is appended to the name of the files being downloaded
+	partSuffix = ".part"
+)
+
+var (
+	// ErrNotShared is returned when requesting a file the peer does not share
+	ErrNotShared = errors.New("file not shared")
+	// ErrHashMismatch is returned when a downloaded file does not match the hash of its offer
+	ErrHashMismatch = errors.New("downloaded file does not match its hash")
+)
+
+// Offer describes a file shared in a room. It is published in the room,
+// while the file itself is fetched from the sender over the ProtocolID
+// stream protocol.
+type Offer struct {
+	Name string
+	Size int64
+	// Hash is the hex encoded SHA-256 of the file, which identifies it
+	Hash string
+}
+
+// ShortID returns a short identifier of the offer, used to refer to it in commands
+func (o *Offer) ShortID() string {
+	if len(o.Hash) < 8 {
+		return o.Hash
+	}
+	return o.Hash[:8]
+}
+
+// Validate checks the offer received from another peer. The hash must be a
+// SHA-256 in lowercase hex, as it names the partial file of the download, and
+// the name must be printable UTF-8 text, as it is shown to the user. Format
+// characters are refused too, as a right-to-left override would show
+// "invoice\u202Efdp.exe" as invoiceexe.pdf.
+func (o *Offer) Validate() error {
+	if o.Name == "" {
+		return errors.New("missing file name")
+	}
+	if !utf8.ValidString(o.Name) || strings.IndexFunc(o.Name, unprintable) >= 0 {
+		return fmt.Errorf("invalid file name %q", o.Name)
+	}
+	if o.Size < 0 {
+		return fmt.Errorf("invalid file size %d", o.Size)
+	}
+	hash, err := hex.DecodeString(o.Hash)
+	if err != nil || len(hash) != sha256.Size || hex.EncodeToString(hash) != o.Hash {
+		return fmt.Errorf("invalid file hash %q", o.Hash)
+	}
+	return nil
+}
+
+// unprintable reports whether r is a control or a format character
+func unprintable(r rune) bool {
+	return unicode.Is(unicode.Cf, r) || !unicode.IsGraphic(r)
+}
+
+// request is written by the downloader, asking for the file from the given offset
+type request struct {
+	Hash   string
+	Offset int64
+}
+
+// response is written back by the sharing peer, followed by the bytes of the file
+type response struct {
+	Size  int64
+	Error string `json:",omitempty"`
+}
+
+// DefaultPath returns the default directory the files are downloaded to
+func DefaultPath() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return DefaultDir
+	}
+	return filepath.Join(dir, "p2p-chat", DefaultDir)
+}
+
+// Progress is called while downloading a file, with the number of bytes received so far
+type Progress func(received, total int64)
+
+// Service shares local files with the other peers, and downloads the files they share.
+type Service struct {
+	host      host.Host
+	authorize func(hash string, p peer.ID) error
+
+	mu     sync.RWMutex
+	shared map[string]string // paths of the shared files, keyed by hash
+}
+
+// NewService registers the file transfer protocol handler on the host. A
+// shared file is only served when authorize returns nil for its hash and the
+// requesting peer, so that the files offered in a room are only served to the
+// peers that can read it.
+func NewService(h host.Host, authorize func(hash string, p peer.ID) error) *Service {
+	s := &Service{
+		host:      h,
+		authorize: authorize,
+		shared:    make(map[string]string),
+	}
+	h.SetStreamHandler(ProtocolID, s.handleStream)
+	return s
+}
+
+// Close removes the protocol handler from the host.
+func (s *Service) Close() {
+	s.host.RemoveStreamHandler(ProtocolID)
+}
+
+// Share hashes the file at path and makes it available to the other peers
+// until the service is closed. It returns the offer to publish.
+func (s *Service) Share(path string) (*Offer, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if !info.Mode().IsRegular() {
+		return nil, fmt.Errorf("%s is not a regular file", path)
+	}
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return nil, fmt.Errorf("failed to hash %s: %w", path, err)
+	}
+
+	offer := &Offer{
+		Name: filepath.Base(path),
+		Size: info.Size(),
+		Hash: hex.EncodeToString(h.Sum(nil)),
+	}
+	s.mu.Lock()
+	s.shared[offer.Hash] = path
+	s.mu.Unlock()
+	return offer, nil
+}
+
+// Fetch downloads the offered file from the peer into dir, and returns its
+// path. If dir is empty the default directory is used. The bytes are
+// appended to a partial file, so that an interrupted download resumes where
+// it stopped when fetched again. The file is only renamed to its final name
+// once its hash has been verified.
+func (s *Service) Fetch(ctx context.Context, p peer.ID, offer *Offer, dir string, progress Progress) (string, error) {
+	if err := offer.Validate(); err != nil {
+		return "", err
+	}
+	name := filepath.Base(offer.Name)
+	if name == "." || name == ".." || name == string(filepath.Separator) {
+		return "", fmt.Errorf("invalid file name %q", offer.Name)
+	}
+	if dir == "" {
+		dir = DefaultPath()
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return "", fmt.Errorf("failed to create download directory: %w", err)
+	}
+	partPath := filepath.Join(dir, offer.Hash+partSuffix)
+	f, err := os.OpenFile(partPath, os.O_RDWR|os.O_CREATE, 0o600)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	offset, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return "", err
+	}
+	if offset > offer.Size {
+		// not the file we expect, start over
+		if err := f.Truncate(0); err != nil {
+			return "", err
+		}
+		offset, _ = f.Seek(0, io.SeekStart)
+	}
+
+	if offset < offer.Size {
+		if err := s.download(ctx, p, offer, f, offset, progress); err != nil {
+			return "", err
+		}
+	}
+
+	// verify the whole file, including the bytes of the previous attempts
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	if hex.EncodeToString(h.Sum(nil)) != offer.Hash {
+		f.Close()
+		os.Remove(partPath)
+		return "", ErrHashMismatch
+	}
+	if err := f.Close(); err != nil {
+		return "", err
+	}
+	path := availablePath(filepath.Join(dir, name))
+	if err := os.Rename(partPath, path); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+// download appends the bytes of the file from offset to f
+func (s *Service) download(ctx context.Context, p peer.ID, offer *Offer, f *os.File, offset int64, progress Progress) error {
+	str, err := s.host.NewStream(ctx, p, ProtocolID)
+	if err != nil {
+		return fmt.Errorf("failed to open stream to %s: %w", p, err)
+	}
+	defer str.Close()
+	// unblock the reads when the download is cancelled
+	stop := context.AfterFunc(ctx, func() { str.Reset() })
+	defer stop()
+
+	str.SetDeadline(time.Now().Add(ChunkTimeout))
+	if err := json.NewEncoder(str).Encode(&request{Hash: offer.Hash, Offset: offset}); err != nil {
+		str.Reset()
+		return fmt.Errorf("failed to request file: %w", err)
+	}
+	if err := str.CloseWrite(); err != nil {
+		str.Reset()
+		return fmt.Errorf("failed to request file: %w", err)
+	}
+
+	// the header is followed by the file, so read it byte by byte to not consume the file
+	resp := new(response)
+	header, err := readLine(str, MaxHeaderSize)
+	if err == nil {
+		err = json.Unmarshal(header, resp)
+	}
+	if err != nil {
+		str.Reset()
+		return fmt.Errorf("invalid response: %w", err)
+	}
+	if resp.Error != "" {
+		return errors.New(resp.Error)
+	}
+	if resp.Size != offer.Size {
+		str.Reset()
+		return fmt.Errorf("file size %d does not match the offer", resp.Size)
+	}
+
+	buf := make([]byte, ChunkSize)
+	received := offset
+	for received < offer.Size {
+		str.SetReadDeadline(time.Now().Add(ChunkTimeout))
+		n, err := io.ReadFull(str, buf[:min(int64(len(buf)), offer.Size-received)])
+		if n > 0 {
+			if _, err := f.Write(buf[:n]); err != nil {
+				str.Reset()
+				return err
+			}
+			received += int64(n)
+			if progress != nil {
+				progress(received, offer.Size)
+			}
+		}
+		if err != nil {
+			str.Reset()
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return fmt.Errorf("transfer interrupted at %d of %d bytes: %w", received, offer.Size, err)
+		}
+	}
+	return nil
+}
+
+// handleStream serves a shared file to the remote peer, from the requested offset
+func (s *Service) handleStream(str network.Stream) {
+	defer str.Close()
+	from := str.Conn().RemotePeer()
+	str.SetDeadline(time.Now().Add(ChunkTimeout))
+
+	req := new(request)
+	if err := json.NewDecoder(io.LimitReader(str, MaxHeaderSize)).Decode(req); err != nil {
+		logger.Debugf("failed to read file request from %s: %v", from, err)
+		str.Reset()
+		return
+	}
+
+	s.mu.RLock()
+	path, ok := s.shared[req.Hash]
+	s.mu.RUnlock()
+	if !ok {
+		s.writeResponse(str, &response{Error: ErrNotShared.Error()})
+		return
+	}
+	if err := s.authorize(req.Hash, from); err != nil {
+		logger.Debugf("refusing to send %s to %s: %v", filepath.Base(path), from, err)
+		s.writeResponse(str, &response{Error: err.Error()})
+		return
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		s.writeResponse(str, &response{Error: "file no longer available"})
+		return
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil || req.Offset < 0 || req.Offset > info.Size() {
+		s.writeResponse(str, &response{Error: "invalid offset"})
+		return
+	}
+	if _, err := f.Seek(req.Offset, io.SeekStart); err != nil {
+		str.Reset()
+		return
+	}
+	if !s.writeResponse(str, &response{Size: info.Size()}) {
+		return
+	}
+
+	buf := make([]byte, ChunkSize)
+	for {
+		n, err := f.Read(buf)
+		if n > 0 {
+			str.SetWriteDeadline(time.Now().Add(ChunkTimeout))
+			if _, err := str.Write(buf[:n]); err != nil {
+				logger.Debugf("failed to send file to %s: %v", from, err)
+				str.Reset()
+				return
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			logger.Warnf("failed to read shared file %s: %v", path, err)
+			str.Reset()
+			return
+		}
+	}
+	logger.Debugf("sent %s to %s from offset %d", filepath.Base(path), from, req.Offset)
+}
+
+// writeResponse writes the response header as a single JSON line
+func (s *Service) writeResponse(str network.Stream, resp *response) bool {
+	if err := json.NewEncoder(str).Encode(resp); err != nil {
+		logger.Debugf("failed to answer file request from %s: %v", str.Conn().RemotePeer(), err)
+		str.Reset()
+		return false
+	}
+	return true
+}
+
+// readLine reads up to the next newline, one byte at a time
+func readLine(r io.Reader, limit int) ([]byte, error) {
+	var line []byte
+	b := make([]byte, 1)
+	for len(line) < limit {
+		if _, err := io.ReadFull(r, b); err != nil {
+			return nil, err
+		}
+		if b[0] == '\n' {
+			return line, nil
+		}
+		line = append(line, b[0])
+	}
+	return nil, errors.New("header too long")
+}
+
+// availablePath returns path, or path with a numbered suffix if a file already exists there
+func availablePath(path string) string {
+	ext := filepath.Ext(path)
+	base := strings.TrimSuffix(path, ext)
+	for i := 1; ; i++ {
+		if _, err := os.Stat(path); errors.Is(err, os.ErrNotExist) {
+			return path
+		}
+		path = fmt.Sprintf("%s (%d)%s", base, i, ext)
+	}
+}
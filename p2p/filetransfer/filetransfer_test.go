@@ -0,0 +1,125 @@
+package filetransfer
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
+)
+
+func TestOfferValidate(t *testing.T) {
+	sum := sha256.Sum256([]byte("hello"))
+	hash := hex.EncodeToString(sum[:])
+
+	tests := []struct {
+		name    string
+		offer   Offer
+		wantErr bool
+	}{
+		{name: "valid", offer: Offer{Name: "hello.txt", Size: 5, Hash: hash}},
+		{name: "empty file", offer: Offer{Name: "empty", Size: 0, Hash: hash}},
+		{name: "missing name", offer: Offer{Size: 5, Hash: hash}, wantErr: true},
+		{name: "name with brackets", offer: Offer{Name: "photo [1].jpg", Size: 5, Hash: hash}},
+		{name: "multi-line name", offer: Offer{Name: "hello.txt\n12:00:00 Downloaded", Size: 5, Hash: hash}, wantErr: true},
+		{name: "escape sequence in name", offer: Offer{Name: "hello\x1b[31m.txt", Size: 5, Hash: hash}, wantErr: true},
+		{name: "invalid UTF-8 name", offer: Offer{Name: "hello\xff.txt", Size: 5, Hash: hash}, wantErr: true},
+		{name: "right-to-left override in name", offer: Offer{Name: "invoice\u202Efdp.exe", Size: 5, Hash: hash}, wantErr: true},
+		{name: "zero-width space in name", offer: Offer{Name: "hello\u200B.txt", Size: 5, Hash: hash}, wantErr: true},
+		{name: "unicode name", offer: Offer{Name: "résumé 📄.pdf", Size: 5, Hash: hash}},
+		{name: "negative size", offer: Offer{Name: "hello.txt", Size: -1, Hash: hash}, wantErr: true},
+		{name: "missing hash", offer: Offer{Name: "hello.txt", Size: 5}, wantErr: true},
+		{name: "path traversal", offer: Offer{Name: "hello.txt", Size: 5, Hash: "../../.bashrc"}, wantErr: true},
+		{name: "path in hash", offer: Offer{Name: "hello.txt", Size: 5, Hash: hash[:62] + "/x"}, wantErr: true},
+		{name: "uppercase hash", offer: Offer{Name: "hello.txt", Size: 5, Hash: strings.ToUpper(hash)}, wantErr: true},
+		{name: "short hash", offer: Offer{Name: "hello.txt", Size: 5, Hash: hash[:32]}, wantErr: true},
+		{name: "long hash", offer: Offer{Name: "hello.txt", Size: 5, Hash: hash + "00"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.offer.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("got error %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestFetch(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	mn, err := mocknet.FullMeshConnected(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mn.Close()
+	hosts := mn.Hosts()
+	alice, bob, mallory := hosts[0], hosts[1], hosts[2]
+
+	// alice only serves her files to bob
+	sharer := NewService(alice, func(hash string, p peer.ID) error {
+		if p != bob.ID() {
+			return errors.New("not a member of the room")
+		}
+		return nil
+	})
+	defer sharer.Close()
+
+	path := filepath.Join(t.TempDir(), "hello.txt")
+	content := strings.Repeat("hello ", ChunkSize/3)
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	offer, err := sharer.Share(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if offer.Name != "hello.txt" || offer.Size != int64(len(content)) {
+		t.Fatalf("got offer %+v", offer)
+	}
+
+	t.Run("authorized", func(t *testing.T) {
+		s := NewService(bob, nil)
+		var received int64
+		got, err := s.Fetch(ctx, alice.ID(), offer, t.TempDir(), func(n, total int64) { received = n })
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := os.ReadFile(got)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != content || filepath.Base(got) != "hello.txt" {
+			t.Errorf("got %s with %d bytes, want hello.txt with %d bytes", got, len(data), len(content))
+		}
+		if received != offer.Size {
+			t.Errorf("got progress %d, want %d", received, offer.Size)
+		}
+	})
+
+	t.Run("unauthorized", func(t *testing.T) {
+		s := NewService(mallory, nil)
+		dir := t.TempDir()
+		if _, err := s.Fetch(ctx, alice.ID(), offer, dir, nil); err == nil {
+			t.Fatal("expected an error fetching a file not shared with the peer")
+		}
+		if _, err := os.Stat(filepath.Join(dir, "hello.txt")); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("got the file downloaded: %v", err)
+		}
+	})
+
+	t.Run("not shared", func(t *testing.T) {
+		s := NewService(bob, nil)
+		sum := sha256.Sum256([]byte("other"))
+		other := &Offer{Name: "other.txt", Size: 5, Hash: hex.EncodeToString(sum[:])}
+		if _, err := s.Fetch(ctx, alice.ID(), other, t.TempDir(), nil); err == nil || err.Error() != ErrNotShared.Error() {
+			t.Errorf("got error %v, want %v", err, ErrNotShared)
+		}
+	})
+}
@@ -0,0 +1,297 @@
+package historysync
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/alejoacosta74/go-logger"
+	"github.com/alejoacosta74/libp2p-chat-app/history"
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	pb "github.com/libp2p/go-libp2p-pubsub/pb"
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+)
+
+const (
+	// ProtocolID is the request/response stream protocol used to fetch missed messages
+	ProtocolID protocol.ID = "/p2p-chat/history/1.0.0"
+
+	// MaxMessages is the maximum number of messages returned in a single response
+	MaxMessages = 500
+
+	// MaxRequestSize is the maximum size of an encoded request
+	MaxRequestSize = 4 * 1024
+
+	// MaxResponseSize is the maximum size of an encoded response
+	MaxResponseSize = 4 * 1024 * 1024
+
+	// StreamTimeout bounds the time spent on a single request
+	StreamTimeout = 15 * time.Second
+)
+
+// ErrInvalidSignature is returned when the message carried by a record is not
+// signed by its origin peer
+var ErrInvalidSignature = errors.New("invalid message signature")
+
+// Request asks a peer for the messages of a room published after a given
+// message ID or, if the peer doesn't know that message, after a timestamp.
+type Request struct {
+	Room    string
+	Since   int64 // unix milliseconds
+	SinceID string
+	Limit   int
+}
+
+// Response carries the messages matching a Request, oldest first. Only the
+// records carrying their signed message are served, see SignedMessage.
+type Response struct {
+	Records []*history.Record
+	Error   string `json:",omitempty"`
+}
+
+// Service serves the local history to other peers and fetches the messages
+// missed while offline from them.
+type Service struct {
+	host      host.Host
+	store     *history.Store
+	authorize func(roomName string, p peer.ID) error
+}
+
+// NewService registers the history sync protocol handler on the host. Requests
+// are only answered when authorize returns nil for the room and the requesting
+// peer, so that peers can't read the history of rooms they can't read live.
+func NewService(h host.Host, store *history.Store, authorize func(roomName string, p peer.ID) error) *Service {
+	s := &Service{
+		host:      h,
+		store:     store,
+		authorize: authorize,
+	}
+	h.SetStreamHandler(ProtocolID, s.handleStream)
+	return s
+}
+
+// Close removes the protocol handler from the host.
+func (s *Service) Close() {
+	s.host.RemoveStreamHandler(ProtocolID)
+}
+
+// Fetch requests the messages of a room from a single peer.
+func (s *Service) Fetch(ctx context.Context, p peer.ID, req *Request) ([]*history.Record, error) {
+	ctx, cancel := context.WithTimeout(ctx, StreamTimeout)
+	defer cancel()
+
+	str, err := s.host.NewStream(ctx, p, ProtocolID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open stream to %s: %w", p, err)
+	}
+	defer str.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		str.SetDeadline(deadline)
+	}
+
+	if err := json.NewEncoder(str).Encode(req); err != nil {
+		str.Reset()
+		return nil, fmt.Errorf("failed to send request: %w", err)
+	}
+	if err := str.CloseWrite(); err != nil {
+		str.Reset()
+		return nil, fmt.Errorf("failed to send request: %w", err)
+	}
+
+	resp := new(Response)
+	if err := json.NewDecoder(io.LimitReader(str, MaxResponseSize)).Decode(resp); err != nil {
+		str.Reset()
+		return nil, fmt.Errorf("failed to read response: %w", err)
+	}
+	if resp.Error != "" {
+		return nil, fmt.Errorf("request rejected: %s", resp.Error)
+	}
+	return resp.Records, nil
+}
+
+// Sync asks the peers for the messages of the room published after the most
+// recent locally stored one. Each record is checked by verify, which returns
+// the record to keep, as the peers serving them can't be trusted. The results
+// are deduplicated by message ID, saved to the store and returned in
+// timestamp order.
+func (s *Service) Sync(ctx context.Context, roomName string, peers []peer.ID, verify func(*history.Record) (*history.Record, error)) ([]*history.Record, error) {
+	req := &Request{Room: roomName, Limit: MaxMessages}
+	latest, err := s.store.Latest(roomName)
+	if err != nil {
+		return nil, err
+	}
+	if latest != nil {
+		req.Since = latest.Timestamp
+		req.SinceID = latest.ID
+	}
+
+	var (
+		mu      sync.Mutex
+		wg      sync.WaitGroup
+		records = make(map[string]*history.Record)
+	)
+	for _, p := range peers {
+		wg.Add(1)
+		go func(p peer.ID) {
+			defer wg.Done()
+			recs, err := s.Fetch(ctx, p, req)
+			if err != nil {
+				logger.Debugf("history sync with %s failed: %v", p, err)
+				return
+			}
+			var verified []*history.Record
+			for _, r := range recs {
+				if r.ID == "" || r.Room != roomName {
+					continue
+				}
+				v, err := verify(r)
+				if err != nil {
+					logger.Debugf("dropping history record %s from %s: %v", r.ID, p, err)
+					continue
+				}
+				verified = append(verified, v)
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			for _, r := range verified {
+				records[r.ID] = r
+			}
+		}(p)
+	}
+	wg.Wait()
+
+	var missed []*history.Record
+	for _, r := range records {
+		if s.store.Has(roomName, r.ID) {
+			continue
+		}
+		if err := s.store.Put(r); err != nil {
+			return missed, err
+		}
+		missed = append(missed, r)
+	}
+	sort.Slice(missed, func(i, j int) bool {
+		if missed[i].Timestamp == missed[j].Timestamp {
+			return missed[i].ID < missed[j].ID
+		}
+		return missed[i].Timestamp < missed[j].Timestamp
+	})
+	return missed, nil
+}
+
+// handleStream answers a history request from the local store.
+func (s *Service) handleStream(str network.Stream) {
+	defer str.Close()
+	str.SetDeadline(time.Now().Add(StreamTimeout))
+
+	req := new(Request)
+	if err := json.NewDecoder(io.LimitReader(str, MaxRequestSize)).Decode(req); err != nil {
+		logger.Debugf("failed to read history request from %s: %v", str.Conn().RemotePeer(), err)
+		str.Reset()
+		return
+	}
+
+	resp := new(Response)
+	if err := s.authorize(req.Room, str.Conn().RemotePeer()); err != nil {
+		resp.Error = err.Error()
+	} else {
+		records, err := s.query(req)
+		if err != nil {
+			logger.Warnf("failed to query history for %s: %v", str.Conn().RemotePeer(), err)
+			resp.Error = "internal error"
+		}
+		// the records saved before their signed message was kept can't be verified
+		for _, r := range records {
+			if len(r.Signed) > 0 {
+				resp.Records = append(resp.Records, r)
+			}
+		}
+	}
+
+	if err := json.NewEncoder(str).Encode(resp); err != nil {
+		logger.Debugf("failed to send history response to %s: %v", str.Conn().RemotePeer(), err)
+		str.Reset()
+	}
+}
+
+// query looks up the messages matching the request in the store
+func (s *Service) query(req *Request) ([]*history.Record, error) {
+	limit := req.Limit
+	if limit <= 0 || limit > MaxMessages {
+		limit = MaxMessages
+	}
+
+	since := req.Since
+	if req.SinceID != "" {
+		r, err := s.store.Get(req.Room, req.SinceID)
+		if err != nil {
+			return nil, err
+		}
+		if r != nil {
+			since = r.Timestamp
+		}
+	}
+	if since == 0 {
+		// a peer with no history gets the most recent messages
+		return s.store.Last(req.Room, limit)
+	}
+	// include messages sharing the timestamp, duplicates are dropped by the requester
+	return s.store.Since(req.Room, since-1, limit)
+}
+
+// SignedMessage returns the pubsub message carried by the record, after
+// checking it is signed by its origin peer, as pubsub does for the messages
+// it delivers. Its data and origin can then be trusted, whichever peer served
+// the record.
+func SignedMessage(r *history.Record) (*pubsub.Message, error) {
+	if len(r.Signed) == 0 {
+		return nil, errors.New("record carries no signed message")
+	}
+	m := new(pb.Message)
+	if err := m.Unmarshal(r.Signed); err != nil {
+		return nil, fmt.Errorf("invalid signed message: %w", err)
+	}
+	pub, err := signingKey(m)
+	if err != nil {
+		return nil, err
+	}
+	unsigned := *m
+	unsigned.Signature, unsigned.Key = nil, nil
+	data, err := unsigned.Marshal()
+	if err != nil {
+		return nil, err
+	}
+	if ok, err := pub.Verify(append([]byte(pubsub.SignPrefix), data...), m.Signature); err != nil || !ok {
+		return nil, ErrInvalidSignature
+	}
+	return &pubsub.Message{Message: m}, nil
+}
+
+// signingKey returns the public key of the origin of the message, either
+// attached to it or inlined in the peer ID
+func signingKey(m *pb.Message) (crypto.PubKey, error) {
+	from, err := peer.IDFromBytes(m.From)
+	if err != nil {
+		return nil, fmt.Errorf("invalid message origin: %w", err)
+	}
+	if m.Key == nil {
+		return from.ExtractPublicKey()
+	}
+	pub, err := crypto.UnmarshalPublicKey(m.Key)
+	if err != nil {
+		return nil, fmt.Errorf("invalid signing key: %w", err)
+	}
+	if !from.MatchesPublicKey(pub) {
+		return nil, fmt.Errorf("signing key does not match origin %s", from)
+	}
+	return pub, nil
+}
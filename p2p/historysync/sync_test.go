@@ -0,0 +1,282 @@
+package historysync
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"github.com/alejoacosta74/libp2p-chat-app/history"
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	pb "github.com/libp2p/go-libp2p-pubsub/pb"
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+	mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
+)
+
+func newKey(t *testing.T) (crypto.PrivKey, peer.ID) {
+	t.Helper()
+	key, _, err := crypto.GenerateEd25519Key(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := peer.IDFromPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key, id
+}
+
+func openStore(t *testing.T) *history.Store {
+	t.Helper()
+	store, err := history.Open(filepath.Join(t.TempDir(), "history.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+	return store
+}
+
+// sign returns the pubsub message carrying text, signed by key as pubsub signs them
+func sign(t *testing.T, key crypto.PrivKey, text string) *pb.Message {
+	t.Helper()
+	from, err := peer.IDFromPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	topic := "chat-room:lobby"
+	m := &pb.Message{From: []byte(from), Data: []byte(text), Seqno: []byte(text), Topic: &topic}
+	unsigned, err := m.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Signature, err = key.Sign(append([]byte(pubsub.SignPrefix), unsigned...)); err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+// record returns a record of the lobby room carrying the signed message m
+func record(t *testing.T, id string, ts int64, m *pb.Message) *history.Record {
+	t.Helper()
+	signed, err := m.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the origin is left as is, to check the records of invalid ones
+	from, _ := peer.IDFromBytes(m.From)
+	return &history.Record{
+		Room:      "lobby",
+		ID:        id,
+		Timestamp: ts,
+		SenderID:  from.String(),
+		Message:   string(m.Data),
+		Signed:    signed,
+	}
+}
+
+// verify rebuilds the record from its signed message, as the rooms do
+func verify(r *history.Record) (*history.Record, error) {
+	msg, err := SignedMessage(r)
+	if err != nil {
+		return nil, err
+	}
+	v := *r
+	v.SenderID, v.Message = msg.GetFrom().String(), string(msg.Data)
+	return &v, nil
+}
+
+// onlyLobby serves the history of the lobby room to every peer
+func onlyLobby(roomName string, p peer.ID) error {
+	if roomName != "lobby" {
+		return errors.New("not a member of the room")
+	}
+	return nil
+}
+
+func TestFetch(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	mn, err := mocknet.FullMeshConnected(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mn.Close()
+	server, client := mn.Hosts()[0], mn.Hosts()[1]
+	key, _ := newKey(t)
+
+	store := openStore(t)
+	for i := 1; i <= 5; i++ {
+		text := fmt.Sprintf("message %d", i)
+		if err := store.Put(record(t, text, int64(i*1000), sign(t, key, text))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the records saved without their signed message are not served
+	if err := store.Put(&history.Record{Room: "lobby", ID: "unsigned", Timestamp: 6000, Message: "unsigned"}); err != nil {
+		t.Fatal(err)
+	}
+	NewService(server, store, onlyLobby)
+	s := NewService(client, openStore(t), onlyLobby)
+
+	tests := []struct {
+		name    string
+		req     *Request
+		wantIDs []string
+		wantErr bool
+	}{
+		{name: "no history", req: &Request{Room: "lobby", Limit: 2}, wantIDs: []string{"message 5"}},
+		{name: "since ID", req: &Request{Room: "lobby", SinceID: "message 3"}, wantIDs: []string{"message 3", "message 4", "message 5"}},
+		{name: "since timestamp", req: &Request{Room: "lobby", Since: 4000}, wantIDs: []string{"message 4", "message 5"}},
+		{name: "unknown ID", req: &Request{Room: "lobby", Since: 5000, SinceID: "unknown"}, wantIDs: []string{"message 5"}},
+		{name: "unauthorized room", req: &Request{Room: "private"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			records, err := s.Fetch(ctx, server.ID(), tt.req)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want error %v", err, tt.wantErr)
+			}
+			var ids []string
+			for _, r := range records {
+				ids = append(ids, r.ID)
+			}
+			if fmt.Sprint(ids) != fmt.Sprint(tt.wantIDs) {
+				t.Errorf("got records %q, want %q", ids, tt.wantIDs)
+			}
+		})
+	}
+}
+
+func TestSync(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	mn, err := mocknet.FullMeshConnected(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mn.Close()
+	hosts := mn.Hosts()
+	alice, bob, client := hosts[0], hosts[1], hosts[2]
+	aliceKey, _ := newKey(t)
+	bobKey, _ := newKey(t)
+	malloryKey, _ := newKey(t)
+
+	known := record(t, "known", 1000, sign(t, aliceKey, "known"))
+	shared := record(t, "shared", 3000, sign(t, aliceKey, "shared"))
+	fromAlice := record(t, "alice", 2000, sign(t, aliceKey, "from alice"))
+	fromBob := record(t, "bob", 4000, sign(t, bobKey, "from bob"))
+	// same timestamp as fromBob, ordered by ID
+	early := record(t, "a-bob", 4000, sign(t, bobKey, "early"))
+
+	tampered := record(t, "tampered", 5000, sign(t, aliceKey, "hello"))
+	m := sign(t, aliceKey, "hello")
+	m.Data = []byte("forged")
+	tampered.Signed, _ = m.Marshal()
+	// signed by mallory, claiming to come from alice
+	forged := sign(t, malloryKey, "impersonated")
+	forged.From = sign(t, aliceKey, "impersonated").From
+	impersonated := record(t, "impersonated", 5000, forged)
+	unsigned := &history.Record{Room: "lobby", ID: "unsigned", Timestamp: 5000, SenderID: alice.ID().String(), Message: "unsigned"}
+
+	for h, records := range map[peer.ID][]*history.Record{
+		alice.ID(): {known, fromAlice, shared, tampered},
+		bob.ID():   {shared, fromBob, early, impersonated, unsigned},
+	} {
+		store := openStore(t)
+		for _, r := range records {
+			if err := store.Put(r); err != nil {
+				t.Fatal(err)
+			}
+		}
+		NewService(mn.Host(h), store, onlyLobby)
+	}
+
+	store := openStore(t)
+	if err := store.Put(known); err != nil {
+		t.Fatal(err)
+	}
+	s := NewService(client, store, onlyLobby)
+	missed, err := s.Sync(ctx, "lobby", []peer.ID{alice.ID(), bob.ID()}, verify)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the known message is served again, as the peers include the messages
+	// sharing its timestamp, but it is not returned twice
+	want := []string{"alice", "shared", "a-bob", "bob"}
+	var ids []string
+	for _, r := range missed {
+		ids = append(ids, r.ID)
+	}
+	if fmt.Sprint(ids) != fmt.Sprint(want) {
+		t.Errorf("got records %q, want %q", ids, want)
+	}
+	for _, id := range want {
+		if !store.Has("lobby", id) {
+			t.Errorf("record %s not saved", id)
+		}
+	}
+	for _, id := range []string{"tampered", "impersonated", "unsigned"} {
+		if store.Has("lobby", id) {
+			t.Errorf("record %s saved", id)
+		}
+	}
+
+	// nothing is missed anymore
+	if missed, err := s.Sync(ctx, "lobby", []peer.ID{alice.ID(), bob.ID()}, verify); err != nil || len(missed) != 0 {
+		t.Errorf("got %d records syncing again, %v", len(missed), err)
+	}
+}
+
+func TestSignedMessage(t *testing.T) {
+	key, id := newKey(t)
+	otherKey, _ := newKey(t)
+
+	valid := record(t, "1", 1000, sign(t, key, "hello"))
+	msg, err := SignedMessage(valid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.GetFrom() != id || string(msg.Data) != "hello" {
+		t.Errorf("got message %q from %s, want %q from %s", msg.Data, msg.GetFrom(), "hello", id)
+	}
+
+	// edit returns a record carrying the message signed by key, modified by fn
+	edit := func(fn func(m *pb.Message)) *history.Record {
+		m := sign(t, key, "hello")
+		fn(m)
+		return record(t, "1", 1000, m)
+	}
+	otherPub, err := otherKey.GetPublic().Raw()
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKeyBytes, err := crypto.MarshalPublicKey(otherKey.GetPublic())
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		r    *history.Record
+	}{
+		{name: "no signed message", r: &history.Record{Room: "lobby", ID: "1", Message: "hello"}},
+		{name: "garbage", r: &history.Record{Room: "lobby", ID: "1", Signed: []byte("garbage")}},
+		{name: "unsigned", r: edit(func(m *pb.Message) { m.Signature = nil })},
+		{name: "tampered data", r: edit(func(m *pb.Message) { m.Data = []byte("bye") })},
+		{name: "tampered topic", r: edit(func(m *pb.Message) { topic := "chat-room:other"; m.Topic = &topic })},
+		{name: "invalid origin", r: edit(func(m *pb.Message) { m.From = otherPub })},
+		{name: "key of another peer", r: edit(func(m *pb.Message) { m.Key = otherKeyBytes })},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if msg, err := SignedMessage(tt.r); err == nil {
+				t.Errorf("expected an error, got message %q from %s", msg.Data, msg.GetFrom())
+			}
+		})
+	}
+}
@@ -0,0 +1,322 @@
+package identity
+
+import (
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/scrypt"
+)
+
+const (
+	// DefaultKeyFile is the name of the key file inside the default config directory
+	DefaultKeyFile = "identity.key"
+
+	plainBlockType     = "LIBP2P PRIVATE KEY"
+	encryptedBlockType = "ENCRYPTED LIBP2P PRIVATE KEY"
+
+	// scrypt parameters used to derive the key encryption key from the passphrase
+	scryptN      = 1 << 15
+	scryptR      = 8
+	scryptP      = 1
+	scryptSalt   = 16
+	scryptKeyLen = chacha20poly1305.KeySize
+)
+
+var (
+	// ErrNoKey is returned when the key file does not exist
+	ErrNoKey = errors.New("identity key not found")
+	// ErrPassphraseRequired is returned when loading an encrypted key without a passphrase
+	ErrPassphraseRequired = errors.New("identity key is encrypted, passphrase required")
+	// ErrKeyExists is returned when trying to overwrite an existing key file
+	ErrKeyExists = errors.New("identity key already exists")
+)
+
+// KeyStore persists the node's private key on disk, optionally encrypted
+// with a passphrase.
+type KeyStore struct {
+	path       string
+	passphrase []byte
+}
+
+// NewKeyStore creates a key store backed by the file at path. If path is empty
+// the default location is used. If passphrase is not empty, keys are
+// encrypted at rest.
+func NewKeyStore(path string, passphrase string) *KeyStore {
+	if path == "" {
+		path = DefaultPath()
+	}
+	return &KeyStore{
+		path:       path,
+		passphrase: []byte(passphrase),
+	}
+}
+
+// DefaultPath returns the default location of the identity key file
+func DefaultPath() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return DefaultKeyFile
+	}
+	return filepath.Join(dir, "p2p-chat", DefaultKeyFile)
+}
+
+// Path returns the location of the key file
+func (ks *KeyStore) Path() string {
+	return ks.path
+}
+
+// Exists reports whether a key file is present
+func (ks *KeyStore) Exists() bool {
+	_, err := os.Stat(ks.path)
+	return err == nil
+}
+
+// Encrypted reports whether the stored key is encrypted with a passphrase
+func (ks *KeyStore) Encrypted() (bool, error) {
+	data, err := os.ReadFile(ks.path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return false, ErrNoKey
+		}
+		return false, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return false, fmt.Errorf("invalid key file %s", ks.path)
+	}
+	return block.Type == encryptedBlockType, nil
+}
+
+// Load reads and decodes the private key from disk
+func (ks *KeyStore) Load() (crypto.PrivKey, error) {
+	data, err := os.ReadFile(ks.path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, ErrNoKey
+		}
+		return nil, fmt.Errorf("failed to read key file: %w", err)
+	}
+	return Decode(data, ks.passphrase)
+}
+
+// LoadOrCreate loads the private key from disk, generating and saving a new
+// Ed25519 key on first run.
+func (ks *KeyStore) LoadOrCreate() (crypto.PrivKey, error) {
+	key, err := ks.Load()
+	if err == nil {
+		return key, nil
+	}
+	if !errors.Is(err, ErrNoKey) {
+		return nil, err
+	}
+
+	key, err = Generate()
+	if err != nil {
+		return nil, err
+	}
+	if err := ks.Save(key, false); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// Save writes the private key to disk. An existing key file is only
+// overwritten if overwrite is true, and is replaced atomically.
+func (ks *KeyStore) Save(key crypto.PrivKey, overwrite bool) error {
+	if !overwrite && ks.Exists() {
+		return ErrKeyExists
+	}
+	data, err := Encode(key, ks.passphrase)
+	if err != nil {
+		return err
+	}
+	tmp, err := ks.writeTemp(data)
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, ks.path); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to write key file: %w", err)
+	}
+	return nil
+}
+
+// Rotate replaces the stored key with a freshly generated one. The previous
+// key file is kept next to the new one with a timestamped ".bak" suffix, and
+// its path is returned. The new key is written to a temporary file first, so
+// that the previous key stays in place if it can't be saved.
+func (ks *KeyStore) Rotate() (crypto.PrivKey, string, error) {
+	key, err := Generate()
+	if err != nil {
+		return nil, "", err
+	}
+	data, err := Encode(key, ks.passphrase)
+	if err != nil {
+		return nil, "", err
+	}
+	tmp, err := ks.writeTemp(data)
+	if err != nil {
+		return nil, "", err
+	}
+
+	backup := ""
+	if ks.Exists() {
+		backup = fmt.Sprintf("%s.%d.bak", ks.path, time.Now().Unix())
+		if err := os.Rename(ks.path, backup); err != nil {
+			os.Remove(tmp)
+			return nil, "", fmt.Errorf("failed to back up key file: %w", err)
+		}
+	}
+	if err := os.Rename(tmp, ks.path); err != nil {
+		os.Remove(tmp)
+		if backup != "" {
+			// put the previous key back, rather than leaving no key at all
+			os.Rename(backup, ks.path)
+		}
+		return nil, "", fmt.Errorf("failed to write key file: %w", err)
+	}
+	return key, backup, nil
+}
+
+// writeTemp writes data to a new temporary file in the directory of the key
+// file, readable by the owner only, and returns its path
+func (ks *KeyStore) writeTemp(data []byte) (string, error) {
+	dir := filepath.Dir(ks.path)
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return "", fmt.Errorf("failed to create key directory: %w", err)
+	}
+	f, err := os.CreateTemp(dir, filepath.Base(ks.path)+".*.tmp")
+	if err != nil {
+		return "", fmt.Errorf("failed to write key file: %w", err)
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", fmt.Errorf("failed to write key file: %w", err)
+	}
+	return f.Name(), nil
+}
+
+// Generate creates a new Ed25519 private key
+func Generate() (crypto.PrivKey, error) {
+	key, _, err := crypto.GenerateEd25519Key(rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate key: %w", err)
+	}
+	return key, nil
+}
+
+// PeerID returns the peer ID derived from the private key
+func PeerID(key crypto.PrivKey) (peer.ID, error) {
+	return peer.IDFromPrivateKey(key)
+}
+
+// Encode serializes the private key as a PEM block. If passphrase is not
+// empty, the key is encrypted with XChaCha20-Poly1305 using a key derived
+// with scrypt.
+func Encode(key crypto.PrivKey, passphrase []byte) ([]byte, error) {
+	raw, err := crypto.MarshalPrivateKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal key: %w", err)
+	}
+	if len(passphrase) == 0 {
+		return pem.EncodeToMemory(&pem.Block{Type: plainBlockType, Bytes: raw}), nil
+	}
+
+	salt := make([]byte, scryptSalt)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	aead, err := newAEAD(passphrase, salt)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	block := &pem.Block{
+		Type: encryptedBlockType,
+		Headers: map[string]string{
+			"KDF":   "scrypt",
+			"Salt":  hex.EncodeToString(salt),
+			"Nonce": hex.EncodeToString(nonce),
+		},
+		Bytes: aead.Seal(nil, nonce, raw, nil),
+	}
+	return pem.EncodeToMemory(block), nil
+}
+
+// Decode parses a PEM encoded private key, decrypting it with passphrase
+// if needed.
+func Decode(data []byte, passphrase []byte) (crypto.PrivKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("invalid key file: no PEM block found")
+	}
+
+	raw := block.Bytes
+	switch block.Type {
+	case plainBlockType:
+	case encryptedBlockType:
+		if len(passphrase) == 0 {
+			return nil, ErrPassphraseRequired
+		}
+		if kdf := block.Headers["KDF"]; kdf != "scrypt" {
+			return nil, fmt.Errorf("unsupported key derivation function %q", kdf)
+		}
+		salt, err := hex.DecodeString(block.Headers["Salt"])
+		if err != nil {
+			return nil, fmt.Errorf("invalid salt: %w", err)
+		}
+		nonce, err := hex.DecodeString(block.Headers["Nonce"])
+		if err != nil {
+			return nil, fmt.Errorf("invalid nonce: %w", err)
+		}
+		aead, err := newAEAD(passphrase, salt)
+		if err != nil {
+			return nil, err
+		}
+		if len(nonce) != aead.NonceSize() {
+			return nil, errors.New("invalid nonce size")
+		}
+		raw, err = aead.Open(nil, nonce, block.Bytes, nil)
+		if err != nil {
+			return nil, errors.New("failed to decrypt key: wrong passphrase?")
+		}
+	default:
+		return nil, fmt.Errorf("unexpected PEM block type %q", block.Type)
+	}
+
+	key, err := crypto.UnmarshalPrivateKey(raw)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal key: %w", err)
+	}
+	return key, nil
+}
+
+// newAEAD derives the key encryption key from the passphrase and salt
+func newAEAD(passphrase, salt []byte) (cipher.AEAD, error) {
+	kek, err := scrypt.Key(passphrase, salt, scryptN, scryptR, scryptP, scryptKeyLen)
+	if err != nil {
+		return nil, fmt.Errorf("failed to derive key: %w", err)
+	}
+	return chacha20poly1305.NewX(kek)
+}
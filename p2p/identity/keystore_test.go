@@ -0,0 +1,154 @@
+package identity
+
+import (
+	"bytes"
+	"encoding/pem"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestEncodeDecode(t *testing.T) {
+	key, err := Generate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, passphrase := range []string{"", "correct horse"} {
+		data, err := Encode(key, []byte(passphrase))
+		if err != nil {
+			t.Fatalf("passphrase %q: encode: %v", passphrase, err)
+		}
+		decoded, err := Decode(data, []byte(passphrase))
+		if err != nil {
+			t.Fatalf("passphrase %q: decode: %v", passphrase, err)
+		}
+		if !decoded.Equals(key) {
+			t.Errorf("passphrase %q: decoded key differs from the encoded one", passphrase)
+		}
+	}
+}
+
+func TestDecodeErrors(t *testing.T) {
+	key, err := Generate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	encrypted, err := Encode(key, []byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// reencode rewrites the PEM block of the encrypted key
+	reencode := func(edit func(b *pem.Block)) []byte {
+		block, _ := pem.Decode(encrypted)
+		edit(block)
+		return pem.EncodeToMemory(block)
+	}
+
+	tests := []struct {
+		name       string
+		data       []byte
+		passphrase string
+		wantErr    error
+	}{
+		{name: "no PEM block", data: []byte("not a key")},
+		{name: "unexpected block type", data: pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: []byte{1}})},
+		{name: "invalid key bytes", data: pem.EncodeToMemory(&pem.Block{Type: plainBlockType, Bytes: []byte("garbage")})},
+		{name: "missing passphrase", data: encrypted, wantErr: ErrPassphraseRequired},
+		{name: "wrong passphrase", data: encrypted, passphrase: "wrong"},
+		{name: "unsupported KDF", data: reencode(func(b *pem.Block) { b.Headers["KDF"] = "md5" }), passphrase: "secret"},
+		{name: "invalid salt", data: reencode(func(b *pem.Block) { b.Headers["Salt"] = "zz" }), passphrase: "secret"},
+		{name: "invalid nonce", data: reencode(func(b *pem.Block) { b.Headers["Nonce"] = "zz" }), passphrase: "secret"},
+		{name: "short nonce", data: reencode(func(b *pem.Block) { b.Headers["Nonce"] = "00" }), passphrase: "secret"},
+		{name: "tampered ciphertext", data: reencode(func(b *pem.Block) { b.Bytes[0] ^= 1 }), passphrase: "secret"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Decode(tt.data, []byte(tt.passphrase))
+			if err == nil {
+				t.Fatal("expected an error")
+			}
+			if tt.wantErr != nil && !errors.Is(err, tt.wantErr) {
+				t.Errorf("got error %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestKeyStoreLoadOrCreate(t *testing.T) {
+	ks := NewKeyStore(filepath.Join(t.TempDir(), "p2p-chat", DefaultKeyFile), "secret")
+	if _, err := ks.Load(); !errors.Is(err, ErrNoKey) {
+		t.Fatalf("got error %v loading a missing key, want %v", err, ErrNoKey)
+	}
+	key, err := ks.LoadOrCreate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, err := ks.LoadOrCreate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !again.Equals(key) {
+		t.Error("the key changed across loads")
+	}
+	if encrypted, err := ks.Encrypted(); err != nil || !encrypted {
+		t.Errorf("got encrypted %v, %v, want true", encrypted, err)
+	}
+	if err := ks.Save(key, false); !errors.Is(err, ErrKeyExists) {
+		t.Errorf("got error %v overwriting the key, want %v", err, ErrKeyExists)
+	}
+	if _, err := NewKeyStore(ks.Path(), "").Load(); !errors.Is(err, ErrPassphraseRequired) {
+		t.Errorf("got error %v loading without passphrase, want %v", err, ErrPassphraseRequired)
+	}
+	fi, err := os.Stat(ks.Path())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := fi.Mode().Perm(); perm != 0o600 {
+		t.Errorf("key file has mode %v, want 0600", perm)
+	}
+}
+
+func TestKeyStoreRotate(t *testing.T) {
+	dir := t.TempDir()
+	ks := NewKeyStore(filepath.Join(dir, DefaultKeyFile), "")
+	old, err := ks.LoadOrCreate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldData, err := os.ReadFile(ks.Path())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key, backup, err := ks.Rotate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key.Equals(old) {
+		t.Error("the rotated key is the previous one")
+	}
+	loaded, err := ks.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !loaded.Equals(key) {
+		t.Error("the stored key is not the rotated one")
+	}
+	backupData, err := os.ReadFile(backup)
+	if err != nil {
+		t.Fatalf("reading backup: %v", err)
+	}
+	if !bytes.Equal(backupData, oldData) {
+		t.Error("the backup differs from the previous key file")
+	}
+
+	// only the key and its backup are left, no temporary file
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Errorf("got %d files in the key directory, want 2", len(entries))
+	}
+}
@@ -0,0 +1,172 @@
+package message
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Version is the current version of the envelope schema
+const Version = 1
+
+// Type identifies the kind of payload carried by an envelope
+type Type int32
+
+const (
+	TypeUnspecified Type = iota
+	// TypeChat envelopes carry the UTF-8 text of a chat message
+	TypeChat
+	// TypeACL envelopes carry the access control list of a restricted room,
+	// signed by the room owner
+	TypeACL
+	// TypeFile envelopes carry the metadata of a file shared in the room,
+	// which is fetched from the sender over a dedicated stream protocol
+	TypeFile
+	// TypePresence envelopes carry the heartbeats announcing the status of a
+	// peer, published on the presence topic of the room
+	TypePresence
+	// TypeNick envelopes carry the signed announcement of the new nickname of
+	// the sender, whose previous nickname is in the envelope
+	TypeNick
+)
+
+// Format is the encoding used to serialize envelopes
+type Format string
+
+const (
+	FormatJSON     Format = "json"
+	FormatProtobuf Format = "protobuf"
+)
+
+var (
+	// ErrEmpty is returned when decoding an empty message
+	ErrEmpty = errors.New("empty message")
+	// ErrUnsupportedVersion is returned when decoding an envelope from a newer schema
+	ErrUnsupportedVersion = errors.New("unsupported envelope version")
+	// ErrMissingVersion is returned when decoding a protobuf envelope without version
+	ErrMissingVersion = errors.New("missing envelope version")
+)
+
+// Envelope is the versioned wire format of the messages published on the
+// chat topics. It is encoded either as JSON or protobuf (see proto.go).
+type Envelope struct {
+	Version    uint32
+	ID         string
+	Timestamp  int64 // unix milliseconds
+	Type       Type
+	Room       string
+	SenderID   string
+	SenderNick string
+	Payload    []byte
+	// Encrypted envelopes carry another envelope in the payload, sealed with
+	// the key of the room. See RoomKey.
+	Encrypted bool `json:",omitempty"`
+	// Legacy envelopes were converted from the JSON messages of the peers
+	// predating the envelope. They carry no room, ID nor timestamp.
+	Legacy bool `json:"-"`
+}
+
+// legacyMessage is the JSON message sent by peers predating the envelope
+type legacyMessage struct {
+	Message    string
+	SenderID   string
+	SenderNick string
+}
+
+// New creates an envelope of the given type with a fresh ID and the current time.
+func New(typ Type, room string, senderID string, senderNick string, payload []byte) *Envelope {
+	return &Envelope{
+		Version:    Version,
+		ID:         NewID(),
+		Timestamp:  time.Now().UnixMilli(),
+		Type:       typ,
+		Room:       room,
+		SenderID:   senderID,
+		SenderNick: senderNick,
+		Payload:    payload,
+	}
+}
+
+// NewID returns a random message identifier
+func NewID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Time returns the envelope timestamp as a time.Time
+func (e *Envelope) Time() time.Time {
+	return time.UnixMilli(e.Timestamp)
+}
+
+// ParseFormat validates the name of an encoding format.
+func ParseFormat(name string) (Format, error) {
+	switch Format(name) {
+	case FormatJSON, FormatProtobuf:
+		return Format(name), nil
+	case "":
+		return FormatProtobuf, nil
+	default:
+		return "", fmt.Errorf("unknown wire format %q", name)
+	}
+}
+
+// Encode serializes the envelope using the given format.
+func Encode(e *Envelope, format Format) ([]byte, error) {
+	switch format {
+	case FormatJSON:
+		return json.Marshal(e)
+	case FormatProtobuf:
+		return e.MarshalProto(), nil
+	default:
+		return nil, fmt.Errorf("unknown wire format %q", format)
+	}
+}
+
+// Decode parses an envelope in any of the supported formats. JSON messages
+// from peers predating the envelope are converted to a legacy chat envelope
+// without ID nor timestamp.
+func Decode(data []byte) (*Envelope, error) {
+	if len(data) == 0 {
+		return nil, ErrEmpty
+	}
+
+	e := new(Envelope)
+	// a JSON object always starts with '{', which is not a valid protobuf tag for our schema
+	if data[0] == '{' {
+		if err := json.Unmarshal(data, e); err != nil {
+			return nil, fmt.Errorf("invalid JSON envelope: %w", err)
+		}
+		if e.Version == 0 {
+			return decodeLegacy(data)
+		}
+	} else if err := e.UnmarshalProto(data); err != nil {
+		return nil, fmt.Errorf("invalid protobuf envelope: %w", err)
+	} else if e.Version == 0 {
+		// only the JSON messages of older peers come without version, a
+		// protobuf one would escape the checks of the room and timestamp
+		return nil, ErrMissingVersion
+	}
+
+	if e.Version > Version {
+		return nil, fmt.Errorf("%w: %d", ErrUnsupportedVersion, e.Version)
+	}
+	return e, nil
+}
+
+func decodeLegacy(data []byte) (*Envelope, error) {
+	lm := new(legacyMessage)
+	if err := json.Unmarshal(data, lm); err != nil {
+		return nil, fmt.Errorf("invalid JSON message: %w", err)
+	}
+	return &Envelope{
+		Type:       TypeChat,
+		SenderID:   lm.SenderID,
+		SenderNick: lm.SenderNick,
+		Payload:    []byte(lm.Message),
+		Legacy:     true,
+	}, nil
+}
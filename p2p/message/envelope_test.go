@@ -0,0 +1,122 @@
+package message
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+func TestEncodeDecode(t *testing.T) {
+	envelopes := map[string]*Envelope{
+		"chat":      New(TypeChat, "lobby", "12D3KooW", "alice", []byte("hello")),
+		"empty":     {Version: Version},
+		"encrypted": {Version: Version, ID: "id", Type: TypeChat, Room: "0123", Payload: []byte{0, 1, 2}, Encrypted: true},
+		"negative":  {Version: Version, Timestamp: -1, Type: TypeNick},
+	}
+	for name, e := range envelopes {
+		for _, format := range []Format{FormatJSON, FormatProtobuf} {
+			t.Run(name+"/"+string(format), func(t *testing.T) {
+				data, err := Encode(e, format)
+				if err != nil {
+					t.Fatal(err)
+				}
+				decoded, err := Decode(data)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !reflect.DeepEqual(decoded, e) {
+					t.Errorf("got %+v, want %+v", decoded, e)
+				}
+			})
+		}
+	}
+}
+
+func TestDecodeErrors(t *testing.T) {
+	newer := &Envelope{Version: Version + 1, Type: TypeChat}
+	// an envelope without version would skip the checks of the legacy messages
+	unversioned := &Envelope{ID: "id", Timestamp: 1, Type: TypeChat, Room: "other", SenderID: "12D3KooW"}
+	tests := []struct {
+		name    string
+		data    []byte
+		wantErr error
+	}{
+		{name: "empty", data: nil, wantErr: ErrEmpty},
+		{name: "invalid JSON", data: []byte(`{"Version":`)},
+		{name: "JSON with wrong types", data: []byte(`{"Version":1,"Room":42}`)},
+		{name: "truncated tag", data: []byte{0x80}},
+		{name: "truncated varint", data: protowire.AppendTag(nil, fieldVersion, protowire.VarintType)},
+		{name: "truncated bytes", data: append(protowire.AppendTag(nil, fieldPayload, protowire.BytesType), 10, 1)},
+		{name: "varint field as bytes", data: protowire.AppendString(protowire.AppendTag(nil, fieldTimestamp, protowire.BytesType), "x")},
+		{name: "newer protobuf version", data: newer.MarshalProto(), wantErr: ErrUnsupportedVersion},
+		{name: "protobuf without version", data: unversioned.MarshalProto(), wantErr: ErrMissingVersion},
+		{name: "newer JSON version", data: []byte(`{"Version":2,"Type":1}`), wantErr: ErrUnsupportedVersion},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e, err := Decode(tt.data)
+			if err == nil {
+				t.Fatalf("expected an error, got %+v", e)
+			}
+			if tt.wantErr != nil && !errors.Is(err, tt.wantErr) {
+				t.Errorf("got error %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestDecodeUnknownFields(t *testing.T) {
+	e := &Envelope{Version: Version, ID: "id", Type: TypeChat, Payload: []byte("hi")}
+	data := e.MarshalProto()
+	data = protowire.AppendTag(data, 100, protowire.VarintType)
+	data = protowire.AppendVarint(data, 7)
+	data = protowire.AppendTag(data, 101, protowire.BytesType)
+	data = protowire.AppendString(data, "from a newer peer")
+	data = protowire.AppendTag(data, 102, protowire.Fixed64Type)
+	data = protowire.AppendFixed64(data, 1)
+
+	decoded, err := Decode(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(decoded, e) {
+		t.Errorf("got %+v, want %+v", decoded, e)
+	}
+}
+
+func TestDecodeLegacy(t *testing.T) {
+	e, err := Decode([]byte(`{"Message":"hello","SenderID":"12D3KooW","SenderNick":"alice"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &Envelope{Type: TypeChat, SenderID: "12D3KooW", SenderNick: "alice", Payload: []byte("hello"), Legacy: true}
+	if !reflect.DeepEqual(e, want) {
+		t.Errorf("got %+v, want %+v", e, want)
+	}
+}
+
+func TestParseFormat(t *testing.T) {
+	tests := []struct {
+		name    string
+		want    Format
+		wantErr bool
+	}{
+		{name: "json", want: FormatJSON},
+		{name: "protobuf", want: FormatProtobuf},
+		{name: "", want: FormatProtobuf},
+		{name: "xml", wantErr: true},
+		{name: "JSON", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := ParseFormat(tt.name)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseFormat(%q): got error %v, want error %v", tt.name, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("ParseFormat(%q): got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
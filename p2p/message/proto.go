@@ -0,0 +1,150 @@
+package message
+
+import (
+	"fmt"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// The protobuf encoding of the envelopes is written by hand with protowire,
+// the field numbers below being the only definition of the wire format. It
+// matches the following schema, for the peers written in other languages:
+//
+//	syntax = "proto3";
+//	package p2pchat.message;
+//
+//	enum Type {
+//	  TYPE_UNSPECIFIED = 0;
+//	  TYPE_CHAT = 1;
+//	  TYPE_ACL = 2;
+//	  TYPE_FILE = 3;
+//	  TYPE_PRESENCE = 4;
+//	  TYPE_NICK = 5;
+//	}
+//
+//	message Envelope {
+//	  uint32 version = 1;
+//	  string id = 2;
+//	  int64 timestamp = 3;  // unix milliseconds
+//	  Type type = 4;
+//	  string room = 5;
+//	  string sender_id = 6;
+//	  string sender_nick = 7;
+//	  bytes payload = 8;
+//	  bool encrypted = 9;   // the payload is another envelope, encrypted with the room key
+//	}
+//
+// New fields and types must be added both to the schema and to the code.
+
+// field numbers of the Envelope message
+const (
+	fieldVersion    protowire.Number = 1
+	fieldID         protowire.Number = 2
+	fieldTimestamp  protowire.Number = 3
+	fieldType       protowire.Number = 4
+	fieldRoom       protowire.Number = 5
+	fieldSenderID   protowire.Number = 6
+	fieldSenderNick protowire.Number = 7
+	fieldPayload    protowire.Number = 8
+	fieldEncrypted  protowire.Number = 9
+)
+
+// MarshalProto encodes the envelope in the protobuf wire format. As in proto3,
+// fields holding their zero value are omitted.
+func (e *Envelope) MarshalProto() []byte {
+	var b []byte
+	if e.Version != 0 {
+		b = protowire.AppendTag(b, fieldVersion, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(e.Version))
+	}
+	b = appendString(b, fieldID, e.ID)
+	if e.Timestamp != 0 {
+		b = protowire.AppendTag(b, fieldTimestamp, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(e.Timestamp))
+	}
+	if e.Type != TypeUnspecified {
+		b = protowire.AppendTag(b, fieldType, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(e.Type))
+	}
+	b = appendString(b, fieldRoom, e.Room)
+	b = appendString(b, fieldSenderID, e.SenderID)
+	b = appendString(b, fieldSenderNick, e.SenderNick)
+	if len(e.Payload) > 0 {
+		b = protowire.AppendTag(b, fieldPayload, protowire.BytesType)
+		b = protowire.AppendBytes(b, e.Payload)
+	}
+	if e.Encrypted {
+		b = protowire.AppendTag(b, fieldEncrypted, protowire.VarintType)
+		b = protowire.AppendVarint(b, 1)
+	}
+	return b
+}
+
+// UnmarshalProto decodes an envelope from the protobuf wire format. Unknown
+// fields are skipped so that newer peers can extend the schema.
+func (e *Envelope) UnmarshalProto(b []byte) error {
+	*e = Envelope{}
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+
+		switch {
+		case typ == protowire.VarintType && (num == fieldVersion || num == fieldTimestamp || num == fieldType || num == fieldEncrypted):
+			v, n := protowire.ConsumeVarint(b)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			b = b[n:]
+			switch num {
+			case fieldVersion:
+				e.Version = uint32(v)
+			case fieldTimestamp:
+				e.Timestamp = int64(v)
+			case fieldType:
+				e.Type = Type(v)
+			case fieldEncrypted:
+				e.Encrypted = v != 0
+			}
+
+		case typ == protowire.BytesType && num >= fieldID && num <= fieldPayload:
+			v, n := protowire.ConsumeBytes(b)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			b = b[n:]
+			switch num {
+			case fieldID:
+				e.ID = string(v)
+			case fieldRoom:
+				e.Room = string(v)
+			case fieldSenderID:
+				e.SenderID = string(v)
+			case fieldSenderNick:
+				e.SenderNick = string(v)
+			case fieldPayload:
+				e.Payload = append([]byte(nil), v...)
+			default:
+				return fmt.Errorf("unexpected wire type for field %d", num)
+			}
+
+		default:
+			n := protowire.ConsumeFieldValue(num, typ, b)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			b = b[n:]
+		}
+	}
+	return nil
+}
+
+func appendString(b []byte, num protowire.Number, s string) []byte {
+	if s == "" {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendString(b, s)
+}
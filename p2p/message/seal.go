@@ -0,0 +1,113 @@
+package message
+
+import (
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+	"golang.org/x/crypto/scrypt"
+)
+
+// scrypt parameters used to derive the room secret from the room name and passphrase
+const (
+	roomScryptN = 1 << 15
+	roomScryptR = 8
+	roomScryptP = 1
+)
+
+// ErrDecrypt is returned when an encrypted envelope can't be opened with the room key
+var ErrDecrypt = errors.New("failed to decrypt message")
+
+// RoomKey holds the secrets of an encrypted room, derived from its name and
+// passphrase: the key encrypting the payloads, and the ID used in place of the
+// room name on the wire.
+type RoomKey struct {
+	aead cipher.AEAD
+	id   string
+}
+
+// DeriveRoomKey derives the key of the encrypted room with the given name and
+// passphrase. The peers using the same name and passphrase get the same key.
+func DeriveRoomKey(roomName, passphrase string) (*RoomKey, error) {
+	secret, err := scrypt.Key([]byte(passphrase), []byte("p2p-chat room:"+roomName), roomScryptN, roomScryptR, roomScryptP, 32)
+	if err != nil {
+		return nil, fmt.Errorf("failed to derive room key: %w", err)
+	}
+	kdf := hkdf.New(sha256.New, secret, nil, []byte("p2p-chat room encryption key"))
+	key := make([]byte, chacha20poly1305.KeySize)
+	if _, err := io.ReadFull(kdf, key); err != nil {
+		return nil, fmt.Errorf("failed to derive room key: %w", err)
+	}
+	aead, err := chacha20poly1305.NewX(key)
+	if err != nil {
+		return nil, err
+	}
+	kdf = hkdf.New(sha256.New, secret, nil, []byte("p2p-chat room id"))
+	id := make([]byte, 16)
+	if _, err := io.ReadFull(kdf, id); err != nil {
+		return nil, fmt.Errorf("failed to derive room id: %w", err)
+	}
+	return &RoomKey{aead: aead, id: hex.EncodeToString(id)}, nil
+}
+
+// ID returns the opaque identifier of the room, which does not reveal its name
+func (k *RoomKey) ID() string {
+	return k.id
+}
+
+// Seal encrypts the envelope of a chat message. The returned envelope only
+// keeps the fields needed to validate and route it, carrying the room ID in
+// place of the room name, and the whole encrypted envelope as payload.
+func (k *RoomKey) Seal(e *Envelope) (*Envelope, error) {
+	nonce := make([]byte, k.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	sealed := &Envelope{
+		Version:   e.Version,
+		ID:        e.ID,
+		Timestamp: e.Timestamp,
+		Type:      e.Type,
+		Room:      k.id,
+		SenderID:  e.SenderID,
+		Encrypted: true,
+	}
+	// the nonce is prepended to the ciphertext
+	sealed.Payload = k.aead.Seal(nonce, nonce, e.MarshalProto(), sealed.additionalData())
+	return sealed, nil
+}
+
+// Open decrypts an envelope sealed with the same room key, and checks the
+// fields left in clear match the encrypted ones.
+func (k *RoomKey) Open(sealed *Envelope) (*Envelope, error) {
+	if !sealed.Encrypted {
+		return nil, errors.New("message is not encrypted")
+	}
+	if len(sealed.Payload) < k.aead.NonceSize() {
+		return nil, ErrDecrypt
+	}
+	nonce, ciphertext := sealed.Payload[:k.aead.NonceSize()], sealed.Payload[k.aead.NonceSize():]
+	plaintext, err := k.aead.Open(nil, nonce, ciphertext, sealed.additionalData())
+	if err != nil {
+		return nil, ErrDecrypt
+	}
+	e := new(Envelope)
+	if err := e.UnmarshalProto(plaintext); err != nil {
+		return nil, fmt.Errorf("invalid encrypted envelope: %w", err)
+	}
+	if e.Version != sealed.Version || e.ID != sealed.ID || e.SenderID != sealed.SenderID || e.Type != sealed.Type || e.Timestamp != sealed.Timestamp {
+		return nil, errors.New("encrypted envelope does not match its header")
+	}
+	return e, nil
+}
+
+// additionalData binds the ciphertext to the room it was published in
+func (e *Envelope) additionalData() []byte {
+	return []byte(e.Room)
+}
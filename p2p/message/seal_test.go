@@ -0,0 +1,120 @@
+package message
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestSealOpen(t *testing.T) {
+	key, err := DeriveRoomKey("secret-room", "passphrase")
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := New(TypeChat, "secret-room", "12D3KooW", "alice", []byte("hello"))
+	sealed, err := key.Seal(e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !sealed.Encrypted || sealed.Room != key.ID() || sealed.SenderNick != "" {
+		t.Errorf("sealed envelope leaks the room or sender: %+v", sealed)
+	}
+
+	// the sealed envelope goes through the wire format before being opened
+	data, err := Encode(sealed, FormatProtobuf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	received, err := Decode(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opened, err := key.Open(received)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(opened, e) {
+		t.Errorf("got %+v, want %+v", opened, e)
+	}
+}
+
+func TestDeriveRoomKey(t *testing.T) {
+	key, err := DeriveRoomKey("room", "passphrase")
+	if err != nil {
+		t.Fatal(err)
+	}
+	same, err := DeriveRoomKey("room", "passphrase")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key.ID() != same.ID() {
+		t.Error("the same room and passphrase derived different IDs")
+	}
+	for _, other := range [][2]string{{"room", "other"}, {"other", "passphrase"}} {
+		k, err := DeriveRoomKey(other[0], other[1])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if k.ID() == key.ID() {
+			t.Errorf("room %q with passphrase %q derived the same ID", other[0], other[1])
+		}
+	}
+}
+
+func TestOpenErrors(t *testing.T) {
+	key, err := DeriveRoomKey("room", "passphrase")
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := New(TypeChat, "room", "12D3KooW", "alice", []byte("hello"))
+	sealed, err := key.Seal(e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// edit returns a copy of the sealed envelope modified by fn
+	edit := func(fn func(s *Envelope)) *Envelope {
+		s := *sealed
+		s.Payload = append([]byte(nil), sealed.Payload...)
+		fn(&s)
+		return &s
+	}
+
+	wrongPassphrase, err := DeriveRoomKey("room", "wrong")
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherRoom, err := DeriveRoomKey("other", "passphrase")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		key     *RoomKey
+		sealed  *Envelope
+		wantErr error
+	}{
+		{name: "wrong passphrase", key: wrongPassphrase, sealed: sealed, wantErr: ErrDecrypt},
+		{name: "other room", key: otherRoom, sealed: sealed, wantErr: ErrDecrypt},
+		{name: "not encrypted", key: key, sealed: e},
+		{name: "short payload", key: key, sealed: edit(func(s *Envelope) { s.Payload = s.Payload[:10] }), wantErr: ErrDecrypt},
+		{name: "tampered payload", key: key, sealed: edit(func(s *Envelope) { s.Payload[len(s.Payload)-1] ^= 1 }), wantErr: ErrDecrypt},
+		{name: "replayed in another room", key: key, sealed: edit(func(s *Envelope) { s.Room = otherRoom.ID() }), wantErr: ErrDecrypt},
+		{name: "forged sender", key: key, sealed: edit(func(s *Envelope) { s.SenderID = "12D3KooWmallory" })},
+		{name: "forged ID", key: key, sealed: edit(func(s *Envelope) { s.ID = NewID() })},
+		{name: "forged type", key: key, sealed: edit(func(s *Envelope) { s.Type = TypeFile })},
+		{name: "forged timestamp", key: key, sealed: edit(func(s *Envelope) { s.Timestamp++ })},
+		{name: "forged version", key: key, sealed: edit(func(s *Envelope) { s.Version++ })},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opened, err := tt.key.Open(tt.sealed)
+			if err == nil {
+				t.Fatalf("expected an error, got %+v", opened)
+			}
+			if tt.wantErr != nil && !errors.Is(err, tt.wantErr) {
+				t.Errorf("got error %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
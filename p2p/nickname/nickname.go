@@ -0,0 +1,154 @@
+package nickname
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// signaturePrefix separates the signatures of the announcements from the
+// other signatures made with the node identity
+const signaturePrefix = "p2p-chat nick:"
+
+// MaxLength is the maximum length of a nickname in bytes
+const MaxLength = 64
+
+// ErrInvalidSignature is returned when an announcement is not signed by its peer
+var ErrInvalidSignature = errors.New("invalid nickname announcement signature")
+
+// Announcement binds a nickname to a peer ID, signed by the peer. It is
+// encoded as JSON on the wire and in the history store, so that it can be
+// verified again when loaded.
+type Announcement struct {
+	Peer string
+	Nick string
+	// Timestamp orders the announcements of a peer, so that the latest nickname is kept
+	Timestamp int64  // unix milliseconds
+	Signature []byte `json:",omitempty"`
+}
+
+// New creates an announcement of the nickname, signed with the private key of the peer
+func New(key crypto.PrivKey, nick string) (*Announcement, error) {
+	if err := Validate(nick); err != nil {
+		return nil, err
+	}
+	id, err := peer.IDFromPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	a := &Announcement{
+		Peer:      id.String(),
+		Nick:      nick,
+		Timestamp: time.Now().UnixMilli(),
+	}
+	data, err := a.signedData()
+	if err != nil {
+		return nil, err
+	}
+	if a.Signature, err = key.Sign(data); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// reserved are the characters a nickname can't contain: the brackets of the
+// terminal UI color tags, and the separator of the peer ID suffix added to the
+// nicknames used by several peers, e.g. alice#kXz9Qe
+const reserved = "[]#"
+
+// Validate checks the nickname is not empty, nor too long, and is printable
+// UTF-8 text, as it is shown in the terminal and in the browser. It can't
+// contain reserved characters, nor invisible ones such as the zero-width and
+// bidirectional marks, nor start or end with spaces, so that it can't pass for
+// another nickname once displayed.
+func Validate(nick string) error {
+	if nick == "" {
+		return errors.New("empty nickname")
+	}
+	if len(nick) > MaxLength {
+		return fmt.Errorf("nickname longer than %d bytes", MaxLength)
+	}
+	if !utf8.ValidString(nick) {
+		return errors.New("nickname is not valid UTF-8")
+	}
+	if strings.IndexFunc(nick, notPrintable) >= 0 {
+		return errors.New("nickname contains control or invisible characters")
+	}
+	if strings.ContainsAny(nick, reserved) {
+		return fmt.Errorf("nickname contains one of the reserved characters %q", reserved)
+	}
+	if strings.TrimSpace(nick) != nick {
+		return errors.New("nickname starts or ends with spaces")
+	}
+	return nil
+}
+
+// notPrintable reports whether r is a control character, or a format character
+// such as the zero-width joiner and the bidirectional overrides, which are not
+// displayed but change how the text around them is
+func notPrintable(r rune) bool {
+	return unicode.Is(unicode.Cf, r) || !unicode.IsGraphic(r)
+}
+
+// Decode parses an encoded announcement and checks its signature
+func Decode(data []byte) (*Announcement, error) {
+	a := new(Announcement)
+	if err := json.Unmarshal(data, a); err != nil {
+		return nil, fmt.Errorf("invalid nickname announcement: %w", err)
+	}
+	if err := a.Verify(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// Encode serializes the announcement
+func (a *Announcement) Encode() ([]byte, error) {
+	return json.Marshal(a)
+}
+
+// PeerID returns the ID of the peer announcing the nickname
+func (a *Announcement) PeerID() (peer.ID, error) {
+	return peer.Decode(a.Peer)
+}
+
+// Verify checks the announcement is signed by its peer
+func (a *Announcement) Verify() error {
+	if err := Validate(a.Nick); err != nil {
+		return err
+	}
+	id, err := a.PeerID()
+	if err != nil {
+		return fmt.Errorf("invalid peer ID: %w", err)
+	}
+	pub, err := id.ExtractPublicKey()
+	if err != nil {
+		return fmt.Errorf("failed to extract public key of peer: %w", err)
+	}
+	data, err := a.signedData()
+	if err != nil {
+		return err
+	}
+	if ok, err := pub.Verify(data, a.Signature); err != nil || !ok {
+		return ErrInvalidSignature
+	}
+	return nil
+}
+
+// signedData returns the bytes covered by the signature: the announcement without its signature
+func (a *Announcement) signedData() ([]byte, error) {
+	unsigned := *a
+	unsigned.Signature = nil
+	data, err := json.Marshal(&unsigned)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(signaturePrefix), data...), nil
+}
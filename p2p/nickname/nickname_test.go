@@ -0,0 +1,151 @@
+package nickname
+
+import (
+	"crypto/rand"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+func newKey(t *testing.T) (crypto.PrivKey, peer.ID) {
+	t.Helper()
+	key, _, err := crypto.GenerateEd25519Key(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := peer.IDFromPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key, id
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		nick    string
+		wantErr bool
+	}{
+		{nick: "alice"},
+		{nick: "álîcé 🦊"},
+		{nick: strings.Repeat("a", MaxLength)},
+		{nick: "", wantErr: true},
+		{nick: "alice\nbob", wantErr: true},
+		{nick: "alice\x1b[31m", wantErr: true},
+		{nick: "alice\u0085", wantErr: true},
+		{nick: "alice\xff", wantErr: true},
+		{nick: strings.Repeat("a", MaxLength+1), wantErr: true},
+		// names rendering as another one in the terminal UI
+		{nick: "bob[-]", wantErr: true},
+		{nick: "[red]bob", wantErr: true},
+		{nick: "bob ", wantErr: true},
+		{nick: " bob", wantErr: true},
+		{nick: "bob\u00a0", wantErr: true},
+		{nick: "bo\u200bb", wantErr: true},
+		{nick: "bo\u200db", wantErr: true},
+		{nick: "\u202ebob", wantErr: true},
+		{nick: "\u2066bob", wantErr: true},
+		// names copying the peer ID suffix of a duplicate nickname
+		{nick: "bob#kXz9Qe", wantErr: true},
+		{nick: "#kXz9Qe", wantErr: true},
+		// the limit is in bytes, not runes
+		{nick: strings.Repeat("é", MaxLength/2+1), wantErr: true},
+	}
+	for _, tt := range tests {
+		if err := Validate(tt.nick); (err != nil) != tt.wantErr {
+			t.Errorf("Validate(%q): got error %v, want error %v", tt.nick, err, tt.wantErr)
+		}
+	}
+}
+
+func TestNewDecode(t *testing.T) {
+	key, id := newKey(t)
+	a, err := New(key, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := a.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := Decode(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded.Nick != "alice" || decoded.Timestamp != a.Timestamp {
+		t.Errorf("got %+v, want %+v", decoded, a)
+	}
+	if p, err := decoded.PeerID(); err != nil || p != id {
+		t.Errorf("got peer %s, %v, want %s", p, err, id)
+	}
+
+	if _, err := New(key, ""); err == nil {
+		t.Error("expected an error announcing an empty nickname")
+	}
+}
+
+func TestVerifyErrors(t *testing.T) {
+	key, _ := newKey(t)
+	_, mallory := newKey(t)
+	signed, err := New(key, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// edit returns a copy of the signed announcement modified by fn
+	edit := func(fn func(a *Announcement)) *Announcement {
+		a := *signed
+		fn(&a)
+		return &a
+	}
+
+	tests := []struct {
+		name    string
+		a       *Announcement
+		wantErr error
+	}{
+		{name: "unsigned", a: edit(func(a *Announcement) { a.Signature = nil }), wantErr: ErrInvalidSignature},
+		{name: "forged peer", a: edit(func(a *Announcement) { a.Peer = mallory.String() }), wantErr: ErrInvalidSignature},
+		{name: "tampered nick", a: edit(func(a *Announcement) { a.Nick = "bob" }), wantErr: ErrInvalidSignature},
+		{name: "replayed with a newer timestamp", a: edit(func(a *Announcement) { a.Timestamp++ }), wantErr: ErrInvalidSignature},
+		{name: "invalid peer", a: edit(func(a *Announcement) { a.Peer = "not a peer ID" })},
+		{name: "empty nick", a: edit(func(a *Announcement) { a.Nick = "" })},
+		{name: "long nick", a: edit(func(a *Announcement) { a.Nick = strings.Repeat("a", MaxLength+1) })},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.a.Verify()
+			if err == nil {
+				t.Fatal("expected an error")
+			}
+			if tt.wantErr != nil && !errors.Is(err, tt.wantErr) {
+				t.Errorf("got error %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestDecodeErrors(t *testing.T) {
+	_, id := newKey(t)
+	unsigned, err := (&Announcement{Peer: id.String(), Nick: "alice"}).Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{name: "empty", data: nil},
+		{name: "invalid JSON", data: []byte(`{"Peer":`)},
+		{name: "wrong types", data: []byte(`{"Peer":1,"Nick":"alice"}`)},
+		{name: "unsigned", data: unsigned},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if a, err := Decode(tt.data); err == nil {
+				t.Errorf("expected an error, got %+v", a)
+			}
+		})
+	}
+}
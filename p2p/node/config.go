@@ -0,0 +1,40 @@
+package node
+
+import (
+	"github.com/alejoacosta74/libp2p-chat-app/p2p/discovery"
+	"github.com/alejoacosta74/libp2p-chat-app/p2p/validator"
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/pnet"
+)
+
+// Config holds the configuration used to build the libp2p node
+type Config struct {
+	// PrivKey is the node identity. If nil, libp2p generates a random key
+	PrivKey crypto.PrivKey
+	// ListenAddrs are the multiaddrs to listen on, see DefaultListenAddrs
+	ListenAddrs []string
+	// Validator holds the limits enforced on the chat topic messages
+	Validator *validator.Config
+	// Score holds the GossipSub peer scoring parameters
+	Score *ScoreConfig
+	// NAT holds the NAT traversal settings
+	NAT *NATConfig
+	// Discovery holds the settings of the peer discovery services
+	Discovery *discovery.DiscoveryConfig
+	// SwarmKey restricts the node to a private network of the peers sharing
+	// the same key, if not empty. See LoadSwarmKey.
+	SwarmKey pnet.PSK
+	// RelayService runs a circuit relay v2 service for other peers, if not nil
+	RelayService *RelayServiceConfig
+}
+
+// NewNodeConfig creates a default node configuration
+func NewNodeConfig() *Config {
+	return &Config{
+		ListenAddrs: DefaultListenAddrs,
+		Validator:   validator.NewValidatorConfig(),
+		Score:       NewScoreConfig(),
+		NAT:         NewNATConfig(),
+		Discovery:   discovery.NewDiscoveryConfig(),
+	}
+}
@@ -29,6 +29,10 @@ func (n *Node) eventLoop() {
 	for {
 		select {
 		case evt := <-sub.Out():
+			// record the reachability in order, before the events are logged concurrently
+			if e, ok := evt.(event.EvtLocalReachabilityChanged); ok {
+				n.setReachability(e.Reachability)
+			}
 			go func(evt interface{}) {
 				switch e := evt.(type) {
 				case event.EvtLocalProtocolsUpdated:
@@ -36,7 +40,7 @@ func (n *Node) eventLoop() {
 				case event.EvtLocalAddressesUpdated:
 					logger.Debugf("Event: 'Local addresses updated' - added: %+v, removed: %+v", e.Current, e.Removed)
 				case event.EvtLocalReachabilityChanged:
-					logger.Debugf("Event: 'Local reachability changed': %+v", e.Reachability)
+					logger.Infof("Event: 'Local reachability changed': %s", e.Reachability)
 				case event.EvtNATDeviceTypeChanged:
 					logger.Debugf("Event: 'NAT device type changed' - DeviceType %v, transport: %v", e.NatDeviceType.String(), e.TransportProtocol.String())
 				case event.EvtPeerProtocolsUpdated:
@@ -46,7 +50,7 @@ func (n *Node) eventLoop() {
 				case event.EvtPeerIdentificationFailed:
 					logger.Debugf("Event 'Peer identification failed' - peer: %v, reason: %v", e.Peer, e.Reason.Error())
 				case event.EvtPeerConnectednessChanged:
-					logger.Debugf("Event: 'Peer connectedness change' - Peer %s (peerInfo: %+v) is now %s, protocols: %v, addresses: %v", e.Peer, e.Peer, e.Connectedness)
+					logger.Debugf("Event: 'Peer connectedness change' - Peer %s is now %s", e.Peer, e.Connectedness)
 				case *event.EvtNATDeviceTypeChanged:
 					logger.Debugf("Event `NAT device type changed` - DeviceType %v, transport: %v", e.NatDeviceType.String(), e.TransportProtocol.String())
 				default:
@@ -0,0 +1,141 @@
+package node
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/alejoacosta74/go-logger"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// MetricsNamespace prefixes the names of the metrics of the chat node
+const MetricsNamespace = "p2pchat"
+
+var (
+	bandwidthTotalDesc = prometheus.NewDesc(
+		MetricsNamespace+"_bandwidth_bytes_total",
+		"Total bytes transferred by the host.",
+		[]string{"direction"}, nil)
+	bandwidthRateDesc = prometheus.NewDesc(
+		MetricsNamespace+"_bandwidth_rate_bytes",
+		"Bytes per second transferred by the host.",
+		[]string{"direction"}, nil)
+	protocolTotalDesc = prometheus.NewDesc(
+		MetricsNamespace+"_protocol_bandwidth_bytes_total",
+		"Total bytes transferred by protocol.",
+		[]string{"protocol", "direction"}, nil)
+	protocolRateDesc = prometheus.NewDesc(
+		MetricsNamespace+"_protocol_bandwidth_rate_bytes",
+		"Bytes per second transferred by protocol.",
+		[]string{"protocol", "direction"}, nil)
+	peersDesc = prometheus.NewDesc(
+		MetricsNamespace+"_peers",
+		"Number of connected peers.",
+		nil, nil)
+	connectionsDesc = prometheus.NewDesc(
+		MetricsNamespace+"_connections",
+		"Number of open connections.",
+		nil, nil)
+	topicPeersDesc = prometheus.NewDesc(
+		MetricsNamespace+"_topic_peers",
+		"Number of pubsub peers subscribed to each joined topic.",
+		[]string{"topic"}, nil)
+	validationRejectsDesc = prometheus.NewDesc(
+		MetricsNamespace+"_validation_rejected_total",
+		"Chat topic messages dropped by the validator, by reason.",
+		[]string{"reason"}, nil)
+)
+
+// nodeCollector reads the state of the node when the metrics are scraped
+type nodeCollector struct {
+	n *Node
+}
+
+// Describe implements prometheus.Collector
+func (c *nodeCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- bandwidthTotalDesc
+	ch <- bandwidthRateDesc
+	ch <- protocolTotalDesc
+	ch <- protocolRateDesc
+	ch <- peersDesc
+	ch <- connectionsDesc
+	ch <- topicPeersDesc
+	ch <- validationRejectsDesc
+}
+
+// Collect implements prometheus.Collector
+func (c *nodeCollector) Collect(ch chan<- prometheus.Metric) {
+	n := c.n
+
+	// bandwidth metrics
+	bw := n.bandwidthCounter.GetBandwidthTotals()
+	ch <- prometheus.MustNewConstMetric(bandwidthTotalDesc, prometheus.CounterValue, float64(bw.TotalIn), "in")
+	ch <- prometheus.MustNewConstMetric(bandwidthTotalDesc, prometheus.CounterValue, float64(bw.TotalOut), "out")
+	ch <- prometheus.MustNewConstMetric(bandwidthRateDesc, prometheus.GaugeValue, bw.RateIn, "in")
+	ch <- prometheus.MustNewConstMetric(bandwidthRateDesc, prometheus.GaugeValue, bw.RateOut, "out")
+	for proto, stats := range n.bandwidthCounter.GetBandwidthByProtocol() {
+		ch <- prometheus.MustNewConstMetric(protocolTotalDesc, prometheus.CounterValue, float64(stats.TotalIn), string(proto), "in")
+		ch <- prometheus.MustNewConstMetric(protocolTotalDesc, prometheus.CounterValue, float64(stats.TotalOut), string(proto), "out")
+		ch <- prometheus.MustNewConstMetric(protocolRateDesc, prometheus.GaugeValue, stats.RateIn, string(proto), "in")
+		ch <- prometheus.MustNewConstMetric(protocolRateDesc, prometheus.GaugeValue, stats.RateOut, string(proto), "out")
+	}
+
+	// peer metrics
+	ch <- prometheus.MustNewConstMetric(peersDesc, prometheus.GaugeValue, float64(len(n.Network().Peers())))
+	ch <- prometheus.MustNewConstMetric(connectionsDesc, prometheus.GaugeValue, float64(len(n.Network().Conns())))
+
+	// pubsub metrics
+	if n.PubSub != nil {
+		for _, topic := range n.PubSub.GetTopics() {
+			ch <- prometheus.MustNewConstMetric(topicPeersDesc, prometheus.GaugeValue, float64(len(n.PubSub.ListPeers(topic))), topic)
+		}
+	}
+	for reason, count := range n.validator.Rejections() {
+		ch <- prometheus.MustNewConstMetric(validationRejectsDesc, prometheus.CounterValue, float64(count), reason)
+	}
+}
+
+// newMetricsRegistry creates the registry holding the metrics of the node, the
+// libp2p metrics and the Go runtime metrics
+func newMetricsRegistry() (*prometheus.Registry, *prometheus.CounterVec) {
+	reg := prometheus.NewRegistry()
+	discovered := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: MetricsNamespace,
+		Name:      "peers_discovered_total",
+		Help:      "Peers found by each discovery mechanism.",
+	}, []string{"mechanism"})
+	reg.MustRegister(
+		discovered,
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+	return reg, discovered
+}
+
+// MetricsRegistry returns the registry served on the metrics endpoint, on
+// which other components can register their own metrics
+func (n *Node) MetricsRegistry() prometheus.Registerer {
+	return n.metrics
+}
+
+// ServeMetrics exposes the Prometheus metrics on http://addr/metrics until the node is closed
+func (n *Node) ServeMetrics(addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.Handle("GET /metrics", promhttp.HandlerFor(n.metrics, promhttp.HandlerOpts{Registry: n.metrics}))
+	n.metricsServer = &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		if err := n.metricsServer.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logger.Errorf("metrics endpoint stopped: %v", err)
+		}
+	}()
+	logger.Infof("Metrics available at http://%s/metrics", ln.Addr())
+	return nil
+}
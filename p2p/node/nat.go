@@ -0,0 +1,102 @@
+package node
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/libp2p/go-libp2p"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+// NATConfig holds the NAT traversal settings. It is loaded from the "nat"
+// section of the config file.
+type NATConfig struct {
+	// PortMap opens a port on the router with UPnP or NAT-PMP
+	PortMap bool `mapstructure:"port-map"`
+	// HolePunching upgrades relayed connections to direct ones with DCUtR
+	HolePunching bool `mapstructure:"hole-punching"`
+	// AutoNAT helps other peers find out whether they are reachable
+	AutoNAT bool `mapstructure:"autonat"`
+	// ForcePublic skips AutoNAT and assumes the node is publicly reachable,
+	// e.g. for an infrastructure node with a public IP address
+	ForcePublic bool `mapstructure:"force-public"`
+	// StaticRelays are the multiaddrs, including the peer ID, of the circuit
+	// relays to reserve a slot on when the node is not publicly reachable
+	StaticRelays []string `mapstructure:"static-relays"`
+}
+
+// NewNATConfig creates a default NAT traversal configuration
+func NewNATConfig() *NATConfig {
+	return &NATConfig{
+		PortMap:      true,
+		HolePunching: true,
+		AutoNAT:      true,
+	}
+}
+
+// options returns the libp2p options enabling the NAT traversal features.
+// The circuit relay v2 client is always enabled, so that we can dial peers
+// through relays.
+func (c *NATConfig) options() ([]libp2p.Option, error) {
+	opts := []libp2p.Option{libp2p.EnableRelay()}
+	if c.PortMap {
+		opts = append(opts, libp2p.NATPortMap())
+	}
+	if c.HolePunching {
+		opts = append(opts, libp2p.EnableHolePunching())
+	}
+	if c.AutoNAT {
+		opts = append(opts, libp2p.EnableNATService())
+	}
+	if c.ForcePublic {
+		opts = append(opts, libp2p.ForceReachabilityPublic())
+	}
+	if len(c.StaticRelays) > 0 {
+		relays, err := parseAddrInfos(c.StaticRelays)
+		if err != nil {
+			return nil, fmt.Errorf("invalid static relay: %w", err)
+		}
+		opts = append(opts, libp2p.EnableAutoRelayWithStaticRelays(relays))
+	}
+	return opts, nil
+}
+
+// parseAddrInfos parses multiaddrs ending with /p2p/<peerID>, merging the
+// addresses of the same peer
+func parseAddrInfos(addrs []string) ([]peer.AddrInfo, error) {
+	maddrs := make([]ma.Multiaddr, 0, len(addrs))
+	for _, s := range addrs {
+		addr, err := ma.NewMultiaddr(s)
+		if err != nil {
+			return nil, fmt.Errorf("%q: %w", s, err)
+		}
+		maddrs = append(maddrs, addr)
+	}
+	return peer.AddrInfosFromP2pAddrs(maddrs...)
+}
+
+// Reachability returns whether the node is reachable from the internet, as
+// last reported by AutoNAT
+func (n *Node) Reachability() network.Reachability {
+	n.reachabilityMu.RLock()
+	defer n.reachabilityMu.RUnlock()
+	return n.reachability
+}
+
+// Relayed reports whether the node advertises addresses through a circuit relay
+func (n *Node) Relayed() bool {
+	for _, addr := range n.Addrs() {
+		if strings.Contains(addr.String(), "/p2p-circuit") {
+			return true
+		}
+	}
+	return false
+}
+
+func (n *Node) setReachability(r network.Reachability) {
+	n.reachabilityMu.Lock()
+	defer n.reachabilityMu.Unlock()
+	n.reachability = r
+}
@@ -3,13 +3,19 @@ package node
 import (
 	"context"
 	"fmt"
+	"net/http"
+	"sync"
 
 	"github.com/alejoacosta74/go-logger"
 	"github.com/alejoacosta74/libp2p-chat-app/p2p/discovery"
+	"github.com/alejoacosta74/libp2p-chat-app/p2p/validator"
 	"github.com/libp2p/go-libp2p"
 	pubsub "github.com/libp2p/go-libp2p-pubsub"
 	"github.com/libp2p/go-libp2p/core/host"
 	libp2pmetrics "github.com/libp2p/go-libp2p/core/metrics"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/prometheus/client_golang/prometheus"
 )
 
 type Node struct {
@@ -18,37 +24,119 @@ type Node struct {
 	quitCh           chan struct{}
 	bandwidthCounter *libp2pmetrics.BandwidthCounter
 	discoveries      []discovery.PeerDiscovery
+	validator        *validator.Validator
+	scoreConfig      *ScoreConfig
+	scoresMu         sync.RWMutex
+	scores           map[peer.ID]float64 // last known pubsub peer scores
+	metrics          *prometheus.Registry
+	discovered       *prometheus.CounterVec // peers found by each discovery mechanism
+	metricsServer    *http.Server           // optional, serves the metrics endpoint
+	reachabilityMu   sync.RWMutex
+	reachability     network.Reachability // last reachability reported by AutoNAT
 	*pubsub.PubSub
 }
 
-func NewNode(ctx context.Context) *Node {
+// NewNode creates the libp2p host listening on the configured addresses, and
+// the peer discovery services
+func NewNode(ctx context.Context, cfg *Config) (*Node, error) {
+	if cfg == nil {
+		cfg = NewNodeConfig()
+	}
+	if cfg.Score == nil {
+		cfg.Score = NewScoreConfig()
+	}
+	if cfg.Score.Enabled {
+		if err := cfg.Score.Validate(); err != nil {
+			return nil, fmt.Errorf("invalid peer score configuration: %w", err)
+		}
+	}
+	listenAddrs, err := parseListenAddrs(cfg.ListenAddrs)
+	if err != nil {
+		return nil, err
+	}
+	transports, err := transportOptions(listenAddrs, len(cfg.SwarmKey) > 0)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.NAT == nil {
+		cfg.NAT = NewNATConfig()
+	}
+	natOpts, err := cfg.NAT.options()
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Discovery == nil {
+		cfg.Discovery = discovery.NewDiscoveryConfig()
+	}
+	if err := cfg.Discovery.Validate(); err != nil {
+		return nil, err
+	}
+
 	bwctr := libp2pmetrics.NewBandwidthCounter()
-	node, err := libp2p.New(
-		libp2p.ListenAddrStrings("/ip4/0.0.0.0/tcp/0"),
+	registry, discovered := newMetricsRegistry()
+	opts := []libp2p.Option{
+		libp2p.ListenAddrs(listenAddrs...),
+		libp2p.ChainOptions(transports...),
 		libp2p.BandwidthReporter(bwctr),
+		libp2p.PrometheusRegisterer(registry),
+		libp2p.ChainOptions(natOpts...),
 		// libp2p.Security(noise.ID, noise.New),
-		// libp2p.EnableRelay(),
-		// libp2p.NATPortMap(),
-	)
+	}
+	if cfg.RelayService != nil {
+		opts = append(opts, cfg.RelayService.option())
+	}
+	// refuse the connections of the peers without the swarm key
+	if len(cfg.SwarmKey) > 0 {
+		opts = append(opts, libp2p.PrivateNetwork(cfg.SwarmKey))
+	}
+	// use the persistent identity if one was provided
+	if cfg.PrivKey != nil {
+		opts = append(opts, libp2p.Identity(cfg.PrivKey))
+	}
+	node, err := libp2p.New(opts...)
 	if err != nil {
-		logger.Fatalf("failed to create host: %v", err)
+		return nil, fmt.Errorf("failed to create host: %w", err)
 	}
 
 	// Create discovery services
-	config := discovery.NewDiscoveryConfig()
-	dhtDiscovery := discovery.NewDHTDiscovery(node, config)
-	mdnsDiscovery := discovery.NewMDNSDiscovery(node, config)
+	dhtDiscovery := discovery.NewDHTDiscovery(node, cfg.Discovery)
+	mdnsDiscovery := discovery.NewMDNSDiscovery(node, cfg.Discovery)
 
-	return &Node{Host: node,
+	n := &Node{Host: node,
 		ctx:              ctx,
 		bandwidthCounter: bwctr,
 		discoveries:      []discovery.PeerDiscovery{dhtDiscovery, mdnsDiscovery},
+		validator:        validator.NewValidator(cfg.Validator),
+		scoreConfig:      cfg.Score,
+		scores:           make(map[peer.ID]float64),
+		metrics:          registry,
+		discovered:       discovered,
 	}
+	registry.MustRegister(&nodeCollector{n: n})
+	return n, nil
 }
 
-// create a new PubSub service using the GossipSub router
+// Validator returns the validator of the chat topic messages
+func (n *Node) Validator() *validator.Validator {
+	return n.validator
+}
+
+// create a new PubSub service using the GossipSub router.
+// Messages are signed and signatures are required, so that receivers can
+// trust the origin peer (From field) of every message.
 func (n *Node) CreatePubSubService() (*pubsub.PubSub, error) {
-	ps, err := pubsub.NewGossipSub(n.ctx, n)
+	opts := []pubsub.Option{
+		pubsub.WithMessageSigning(true),
+		pubsub.WithStrictSignatureVerification(true),
+	}
+	// penalise spammy or misbehaving peers
+	if n.scoreConfig.Enabled {
+		opts = append(opts,
+			pubsub.WithPeerScore(n.scoreConfig.params(), n.scoreConfig.thresholds()),
+			pubsub.WithPeerScoreInspect(pubsub.ExtendedPeerScoreInspectFn(n.inspectScores), scoreInspectInterval),
+		)
+	}
+	ps, err := pubsub.NewGossipSub(n.ctx, n, opts...)
 	if err != nil {
 		return nil, err
 	}
@@ -56,6 +144,18 @@ func (n *Node) CreatePubSubService() (*pubsub.PubSub, error) {
 	return ps, nil
 }
 
+// ConnectAddr connects to the peer at the multiaddr, which must end with /p2p/<peerID>
+func (n *Node) ConnectAddr(ctx context.Context, addr string) (peer.ID, error) {
+	info, err := peer.AddrInfoFromString(addr)
+	if err != nil {
+		return "", fmt.Errorf("invalid peer multiaddr %q: %w", addr, err)
+	}
+	if err := n.Connect(ctx, *info); err != nil {
+		return "", fmt.Errorf("failed to connect to %s: %w", info.ID, err)
+	}
+	return info.ID, nil
+}
+
 func (n *Node) Init() error {
 	// Start all discovery services
 	for _, d := range n.discoveries {
@@ -72,6 +172,7 @@ func (n *Node) Init() error {
 			}
 
 			for peer := range peerCh {
+				n.discovered.WithLabelValues(discovery.Name()).Inc()
 				if err := n.Connect(n.ctx, peer); err != nil {
 					logger.Debugf("failed to connect to peer %s: %s", peer.ID, err)
 				}
@@ -79,6 +180,21 @@ func (n *Node) Init() error {
 		}(d)
 	}
 	go n.eventLoop()
-	go n.InitStats()
+	return nil
+}
+
+// Close stops the metrics endpoint and every discovery service, and shuts down the host
+func (n *Node) Close() error {
+	if n.metricsServer != nil {
+		n.metricsServer.Close()
+	}
+	for _, d := range n.discoveries {
+		if err := d.Stop(); err != nil {
+			logger.Warnf("failed to stop discovery service: %v", err)
+		}
+	}
+	if err := n.Host.Close(); err != nil {
+		return fmt.Errorf("failed to close host: %w", err)
+	}
 	return nil
 }
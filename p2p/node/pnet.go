@@ -0,0 +1,37 @@
+package node
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+
+	"github.com/libp2p/go-libp2p/core/pnet"
+)
+
+// swarmKeyHeader is the header of the standard libp2p PSK file, followed by the hex encoded key
+const swarmKeyHeader = "/key/swarm/psk/1.0.0/\n/base16/\n"
+
+// GenerateSwarmKey creates a new random pre-shared key, encoded in the
+// standard libp2p swarm key file format
+func GenerateSwarmKey() ([]byte, error) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, fmt.Errorf("failed to generate swarm key: %w", err)
+	}
+	return []byte(swarmKeyHeader + hex.EncodeToString(key) + "\n"), nil
+}
+
+// LoadSwarmKey reads the pre-shared key of a private network from a libp2p swarm key file
+func LoadSwarmKey(path string) (pnet.PSK, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read swarm key: %w", err)
+	}
+	psk, err := pnet.DecodeV1PSK(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("invalid swarm key %s: %w", path, err)
+	}
+	return psk, nil
+}
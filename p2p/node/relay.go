@@ -0,0 +1,49 @@
+package node
+
+import (
+	"time"
+
+	"github.com/libp2p/go-libp2p"
+	relayv2 "github.com/libp2p/go-libp2p/p2p/protocol/circuitv2/relay"
+)
+
+// RelayServiceConfig holds the resource limits of the circuit relay v2 service
+type RelayServiceConfig struct {
+	// MaxReservations is the maximum number of peers holding a relay slot
+	MaxReservations int
+	// MaxReservationsPerIP is the maximum number of relay slots held from the same IP address
+	MaxReservationsPerIP int
+	// MaxCircuits is the maximum number of relayed connections of each peer
+	MaxCircuits int
+	// ReservationTTL is how long a relay slot is held before it must be refreshed
+	ReservationTTL time.Duration
+	// LimitDuration is the maximum duration of a relayed connection
+	LimitDuration time.Duration
+	// LimitData is the maximum number of bytes relayed in each direction of a connection
+	LimitData int64
+}
+
+// NewRelayServiceConfig creates a relay service configuration with the libp2p defaults
+func NewRelayServiceConfig() *RelayServiceConfig {
+	res := relayv2.DefaultResources()
+	return &RelayServiceConfig{
+		MaxReservations:      res.MaxReservations,
+		MaxReservationsPerIP: res.MaxReservationsPerIP,
+		MaxCircuits:          res.MaxCircuits,
+		ReservationTTL:       res.ReservationTTL,
+		LimitDuration:        res.Limit.Duration,
+		LimitData:            res.Limit.Data,
+	}
+}
+
+// option returns the libp2p option running the relay service. The relay
+// service only starts once the node is publicly reachable.
+func (c *RelayServiceConfig) option() libp2p.Option {
+	res := relayv2.DefaultResources()
+	res.MaxReservations = c.MaxReservations
+	res.MaxReservationsPerIP = c.MaxReservationsPerIP
+	res.MaxCircuits = c.MaxCircuits
+	res.ReservationTTL = c.ReservationTTL
+	res.Limit = &relayv2.RelayLimit{Duration: c.LimitDuration, Data: c.LimitData}
+	return libp2p.EnableRelayService(relayv2.WithResources(res))
+}
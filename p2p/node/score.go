@@ -0,0 +1,212 @@
+package node
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/alejoacosta74/go-logger"
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+const (
+	// scoreInspectInterval is how often the peer scores are refreshed
+	scoreInspectInterval = 5 * time.Second
+)
+
+// ScoreConfig holds the GossipSub peer scoring parameters. It is loaded from
+// the "pubsub.score" section of the config file.
+type ScoreConfig struct {
+	// Enabled turns peer scoring on
+	Enabled bool `mapstructure:"enabled"`
+
+	// Thresholds, see pubsub.PeerScoreThresholds
+	GossipThreshold             float64 `mapstructure:"gossip-threshold"`
+	PublishThreshold            float64 `mapstructure:"publish-threshold"`
+	GraylistThreshold           float64 `mapstructure:"graylist-threshold"`
+	AcceptPXThreshold           float64 `mapstructure:"accept-px-threshold"`
+	OpportunisticGraftThreshold float64 `mapstructure:"opportunistic-graft-threshold"`
+
+	// Global parameters, see pubsub.PeerScoreParams
+	TopicScoreCap               float64       `mapstructure:"topic-score-cap"`
+	IPColocationFactorWeight    float64       `mapstructure:"ip-colocation-factor-weight"`
+	IPColocationFactorThreshold int           `mapstructure:"ip-colocation-factor-threshold"`
+	BehaviourPenaltyWeight      float64       `mapstructure:"behaviour-penalty-weight"`
+	BehaviourPenaltyThreshold   float64       `mapstructure:"behaviour-penalty-threshold"`
+	BehaviourPenaltyDecay       time.Duration `mapstructure:"behaviour-penalty-decay"`
+	DecayInterval               time.Duration `mapstructure:"decay-interval"`
+	DecayToZero                 float64       `mapstructure:"decay-to-zero"`
+	RetainScore                 time.Duration `mapstructure:"retain-score"`
+
+	// Parameters applied to every chat topic, see pubsub.TopicScoreParams
+	Topic TopicScoreConfig `mapstructure:"topic"`
+}
+
+// TopicScoreConfig holds the score parameters of a chat topic. Decays are
+// expressed as the time it takes for a counter to decay to zero.
+type TopicScoreConfig struct {
+	TopicWeight                    float64       `mapstructure:"topic-weight"`
+	TimeInMeshWeight               float64       `mapstructure:"time-in-mesh-weight"`
+	TimeInMeshQuantum              time.Duration `mapstructure:"time-in-mesh-quantum"`
+	TimeInMeshCap                  float64       `mapstructure:"time-in-mesh-cap"`
+	FirstMessageDeliveriesWeight   float64       `mapstructure:"first-message-deliveries-weight"`
+	FirstMessageDeliveriesDecay    time.Duration `mapstructure:"first-message-deliveries-decay"`
+	FirstMessageDeliveriesCap      float64       `mapstructure:"first-message-deliveries-cap"`
+	InvalidMessageDeliveriesWeight float64       `mapstructure:"invalid-message-deliveries-weight"`
+	InvalidMessageDeliveriesDecay  time.Duration `mapstructure:"invalid-message-deliveries-decay"`
+}
+
+// NewScoreConfig creates a default peer scoring configuration. A peer sending
+// a handful of invalid messages quickly falls below the graylist threshold.
+func NewScoreConfig() *ScoreConfig {
+	return &ScoreConfig{
+		Enabled:                     true,
+		GossipThreshold:             -500,
+		PublishThreshold:            -1000,
+		GraylistThreshold:           -2500,
+		AcceptPXThreshold:           1000,
+		OpportunisticGraftThreshold: 3.5,
+		TopicScoreCap:               100,
+		IPColocationFactorWeight:    -10,
+		IPColocationFactorThreshold: 10,
+		BehaviourPenaltyWeight:      -10,
+		BehaviourPenaltyThreshold:   6,
+		BehaviourPenaltyDecay:       10 * time.Minute,
+		DecayInterval:               time.Second,
+		DecayToZero:                 0.01,
+		RetainScore:                 10 * time.Minute,
+		Topic: TopicScoreConfig{
+			TopicWeight:                    1,
+			TimeInMeshWeight:               0.01,
+			TimeInMeshQuantum:              time.Second,
+			TimeInMeshCap:                  3600,
+			FirstMessageDeliveriesWeight:   1,
+			FirstMessageDeliveriesDecay:    10 * time.Minute,
+			FirstMessageDeliveriesCap:      100,
+			InvalidMessageDeliveriesWeight: -100,
+			InvalidMessageDeliveriesDecay:  time.Hour,
+		},
+	}
+}
+
+// Validate checks the decay parameters, which are converted into the decay
+// factors of pubsub: the decay interval must be positive, the decay to zero
+// between 0 and 1, and every decay at least one decay interval long
+func (c *ScoreConfig) Validate() error {
+	if c.DecayInterval <= 0 {
+		return fmt.Errorf("decay-interval must be positive, got %s", c.DecayInterval)
+	}
+	if c.DecayToZero <= 0 || c.DecayToZero >= 1 {
+		return fmt.Errorf("decay-to-zero must be between 0 and 1, got %v", c.DecayToZero)
+	}
+	decays := []struct {
+		name  string
+		decay time.Duration
+	}{
+		{"behaviour-penalty-decay", c.BehaviourPenaltyDecay},
+		{"topic.first-message-deliveries-decay", c.Topic.FirstMessageDeliveriesDecay},
+		{"topic.invalid-message-deliveries-decay", c.Topic.InvalidMessageDeliveriesDecay},
+	}
+	for _, d := range decays {
+		if d.decay < c.DecayInterval {
+			return fmt.Errorf("%s %s is shorter than the decay interval %s", d.name, d.decay, c.DecayInterval)
+		}
+	}
+	return nil
+}
+
+// thresholds returns the pubsub score thresholds
+func (c *ScoreConfig) thresholds() *pubsub.PeerScoreThresholds {
+	return &pubsub.PeerScoreThresholds{
+		GossipThreshold:             c.GossipThreshold,
+		PublishThreshold:            c.PublishThreshold,
+		GraylistThreshold:           c.GraylistThreshold,
+		AcceptPXThreshold:           c.AcceptPXThreshold,
+		OpportunisticGraftThreshold: c.OpportunisticGraftThreshold,
+	}
+}
+
+// params returns the global pubsub score parameters. Topic parameters are set
+// on each chat topic when it is joined.
+func (c *ScoreConfig) params() *pubsub.PeerScoreParams {
+	return &pubsub.PeerScoreParams{
+		Topics:                      make(map[string]*pubsub.TopicScoreParams),
+		TopicScoreCap:               c.TopicScoreCap,
+		AppSpecificScore:            func(peer.ID) float64 { return 0 },
+		AppSpecificWeight:           1,
+		IPColocationFactorWeight:    c.IPColocationFactorWeight,
+		IPColocationFactorThreshold: c.IPColocationFactorThreshold,
+		BehaviourPenaltyWeight:      c.BehaviourPenaltyWeight,
+		BehaviourPenaltyThreshold:   c.BehaviourPenaltyThreshold,
+		BehaviourPenaltyDecay:       c.decay(c.BehaviourPenaltyDecay),
+		DecayInterval:               c.DecayInterval,
+		DecayToZero:                 c.DecayToZero,
+		RetainScore:                 c.RetainScore,
+	}
+}
+
+// TopicParams returns the score parameters of a chat topic
+func (c *ScoreConfig) TopicParams() *pubsub.TopicScoreParams {
+	t := c.Topic
+	return &pubsub.TopicScoreParams{
+		// the mesh delivery parameters (P3 and P3b) are left disabled, as
+		// chat rooms are too quiet for delivery rates to be meaningful
+		SkipAtomicValidation:           true,
+		TopicWeight:                    t.TopicWeight,
+		TimeInMeshWeight:               t.TimeInMeshWeight,
+		TimeInMeshQuantum:              t.TimeInMeshQuantum,
+		TimeInMeshCap:                  t.TimeInMeshCap,
+		FirstMessageDeliveriesWeight:   t.FirstMessageDeliveriesWeight,
+		FirstMessageDeliveriesDecay:    c.decay(t.FirstMessageDeliveriesDecay),
+		FirstMessageDeliveriesCap:      t.FirstMessageDeliveriesCap,
+		InvalidMessageDeliveriesWeight: t.InvalidMessageDeliveriesWeight,
+		InvalidMessageDeliveriesDecay:  c.decay(t.InvalidMessageDeliveriesDecay),
+	}
+}
+
+// decay converts the time it takes for a counter to decay to zero into the
+// decay factor applied at every decay interval
+func (c *ScoreConfig) decay(d time.Duration) float64 {
+	return pubsub.ScoreParameterDecayWithBase(d, c.DecayInterval, c.DecayToZero)
+}
+
+// TopicScoreParams returns the score parameters to set on the chat topics,
+// or nil if peer scoring is disabled
+func (n *Node) TopicScoreParams() *pubsub.TopicScoreParams {
+	if !n.scoreConfig.Enabled {
+		return nil
+	}
+	return n.scoreConfig.TopicParams()
+}
+
+// PeerScores returns the last known score of every pubsub peer
+func (n *Node) PeerScores() map[peer.ID]float64 {
+	n.scoresMu.RLock()
+	defer n.scoresMu.RUnlock()
+	scores := make(map[peer.ID]float64, len(n.scores))
+	for p, s := range n.scores {
+		scores[p] = s
+	}
+	return scores
+}
+
+// inspectScores is called periodically by the GossipSub router with the
+// current peer scores. It logs the peers crossing the graylist threshold.
+func (n *Node) inspectScores(snapshot map[peer.ID]*pubsub.PeerScoreSnapshot) {
+	n.scoresMu.Lock()
+	defer n.scoresMu.Unlock()
+
+	graylist := n.scoreConfig.GraylistThreshold
+	scores := make(map[peer.ID]float64, len(snapshot))
+	for p, s := range snapshot {
+		scores[p] = s.Score
+		prev := n.scores[p]
+		switch {
+		case prev >= graylist && s.Score < graylist:
+			logger.Warnf("Peer %s graylisted: score %.2f is below the threshold %.2f", p, s.Score, graylist)
+		case prev < graylist && s.Score >= graylist:
+			logger.Infof("Peer %s no longer graylisted: score %.2f", p, s.Score)
+		}
+	}
+	n.scores = scores
+}
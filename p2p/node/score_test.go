@@ -0,0 +1,63 @@
+package node
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestScoreConfigValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		edit    func(c *ScoreConfig)
+		wantErr string
+	}{
+		{name: "default", edit: func(c *ScoreConfig) {}},
+		{name: "decay equal to the interval", edit: func(c *ScoreConfig) { c.Topic.FirstMessageDeliveriesDecay = c.DecayInterval }},
+		{name: "no decay interval", edit: func(c *ScoreConfig) { c.DecayInterval = 0 }, wantErr: "decay-interval"},
+		{name: "negative decay interval", edit: func(c *ScoreConfig) { c.DecayInterval = -time.Second }, wantErr: "decay-interval"},
+		{name: "no decay to zero", edit: func(c *ScoreConfig) { c.DecayToZero = 0 }, wantErr: "decay-to-zero"},
+		{name: "decay to one", edit: func(c *ScoreConfig) { c.DecayToZero = 1 }, wantErr: "decay-to-zero"},
+		{name: "no behaviour penalty decay", edit: func(c *ScoreConfig) { c.BehaviourPenaltyDecay = 0 }, wantErr: "behaviour-penalty-decay"},
+		{name: "short first message deliveries decay", edit: func(c *ScoreConfig) { c.Topic.FirstMessageDeliveriesDecay = time.Millisecond }, wantErr: "first-message-deliveries-decay"},
+		{name: "no invalid message deliveries decay", edit: func(c *ScoreConfig) { c.Topic.InvalidMessageDeliveriesDecay = 0 }, wantErr: "invalid-message-deliveries-decay"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := NewScoreConfig()
+			tt.edit(c)
+			err := c.Validate()
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("unexpected error %v", err)
+				}
+				// the decay factors can be computed
+				c.params()
+				c.TopicParams()
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("got error %v, want an error about %s", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestNewNodeInvalidScore(t *testing.T) {
+	cfg := NewNodeConfig()
+	cfg.Score.DecayInterval = 0
+	if n, err := NewNode(context.Background(), cfg); err == nil {
+		n.Close()
+		t.Fatal("expected an error creating a node with no decay interval")
+	}
+
+	// the parameters of disabled scoring are not used
+	cfg.Score.Enabled = false
+	cfg.ListenAddrs = []string{"/ip4/127.0.0.1/tcp/0"}
+	n, err := NewNode(context.Background(), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n.Close()
+}
@@ -0,0 +1,59 @@
+package node
+
+import (
+	"fmt"
+
+	"github.com/libp2p/go-libp2p"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+// DefaultListenAddrs are the addresses the node listens on when none are configured
+var DefaultListenAddrs = []string{"/ip4/0.0.0.0/tcp/0"}
+
+// parseListenAddrs parses the configured listen addresses
+func parseListenAddrs(addrs []string) ([]ma.Multiaddr, error) {
+	if len(addrs) == 0 {
+		addrs = DefaultListenAddrs
+	}
+	maddrs := make([]ma.Multiaddr, 0, len(addrs))
+	for _, s := range addrs {
+		addr, err := ma.NewMultiaddr(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid listen address %q: %w", s, err)
+		}
+		maddrs = append(maddrs, addr)
+	}
+	return maddrs, nil
+}
+
+// transportOptions checks the listen addresses, and enables the default
+// transports of libp2p whatever they are, so that we can dial the peers
+// advertising other kinds of addresses, e.g. QUIC-only relays or browsers.
+// QUIC, WebTransport and WebRTC have their own encryption and cannot be used
+// in a private network, which only gets TCP and WebSocket.
+func transportOptions(addrs []ma.Multiaddr, private bool) ([]libp2p.Option, error) {
+	for _, addr := range addrs {
+		if private && hasProtocol(addr, ma.P_QUIC_V1) {
+			return nil, fmt.Errorf("unsupported listen address %s: quic-v1 and webtransport cannot be used with a swarm key", addr)
+		}
+		switch {
+		case hasProtocol(addr, ma.P_WSS) || hasProtocol(addr, ma.P_TLS):
+			// the websocket transport is not given a certificate
+			return nil, fmt.Errorf("unsupported listen address %s: listen on /ws behind a TLS terminating proxy instead of /wss", addr)
+		case hasProtocol(addr, ma.P_WEBTRANSPORT), hasProtocol(addr, ma.P_WS),
+			hasProtocol(addr, ma.P_QUIC_V1), hasProtocol(addr, ma.P_TCP):
+		default:
+			return nil, fmt.Errorf("unsupported listen address %s: expected tcp, quic-v1, ws or webtransport", addr)
+		}
+	}
+
+	if private {
+		return []libp2p.Option{libp2p.DefaultPrivateTransports}, nil
+	}
+	return []libp2p.Option{libp2p.DefaultTransports}, nil
+}
+
+func hasProtocol(addr ma.Multiaddr, code int) bool {
+	_, err := addr.ValueForProtocol(code)
+	return err == nil
+}
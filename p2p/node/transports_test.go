@@ -0,0 +1,59 @@
+package node
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseListenAddrs(t *testing.T) {
+	addrs, err := parseListenAddrs(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(addrs) != len(DefaultListenAddrs) || addrs[0].String() != DefaultListenAddrs[0] {
+		t.Errorf("got %v, want the default listen addresses %v", addrs, DefaultListenAddrs)
+	}
+	if _, err := parseListenAddrs([]string{"/ip4/0.0.0.0/tcp/4001", "not an address"}); err == nil {
+		t.Error("expected an error parsing an invalid address")
+	}
+}
+
+func TestTransportOptions(t *testing.T) {
+	tests := []struct {
+		name    string
+		addrs   []string
+		private bool
+		wantErr string
+	}{
+		{name: "tcp", addrs: []string{"/ip4/0.0.0.0/tcp/4001", "/ip6/::/tcp/4001"}},
+		{name: "quic", addrs: []string{"/ip4/0.0.0.0/udp/4001/quic-v1"}},
+		{name: "websocket", addrs: []string{"/ip4/0.0.0.0/tcp/4002/ws"}},
+		{name: "webtransport", addrs: []string{"/ip4/0.0.0.0/udp/4001/quic-v1/webtransport"}},
+		{name: "all", addrs: []string{"/ip4/0.0.0.0/tcp/4001", "/ip4/0.0.0.0/udp/4001/quic-v1", "/ip4/0.0.0.0/tcp/4002/ws"}},
+		{name: "secure websocket", addrs: []string{"/ip4/0.0.0.0/tcp/443/wss"}, wantErr: "/wss"},
+		{name: "tls websocket", addrs: []string{"/ip4/0.0.0.0/tcp/443/tls/ws"}, wantErr: "/wss"},
+		{name: "udp without quic", addrs: []string{"/ip4/0.0.0.0/udp/4001"}, wantErr: "expected tcp"},
+		{name: "private tcp", addrs: []string{"/ip4/0.0.0.0/tcp/4001"}, private: true},
+		{name: "private websocket", addrs: []string{"/ip4/0.0.0.0/tcp/4002/ws"}, private: true},
+		{name: "private quic", addrs: []string{"/ip4/0.0.0.0/tcp/4001", "/ip4/0.0.0.0/udp/4001/quic-v1"}, private: true, wantErr: "swarm key"},
+		{name: "private webtransport", addrs: []string{"/ip4/0.0.0.0/udp/4001/quic-v1/webtransport"}, private: true, wantErr: "swarm key"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			addrs, err := parseListenAddrs(tt.addrs)
+			if err != nil {
+				t.Fatal(err)
+			}
+			opts, err := transportOptions(addrs, tt.private)
+			if tt.wantErr == "" {
+				if err != nil || len(opts) == 0 {
+					t.Errorf("got %d options, error %v", len(opts), err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("got error %v, want an error mentioning %q", err, tt.wantErr)
+			}
+		})
+	}
+}
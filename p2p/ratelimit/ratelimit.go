@@ -0,0 +1,114 @@
+package ratelimit
+
+import (
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	"golang.org/x/time/rate"
+)
+
+const (
+	// FlagDuration is how long a peer stays flagged after one of its messages was throttled
+	FlagDuration = time.Minute
+
+	// idleTimeout is how long the bucket of a silent peer is kept around
+	idleTimeout = 10 * time.Minute
+)
+
+// Config holds the token bucket settings of a room
+type Config struct {
+	// Rate is the sustained number of messages per second allowed for each peer
+	Rate float64 `mapstructure:"rate"`
+	// Burst is the number of messages a peer can send at once
+	Burst int `mapstructure:"burst"`
+}
+
+// NewRateLimitConfig creates a default rate limit configuration
+func NewRateLimitConfig() *Config {
+	return &Config{
+		Rate:  2,
+		Burst: 10,
+	}
+}
+
+type bucket struct {
+	limiter       *rate.Limiter
+	lastSeen      time.Time
+	lastThrottled time.Time
+	throttled     uint64
+}
+
+// Limiter is a set of token buckets keyed by peer ID
+type Limiter struct {
+	config *Config
+
+	mu          sync.Mutex
+	buckets     map[peer.ID]*bucket
+	throttled   uint64
+	lastCleanup time.Time
+}
+
+// NewLimiter creates a limiter giving each peer its own token bucket
+func NewLimiter(config *Config) *Limiter {
+	if config == nil {
+		config = NewRateLimitConfig()
+	}
+	return &Limiter{
+		config:      config,
+		buckets:     make(map[peer.ID]*bucket),
+		lastCleanup: time.Now(),
+	}
+}
+
+// Allow reports whether a message from the peer may go through, taking a
+// token from its bucket. Throttled messages are counted.
+func (l *Limiter) Allow(p peer.ID) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	l.cleanup(now)
+
+	b, ok := l.buckets[p]
+	if !ok {
+		b = &bucket{limiter: rate.NewLimiter(rate.Limit(l.config.Rate), l.config.Burst)}
+		l.buckets[p] = b
+	}
+	b.lastSeen = now
+	if b.limiter.AllowN(now, 1) {
+		return true
+	}
+	b.throttled++
+	b.lastThrottled = now
+	l.throttled++
+	return false
+}
+
+// Flagged reports whether a message from the peer was throttled recently
+func (l *Limiter) Flagged(p peer.ID) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	b, ok := l.buckets[p]
+	return ok && b.throttled > 0 && time.Since(b.lastThrottled) < FlagDuration
+}
+
+// Throttled returns the total number of throttled messages
+func (l *Limiter) Throttled() uint64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.throttled
+}
+
+// cleanup drops the buckets of the peers that have been silent for a while
+func (l *Limiter) cleanup(now time.Time) {
+	if now.Sub(l.lastCleanup) < time.Minute {
+		return
+	}
+	l.lastCleanup = now
+	for p, b := range l.buckets {
+		if now.Sub(b.lastSeen) > idleTimeout {
+			delete(l.buckets, p)
+		}
+	}
+}
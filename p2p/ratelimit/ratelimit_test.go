@@ -0,0 +1,60 @@
+package ratelimit
+
+import (
+	"testing"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+func TestLimiter(t *testing.T) {
+	tests := []struct {
+		name        string
+		config      *Config
+		sent        int
+		wantAllowed int
+	}{
+		{name: "within burst", config: &Config{Rate: 0.001, Burst: 5}, sent: 5, wantAllowed: 5},
+		{name: "over burst", config: &Config{Rate: 0.001, Burst: 5}, sent: 8, wantAllowed: 5},
+		{name: "no burst", config: &Config{Rate: 0.001, Burst: 0}, sent: 3, wantAllowed: 0},
+		{name: "default config", config: nil, sent: 12, wantAllowed: NewRateLimitConfig().Burst},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := NewLimiter(tt.config)
+			p := peer.ID("alice")
+			allowed := 0
+			for i := 0; i < tt.sent; i++ {
+				if l.Allow(p) {
+					allowed++
+				}
+			}
+			if allowed != tt.wantAllowed {
+				t.Errorf("got %d messages allowed, want %d", allowed, tt.wantAllowed)
+			}
+			throttled := uint64(tt.sent - tt.wantAllowed)
+			if got := l.Throttled(); got != throttled {
+				t.Errorf("got %d messages throttled, want %d", got, throttled)
+			}
+			if got := l.Flagged(p); got != (throttled > 0) {
+				t.Errorf("got flagged %v, want %v", got, throttled > 0)
+			}
+		})
+	}
+}
+
+func TestLimiterPerPeer(t *testing.T) {
+	l := NewLimiter(&Config{Rate: 0.001, Burst: 1})
+	alice, bob := peer.ID("alice"), peer.ID("bob")
+	if !l.Allow(alice) || l.Allow(alice) {
+		t.Fatal("expected the second message of alice to be throttled")
+	}
+	if !l.Allow(bob) {
+		t.Error("bob was throttled by the messages of alice")
+	}
+	if !l.Flagged(alice) || l.Flagged(bob) {
+		t.Errorf("got flagged alice %v and bob %v, want only alice", l.Flagged(alice), l.Flagged(bob))
+	}
+	if l.Flagged(peer.ID("carol")) {
+		t.Error("an unknown peer is flagged")
+	}
+}
@@ -0,0 +1,129 @@
+package validator
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/alejoacosta74/go-logger"
+	"github.com/alejoacosta74/libp2p-chat-app/p2p/message"
+	"github.com/alejoacosta74/libp2p-chat-app/p2p/ratelimit"
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// Reasons for rejecting a message, used as keys of the rejection counters
+const (
+	ReasonSize   = "oversized"
+	ReasonDecode = "undecodable"
+	ReasonSender = "sender-mismatch"
+	ReasonRoom   = "wrong-room"
+	ReasonSkew   = "clock-skew"
+	ReasonRate   = "rate-limited"
+	ReasonMember = "not-member"
+)
+
+// Config holds the limits enforced on chat messages
+type Config struct {
+	// MaxMessageSize is the maximum size of an encoded message, in bytes
+	MaxMessageSize int
+	// MaxClockSkew is the maximum difference between a message timestamp and the local clock
+	MaxClockSkew time.Duration
+}
+
+// NewValidatorConfig creates a default validator configuration
+func NewValidatorConfig() *Config {
+	return &Config{
+		MaxMessageSize: 64 * 1024,
+		MaxClockSkew:   5 * time.Minute,
+	}
+}
+
+// Validator checks the messages of the chat topics before they are delivered
+// or relayed to other peers, and counts the rejected ones.
+type Validator struct {
+	config *Config
+
+	mu       sync.Mutex
+	rejected map[string]uint64
+}
+
+// NewValidator creates a validator enforcing the limits in config
+func NewValidator(config *Config) *Validator {
+	if config == nil {
+		config = NewValidatorConfig()
+	}
+	return &Validator{
+		config:   config,
+		rejected: make(map[string]uint64),
+	}
+}
+
+// TopicValidator returns the pubsub validator for the topic of the given room.
+// Malformed, oversized and spoofed messages are rejected, which also lowers the
+// score of the peer relaying them. Messages with a timestamp too far from the
+// local clock are ignored instead, as the sender may just have a skewed clock.
+// If limiter is not nil, the messages of a sender exceeding its rate are
+// ignored too, so that they are neither delivered nor propagated. The rate is
+// counted by signed origin rather than by relaying peer, so that the peers
+// relaying several senders are not throttled, while the peer score takes care
+// of the ones relaying invalid messages. If isMember is not nil, the room is
+// restricted and the messages of non-members are rejected, except the access
+// control lists, which are checked by the room.
+func (v *Validator) TopicValidator(roomName string, limiter *ratelimit.Limiter, isMember func(peer.ID) bool) pubsub.ValidatorEx {
+	return func(ctx context.Context, from peer.ID, msg *pubsub.Message) pubsub.ValidationResult {
+		if limiter != nil && !msg.Local && !limiter.Allow(msg.GetFrom()) {
+			return v.reject(ReasonRate, from, pubsub.ValidationIgnore)
+		}
+		if len(msg.Data) > v.config.MaxMessageSize {
+			return v.reject(ReasonSize, from, pubsub.ValidationReject)
+		}
+
+		env, err := message.Decode(msg.Data)
+		if err != nil {
+			return v.reject(ReasonDecode, from, pubsub.ValidationReject)
+		}
+		if env.SenderID != msg.GetFrom().String() {
+			return v.reject(ReasonSender, from, pubsub.ValidationReject)
+		}
+		if isMember != nil && env.Type != message.TypeACL && !isMember(msg.GetFrom()) {
+			return v.reject(ReasonMember, from, pubsub.ValidationReject)
+		}
+		// messages from peers predating the envelope carry no room nor timestamp
+		if env.Legacy {
+			return pubsub.ValidationAccept
+		}
+		if env.Room != roomName {
+			return v.reject(ReasonRoom, from, pubsub.ValidationReject)
+		}
+		if skew := time.Since(env.Time()); skew > v.config.MaxClockSkew || skew < -v.config.MaxClockSkew {
+			return v.reject(ReasonSkew, from, pubsub.ValidationIgnore)
+		}
+		return pubsub.ValidationAccept
+	}
+}
+
+// MaxClockSkew returns the maximum difference allowed between a message
+// timestamp and the local clock
+func (v *Validator) MaxClockSkew() time.Duration {
+	return v.config.MaxClockSkew
+}
+
+// Rejections returns the number of rejected messages for each reason
+func (v *Validator) Rejections() map[string]uint64 {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	counts := make(map[string]uint64, len(v.rejected))
+	for reason, n := range v.rejected {
+		counts[reason] = n
+	}
+	return counts
+}
+
+func (v *Validator) reject(reason string, from peer.ID, result pubsub.ValidationResult) pubsub.ValidationResult {
+	v.mu.Lock()
+	v.rejected[reason]++
+	v.mu.Unlock()
+	logger.Debugf("validator: dropping %s message relayed by %s", reason, from)
+	return result
+}
@@ -0,0 +1,118 @@
+package validator
+
+import (
+	"context"
+	"crypto/rand"
+	"testing"
+	"time"
+
+	"github.com/alejoacosta74/libp2p-chat-app/p2p/message"
+	"github.com/alejoacosta74/libp2p-chat-app/p2p/ratelimit"
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	pb "github.com/libp2p/go-libp2p-pubsub/pb"
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+func newPeer(t *testing.T) peer.ID {
+	t.Helper()
+	_, pub, err := crypto.GenerateEd25519Key(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := peer.IDFromPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
+
+// newMessage returns the pubsub message signed by origin, carrying data
+func newMessage(origin peer.ID, data []byte) *pubsub.Message {
+	return &pubsub.Message{Message: &pb.Message{From: []byte(origin), Data: data}}
+}
+
+func TestTopicValidator(t *testing.T) {
+	alice, mallory, relay := newPeer(t), newPeer(t), newPeer(t)
+	// envelope returns the encoded chat envelope of sender, modified by fn
+	envelope := func(sender peer.ID, fn func(e *message.Envelope)) []byte {
+		e := message.New(message.TypeChat, "lobby", sender.String(), "nick", []byte("hello"))
+		if fn != nil {
+			fn(e)
+		}
+		data, err := message.Encode(e, message.FormatProtobuf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return data
+	}
+	isMember := func(p peer.ID) bool { return p == alice }
+
+	tests := []struct {
+		name       string
+		msg        *pubsub.Message
+		restricted bool
+		want       pubsub.ValidationResult
+		wantReason string
+	}{
+		{name: "valid", msg: newMessage(alice, envelope(alice, nil)), want: pubsub.ValidationAccept},
+		{name: "legacy", msg: newMessage(alice, []byte(`{"Message":"hi","SenderID":"`+alice.String()+`"}`)), want: pubsub.ValidationAccept},
+		{name: "oversized", msg: newMessage(alice, envelope(alice, func(e *message.Envelope) { e.Payload = make([]byte, 64*1024) })), want: pubsub.ValidationReject, wantReason: ReasonSize},
+		{name: "undecodable", msg: newMessage(alice, []byte{0xff}), want: pubsub.ValidationReject, wantReason: ReasonDecode},
+		{name: "empty", msg: newMessage(alice, nil), want: pubsub.ValidationReject, wantReason: ReasonDecode},
+		{name: "protobuf without version", msg: newMessage(alice, envelope(alice, func(e *message.Envelope) { e.Version, e.Room, e.Timestamp = 0, "other", 1 })), want: pubsub.ValidationReject, wantReason: ReasonDecode},
+		{name: "spoofed sender", msg: newMessage(mallory, envelope(alice, nil)), want: pubsub.ValidationReject, wantReason: ReasonSender},
+		{name: "wrong room", msg: newMessage(alice, envelope(alice, func(e *message.Envelope) { e.Room = "other" })), want: pubsub.ValidationReject, wantReason: ReasonRoom},
+		{name: "future timestamp", msg: newMessage(alice, envelope(alice, func(e *message.Envelope) { e.Timestamp += time.Hour.Milliseconds() })), want: pubsub.ValidationIgnore, wantReason: ReasonSkew},
+		{name: "past timestamp", msg: newMessage(alice, envelope(alice, func(e *message.Envelope) { e.Timestamp -= time.Hour.Milliseconds() })), want: pubsub.ValidationIgnore, wantReason: ReasonSkew},
+		{name: "member", msg: newMessage(alice, envelope(alice, nil)), restricted: true, want: pubsub.ValidationAccept},
+		{name: "not a member", msg: newMessage(mallory, envelope(mallory, nil)), restricted: true, want: pubsub.ValidationReject, wantReason: ReasonMember},
+		{name: "list from a non-member", msg: newMessage(mallory, envelope(mallory, func(e *message.Envelope) { e.Type = message.TypeACL })), restricted: true, want: pubsub.ValidationAccept},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := NewValidator(nil)
+			var member func(peer.ID) bool
+			if tt.restricted {
+				member = isMember
+			}
+			got := v.TopicValidator("lobby", nil, member)(context.Background(), relay, tt.msg)
+			if got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+			rejections := v.Rejections()
+			if tt.wantReason == "" && len(rejections) > 0 {
+				t.Errorf("got rejections %v, want none", rejections)
+			} else if tt.wantReason != "" && rejections[tt.wantReason] != 1 {
+				t.Errorf("got rejections %v, want one %s", rejections, tt.wantReason)
+			}
+		})
+	}
+}
+
+func TestTopicValidatorRateLimit(t *testing.T) {
+	alice, bob, relay := newPeer(t), newPeer(t), newPeer(t)
+	v := NewValidator(nil)
+	limiter := ratelimit.NewLimiter(&ratelimit.Config{Rate: 0.001, Burst: 2})
+	validate := v.TopicValidator("lobby", limiter, nil)
+
+	send := func(sender peer.ID) pubsub.ValidationResult {
+		e := message.New(message.TypeChat, "lobby", sender.String(), "nick", []byte("hello"))
+		return validate(context.Background(), relay, newMessage(sender, e.MarshalProto()))
+	}
+	for i := 0; i < 2; i++ {
+		if got := send(alice); got != pubsub.ValidationAccept {
+			t.Fatalf("message %d of alice: got %v, want accept", i, got)
+		}
+	}
+	if got := send(alice); got != pubsub.ValidationIgnore {
+		t.Errorf("message over the rate of alice: got %v, want ignore", got)
+	}
+	// the messages are limited by origin, not by the peer relaying them
+	if got := send(bob); got != pubsub.ValidationAccept {
+		t.Errorf("message of bob through the same relay: got %v, want accept", got)
+	}
+	if n := v.Rejections()[ReasonRate]; n != 1 {
+		t.Errorf("got %d rate limited messages, want 1", n)
+	}
+}